@@ -12,9 +12,33 @@ CREATE DATABASE "secnex_core";
 -- Reconnect to the database "secnex_core" and run the following script
 DROP TYPE IF EXISTS "method" CASCADE;
 DROP TYPE IF EXISTS "action" CASCADE;
+DROP TYPE IF EXISTS "waf_mode" CASCADE;
+DROP TYPE IF EXISTS "match_type" CASCADE;
+DROP TYPE IF EXISTS "path_match_type" CASCADE;
+DROP TYPE IF EXISTS "cert_match_type" CASCADE;
+DROP TYPE IF EXISTS "claim_operator" CASCADE;
+DROP TYPE IF EXISTS "auth_method" CASCADE;
+DROP TYPE IF EXISTS "auth_mode" CASCADE;
+DROP TYPE IF EXISTS "credential_type" CASCADE;
+DROP TYPE IF EXISTS "header_direction" CASCADE;
+DROP TYPE IF EXISTS "header_action" CASCADE;
+DROP TYPE IF EXISTS "security_profile" CASCADE;
 
+-- Rules with an empty "route_id" apply to every route using the firewall.
+-- Precedence: route deny > route allow > firewall deny > firewall allow > default
 CREATE TYPE "method" AS ENUM ('GET', 'POST', 'PUT', 'DELETE', 'PATCH', 'OPTIONS', 'HEAD', 'CONNECT', 'TRACE');
 CREATE TYPE "action" AS ENUM ('ALLOW', 'BLOCK');
+CREATE TYPE "waf_mode" AS ENUM ('OFF', 'DETECT', 'BLOCK');
+CREATE TYPE "match_type" AS ENUM ('EXACT', 'PREFIX', 'CONTAINS', 'REGEX', 'GLOB', 'CATEGORY');
+CREATE TYPE "path_match_type" AS ENUM ('GLOB', 'REGEX');
+CREATE TYPE "cert_match_type" AS ENUM ('SUBJECT', 'CN', 'DNS', 'URI', 'EMAIL');
+CREATE TYPE "claim_operator" AS ENUM ('EQUALS', 'CONTAINS', 'EXISTS');
+CREATE TYPE "auth_method" AS ENUM ('API_KEY', 'BASIC', 'JWT', 'MTLS', 'INTROSPECTION', 'HMAC', 'NONE');
+CREATE TYPE "auth_mode" AS ENUM ('ANY', 'ALL');
+CREATE TYPE "credential_type" AS ENUM ('HEADER', 'BEARER', 'BASIC', 'OAUTH2');
+CREATE TYPE "header_direction" AS ENUM ('REQUEST', 'RESPONSE');
+CREATE TYPE "header_action" AS ENUM ('ADD', 'SET', 'REMOVE', 'RENAME');
+CREATE TYPE "security_profile" AS ENUM ('NONE', 'API', 'STRICT');
 
 CREATE TABLE servers (
     "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
@@ -22,21 +46,109 @@ CREATE TABLE servers (
     "address" TEXT NOT NULL,
     "port" INT NOT NULL,
     "base_path" TEXT NOT NULL DEFAULT '/api/v1',
+    "tls_enabled" BOOLEAN NOT NULL DEFAULT false,
+    "tls_port" INT NOT NULL DEFAULT 443,
+    "tls_min_version" TEXT NOT NULL DEFAULT '1.2',
+    "tls_cipher_suites" TEXT[],
+    "tls_cert_file" TEXT,
+    "tls_key_file" TEXT,
+    "tls_redirect" BOOLEAN NOT NULL DEFAULT true,
+    "tls_client_auth" BOOLEAN NOT NULL DEFAULT false,
     "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "deleted_at" TIMESTAMPTZ
 );
 
+-- Certificates are selected by the DNS names of the certificate (SNI). A
+-- certificate without server applies to all servers.
+CREATE TABLE "certificates" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "server_id" UUID,
+    "name" TEXT NOT NULL,
+    "cert_file" TEXT,
+    "key_file" TEXT,
+    "certificate" TEXT,
+    "private_key" TEXT,
+    "acme_domain" TEXT,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    CHECK (("cert_file" IS NOT NULL AND "key_file" IS NOT NULL) OR ("certificate" IS NOT NULL AND "private_key" IS NOT NULL)),
+    FOREIGN KEY ("server_id") REFERENCES "servers" ("id") ON DELETE CASCADE
+);
+
+-- ACME account keys are shared by all gateway instances per directory
+CREATE TABLE "acme_accounts" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "directory_url" TEXT NOT NULL UNIQUE,
+    "email" TEXT,
+    "private_key" TEXT NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ
+);
+
+-- Domains with certificates issued via ACME, for all servers if server_id
+-- is NULL
+CREATE TABLE "acme_domains" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "server_id" UUID,
+    "domain" TEXT NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    UNIQUE NULLS NOT DISTINCT ("server_id", "domain"),
+    FOREIGN KEY ("server_id") REFERENCES "servers" ("id") ON DELETE CASCADE
+);
+
+-- Pending challenges, answered by whichever instance the ACME server reaches
+CREATE TABLE "acme_challenges" (
+    "token" TEXT PRIMARY KEY,
+    "domain" TEXT NOT NULL,
+    "type" TEXT NOT NULL,
+    "expires_at" TIMESTAMPTZ NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
 CREATE TABLE firewalls (
     "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     "name" TEXT NOT NULL,
     "allow_all" BOOLEAN NOT NULL DEFAULT TRUE,
     "require_auth" BOOLEAN NOT NULL DEFAULT FALSE,
+    "auth_mode" auth_mode NOT NULL DEFAULT 'ANY',
     "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "deleted_at" TIMESTAMPTZ
 );
 
+-- Authentication methods of a firewall, tried in the order of "position".
+-- With "auth_mode" ANY the first successful method wins, with ALL every
+-- method must succeed. Without entries a route uses mTLS, JWT, token
+-- introspection or API keys, depending on its configuration.
+CREATE TABLE "auth_methods" (
+    "firewall_id" UUID NOT NULL,
+    "method" auth_method NOT NULL,
+    "position" INTEGER NOT NULL DEFAULT 0,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    PRIMARY KEY ("firewall_id", "method"),
+    FOREIGN KEY ("firewall_id") REFERENCES "firewalls" ("id") ON DELETE CASCADE
+);
+
+-- Users of HTTP Basic authentication, password_hash is an argon2id hash
+CREATE TABLE "basic_users" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "firewall_id" UUID NOT NULL,
+    "username" TEXT NOT NULL,
+    "password_hash" TEXT NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    UNIQUE ("firewall_id", "username"),
+    FOREIGN KEY ("firewall_id") REFERENCES "firewalls" ("id") ON DELETE CASCADE
+);
+
 CREATE TABLE "routes" (
     "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     "name" TEXT NOT NULL,
@@ -55,43 +167,112 @@ CREATE TABLE "routes" (
 
 CREATE TABLE "methods" (
     "firewall_id" UUID NOT NULL,
-    "route_id" UUID NOT NULL,
+    "route_id" UUID,
     "method" "method" NOT NULL,
     "action" "action" NOT NULL DEFAULT 'ALLOW',
     "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "deleted_at" TIMESTAMPTZ,
-    PRIMARY KEY ("firewall_id", "route_id", "method"),
+    UNIQUE NULLS NOT DISTINCT ("firewall_id", "route_id", "method"),
     FOREIGN KEY ("firewall_id") REFERENCES "firewall" ("id") ON DELETE CASCADE,
     FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
 );
 
 CREATE TABLE "ips" (
     "firewall_id" UUID NOT NULL,
-    "route_id" UUID NOT NULL,
+    "route_id" UUID,
     "ip" TEXT NOT NULL,
     "action" "action" NOT NULL DEFAULT 'ALLOW',
     "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "deleted_at" TIMESTAMPTZ,
-    PRIMARY KEY ("firewall_id", "route_id", "ip"),
+    UNIQUE NULLS NOT DISTINCT ("firewall_id", "route_id", "ip"),
     FOREIGN KEY ("firewall_id") REFERENCES "firewall" ("id") ON DELETE CASCADE,
     FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
 );
 
 CREATE TABLE "useragents" (
     "firewall_id" UUID NOT NULL,
-    "route_id" UUID NOT NULL,
+    "route_id" UUID,
     "useragent" TEXT NOT NULL,
     "action" "action" NOT NULL DEFAULT 'ALLOW',
+    "match_type" "match_type" NOT NULL DEFAULT 'EXACT',
     "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
     "deleted_at" TIMESTAMPTZ,
-    PRIMARY KEY ("firewall_id", "route_id", "useragent"),
+    UNIQUE NULLS NOT DISTINCT ("firewall_id", "route_id", "useragent"),
     FOREIGN KEY ("firewall_id") REFERENCES "firewall" ("id") ON DELETE CASCADE,
     FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
 );
 
+CREATE TABLE "countries" (
+    "firewall_id" UUID NOT NULL,
+    "route_id" UUID,
+    "country" CHAR(2) NOT NULL,
+    "action" "action" NOT NULL DEFAULT 'ALLOW',
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    UNIQUE NULLS NOT DISTINCT ("firewall_id", "route_id", "country"),
+    FOREIGN KEY ("firewall_id") REFERENCES "firewall" ("id") ON DELETE CASCADE,
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+CREATE TABLE "asns" (
+    "firewall_id" UUID NOT NULL,
+    "route_id" UUID,
+    "asn" BIGINT NOT NULL,
+    "action" "action" NOT NULL DEFAULT 'ALLOW',
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    UNIQUE NULLS NOT DISTINCT ("firewall_id", "route_id", "asn"),
+    FOREIGN KEY ("firewall_id") REFERENCES "firewall" ("id") ON DELETE CASCADE,
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+CREATE TABLE "paths" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "firewall_id" UUID NOT NULL,
+    "route_id" UUID,
+    "pattern" TEXT NOT NULL,
+    "match_type" "path_match_type" NOT NULL DEFAULT 'GLOB',
+    "action" "action" NOT NULL DEFAULT 'ALLOW',
+    "methods" "method"[],
+    "ips" TEXT[],
+    "require_auth" BOOLEAN,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    FOREIGN KEY ("firewall_id") REFERENCES "firewall" ("id") ON DELETE CASCADE,
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+CREATE TABLE "wafs" (
+    "route_id" UUID PRIMARY KEY,
+    "mode" "waf_mode" NOT NULL DEFAULT 'OFF',
+    "threshold" INT NOT NULL DEFAULT 5,
+    "max_body_size" INT NOT NULL DEFAULT 65536,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+CREATE TABLE "waf_rules" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL,
+    "name" TEXT NOT NULL,
+    "file" TEXT,
+    "rules" TEXT,
+    "position" INT NOT NULL DEFAULT 0,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    CHECK ("file" IS NOT NULL OR "rules" IS NOT NULL),
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
 CREATE TABLE "auths" (
     "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     "api_key" TEXT NOT NULL,
@@ -100,6 +281,235 @@ CREATE TABLE "auths" (
     "deleted_at" TIMESTAMPTZ
 );
 
+-- Shared secrets for HMAC request signing, the key id is the id of the
+-- auth. The secret is encrypted with the master key of the gateway.
+CREATE TABLE "hmac_secrets" (
+    "auth_id" UUID PRIMARY KEY,
+    "secret" TEXT NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    FOREIGN KEY ("auth_id") REFERENCES "auths" ("id") ON DELETE CASCADE
+);
+
+-- Nonces of signed requests, shared by all gateway instances so a request
+-- cannot be replayed on another instance. nonce is the SHA-256 (hex) of the
+-- key id and the nonce, expired rows are deleted by the gateways.
+CREATE TABLE "signature_nonces" (
+    "nonce" TEXT PRIMARY KEY,
+    "expires_at" TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX "signature_nonces_expires_at" ON "signature_nonces" ("expires_at");
+
+-- Client certificate authentication of a route, the CA bundle is read from
+-- ca_file or ca_bundle
+CREATE TABLE "route_mtls" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL UNIQUE,
+    "ca_file" TEXT,
+    "ca_bundle" TEXT,
+    "crl_files" TEXT[],
+    "forward_headers" BOOLEAN NOT NULL DEFAULT true,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    CHECK ("ca_file" IS NOT NULL OR "ca_bundle" IS NOT NULL),
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+-- Allowed client certificates of a route and the principal they map to. If
+-- a route has no entries, every certificate of the CA is allowed.
+CREATE TABLE "route_mtls_principals" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL,
+    "match_type" cert_match_type NOT NULL DEFAULT 'CN',
+    "value" TEXT NOT NULL,
+    "principal" TEXT NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+-- TLS toward the target of a route. The CA bundle replaces the system roots,
+-- the client certificate is read from cert_file/key_file or certificate/
+-- private_key. pins are SHA-256 fingerprints (hex) of the public key of the
+-- target certificate or one of its CAs.
+CREATE TABLE "route_upstream_tls" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL UNIQUE,
+    "ca_file" TEXT,
+    "ca_bundle" TEXT,
+    "cert_file" TEXT,
+    "key_file" TEXT,
+    "certificate" TEXT,
+    "private_key" TEXT,
+    "server_name" TEXT,
+    "insecure_skip_verify" BOOLEAN NOT NULL DEFAULT false,
+    "min_version" TEXT NOT NULL DEFAULT '1.2',
+    "pins" TEXT[],
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    CHECK (("cert_file" IS NULL) = ("key_file" IS NULL)),
+    CHECK (("certificate" IS NULL) = ("private_key" IS NULL)),
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+-- Credentials of the gateway at the target of a route, set in "header"
+-- (default Authorization) of every forwarded request. "secret" is the header
+-- value (HEADER), the token (BEARER), the password of "username" (BASIC) or
+-- the client secret of "client_id" at "token_url" (OAUTH2, client
+-- credentials grant). The secret is encrypted with the master key.
+CREATE TABLE "route_credentials" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL,
+    "type" credential_type NOT NULL,
+    "header" TEXT,
+    "username" TEXT,
+    "secret" TEXT NOT NULL,
+    "token_url" TEXT,
+    "client_id" TEXT,
+    "scopes" TEXT[],
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    CHECK ("type" <> 'HEADER' OR "header" IS NOT NULL),
+    CHECK ("type" <> 'BASIC' OR "username" IS NOT NULL),
+    CHECK ("type" <> 'OAUTH2' OR ("token_url" IS NOT NULL AND "client_id" IS NOT NULL)),
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+-- Header changes of the upstream request or the response of a route, applied
+-- in the order of "position". "value" is the new name for RENAME, otherwise
+-- a template with the variables {client_ip}, {route}, {key_id} and
+-- {request_id}.
+CREATE TABLE "header_rules" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL,
+    "direction" header_direction NOT NULL,
+    "action" header_action NOT NULL,
+    "header" TEXT NOT NULL,
+    "value" TEXT,
+    "position" INTEGER NOT NULL DEFAULT 0,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    CHECK ("action" = 'REMOVE' OR "value" IS NOT NULL),
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+-- Security headers of the responses of a route. The header columns replace
+-- the values of the profile, an empty value omits the header. Headers of the
+-- target are kept unless "override" is set.
+CREATE TABLE "route_security_headers" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL UNIQUE,
+    "profile" security_profile NOT NULL DEFAULT 'STRICT',
+    "override" BOOLEAN NOT NULL DEFAULT false,
+    "hsts" TEXT,
+    "content_security_policy" TEXT,
+    "csp_report_only" BOOLEAN NOT NULL DEFAULT false,
+    "frame_options" TEXT,
+    "content_type_options" TEXT,
+    "referrer_policy" TEXT,
+    "permissions_policy" TEXT,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+-- JWT authentication of a route. Keys are fetched from jwks_url or read from
+-- jwks_file, HS256 tokens are verified with the secret.
+CREATE TABLE "route_jwt" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL UNIQUE,
+    "issuer" TEXT,
+    "audiences" TEXT[],
+    "algorithms" TEXT[] NOT NULL DEFAULT '{RS256,ES256,EdDSA}',
+    "jwks_url" TEXT,
+    "jwks_file" TEXT,
+    "secret" TEXT,
+    "jwks_refresh_seconds" INTEGER NOT NULL DEFAULT 3600,
+    "clock_skew_seconds" INTEGER NOT NULL DEFAULT 60,
+    "principal_claim" TEXT NOT NULL DEFAULT 'sub',
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    CHECK ("jwks_url" IS NOT NULL OR "jwks_file" IS NOT NULL OR "secret" IS NOT NULL),
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+-- Claims required by the JWT authentication of a route, e.g. scope CONTAINS
+-- orders:read. All rules must match.
+CREATE TABLE "route_jwt_claims" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL,
+    "claim" TEXT NOT NULL,
+    "operator" claim_operator NOT NULL DEFAULT 'EQUALS',
+    "value" TEXT NOT NULL DEFAULT '',
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+-- OpenID Connect login of a route for browsers. The session is stored in a
+-- cookie encrypted with cookie_secret.
+CREATE TABLE "route_oidc" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "route_id" UUID NOT NULL UNIQUE,
+    "issuer" TEXT NOT NULL,
+    "client_id" TEXT NOT NULL,
+    "client_secret" TEXT NOT NULL,
+    "redirect_url" TEXT,
+    "post_logout_redirect_url" TEXT,
+    "scopes" TEXT[] NOT NULL DEFAULT '{openid,profile,email}',
+    "cookie_name" TEXT NOT NULL DEFAULT '_gateway_session',
+    "cookie_secret" TEXT NOT NULL,
+    "session_lifetime_seconds" INTEGER NOT NULL DEFAULT 28800,
+    "pass_access_token" BOOLEAN NOT NULL DEFAULT false,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    CHECK (length("cookie_secret") >= 16),
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
+-- OAuth2 token introspection (RFC 7662) for the routes of a firewall
+CREATE TABLE "firewall_introspection" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "firewall_id" UUID NOT NULL UNIQUE,
+    "endpoint" TEXT NOT NULL,
+    "client_id" TEXT,
+    "client_secret" TEXT,
+    "timeout_ms" INTEGER NOT NULL DEFAULT 5000,
+    "cache_seconds" INTEGER NOT NULL DEFAULT 300,
+    "negative_cache_seconds" INTEGER NOT NULL DEFAULT 30,
+    "failure_threshold" INTEGER NOT NULL DEFAULT 5,
+    "cooldown_seconds" INTEGER NOT NULL DEFAULT 30,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    FOREIGN KEY ("firewall_id") REFERENCES "firewalls" ("id") ON DELETE CASCADE
+);
+
+-- Scopes an introspected token must have, for all routes of the firewall if
+-- "route_id" is empty
+CREATE TABLE "scopes" (
+    "firewall_id" UUID NOT NULL,
+    "route_id" UUID,
+    "scope" TEXT NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ,
+    UNIQUE NULLS NOT DISTINCT ("firewall_id", "route_id", "scope"),
+    FOREIGN KEY ("firewall_id") REFERENCES "firewalls" ("id") ON DELETE CASCADE,
+    FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE
+);
+
 CREATE TABLE "route_auths" (
     "route_id" UUID NOT NULL,
     "auth_id" UUID NOT NULL,
@@ -109,4 +519,62 @@ CREATE TABLE "route_auths" (
     PRIMARY KEY ("route_id", "auth_id"),
     FOREIGN KEY ("route_id") REFERENCES "routes" ("id") ON DELETE CASCADE,
     FOREIGN KEY ("auth_id") REFERENCES "auths" ("id") ON DELETE CASCADE
-);
\ No newline at end of file
+);
+
+CREATE TABLE "dynamic_bans" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "ip" TEXT NOT NULL,
+    "reason" TEXT NOT NULL,
+    "expires_at" TIMESTAMPTZ NOT NULL,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+    "deleted_at" TIMESTAMPTZ
+);
+
+CREATE INDEX "dynamic_bans_active" ON "dynamic_bans" ("expires_at") WHERE "deleted_at" IS NULL;
+CREATE TABLE "audit_events" (
+    "id" UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    "type" TEXT NOT NULL,
+    "actor" TEXT NOT NULL,
+    "actor_ip" TEXT,
+    "target" TEXT,
+    "request_id" TEXT,
+    "before" JSONB,
+    "after" JSONB,
+    "details" JSONB,
+    "created_at" TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX "audit_events_created_at" ON "audit_events" ("created_at");
+CREATE INDEX "audit_events_actor" ON "audit_events" ("actor", "created_at");
+CREATE INDEX "audit_events_type" ON "audit_events" ("type", "created_at");
+
+-- Audit events are append-only
+CREATE FUNCTION "audit_events_append_only"() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER "audit_events_append_only"
+    BEFORE UPDATE OR DELETE OR TRUNCATE ON "audit_events"
+    FOR EACH STATEMENT EXECUTE FUNCTION "audit_events_append_only"();
+
+-- API keys are managed directly in the database, changes are audited here
+CREATE FUNCTION "audit_auths"() RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO "audit_events" ("type", "actor", "target", "before", "after")
+    VALUES (
+        'key.' || lower(TG_OP),
+        current_user,
+        COALESCE(NEW."id", OLD."id")::TEXT,
+        CASE WHEN TG_OP = 'INSERT' THEN NULL ELSE jsonb_build_object('deleted_at', OLD."deleted_at") END,
+        CASE WHEN TG_OP = 'DELETE' THEN NULL ELSE jsonb_build_object('deleted_at', NEW."deleted_at") END
+    );
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER "audit_auths"
+    AFTER INSERT OR UPDATE OR DELETE ON "auths"
+    FOR EACH ROW EXECUTE FUNCTION "audit_auths"();
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/secnex/secnex-api-gateway/auth"
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/middleware"
+	apitypes "github.com/secnex/secnex-api-gateway/types"
+)
+
+// NewAdminAuthEnv creates the authentication of the admin API from
+// ADMIN_KEYS, the comma separated ids of the API keys in the auths table
+// which may use it. Without ids nil is returned and the admin API is
+// disabled.
+func NewAdminAuthEnv(cnx *db.Connection) (*auth.Chain, error) {
+	allowed := map[string]bool{}
+	for _, id := range strings.Split(os.Getenv("ADMIN_KEYS"), ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, fmt.Errorf("invalid ADMIN_KEYS id %q", id)
+		}
+		allowed[id] = true
+	}
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+	return auth.NewChain(auth.MODE_ANY, &auth.APIKeyAuthenticator{
+		Lookup: func(id string) (string, bool, error) {
+			key, ok, err := cnx.GetAuth(id)
+			return key.APIKey, ok, err
+		},
+		Allowed: allowed,
+	}), nil
+}
+
+// adminHandler authenticates requests of the admin API with an admin key.
+// The principal is set on the request info of the handler.
+func (s *Server) adminHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, info := middleware.WithRequestInfo(w, r)
+		principal, err := s.AdminAuth.Authenticate(r)
+		if err != nil {
+			status := auth.Status(err)
+			if status == http.StatusServiceUnavailable {
+				log.Printf("Admin authentication unavailable: %s request_id=%s\n", err, info.RequestID)
+				err = auth.ErrUnavailable
+			} else {
+				log.Printf("Admin authentication from %s failed: %s request_id=%s\n", clientAddress(r.RemoteAddr), err, info.RequestID)
+				for _, challenge := range s.AdminAuth.Challenges(err) {
+					w.Header().Add("WWW-Authenticate", challenge)
+				}
+			}
+			result := apitypes.ResultError{
+				Code:      status,
+				Message:   http.StatusText(status),
+				Error:     err.Error(),
+				RequestID: info.RequestID,
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write([]byte(result.String()))
+			return
+		}
+		info.Principal = principal
+		info.KeyID = principal.ID
+		next(w, r)
+	}
+}
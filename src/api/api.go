@@ -2,6 +2,8 @@ package api
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,24 +12,90 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/secnex/secnex-api-gateway/audit"
 	"github.com/secnex/secnex-api-gateway/auth"
+	"github.com/secnex/secnex-api-gateway/ban"
+	"github.com/secnex/secnex-api-gateway/geoip"
+	"github.com/secnex/secnex-api-gateway/metrics"
+	"github.com/secnex/secnex-api-gateway/middleware"
+	"github.com/secnex/secnex-api-gateway/oidc"
+	"github.com/secnex/secnex-api-gateway/tracing"
 	apitypes "github.com/secnex/secnex-api-gateway/types"
 )
 
+// errAnswered stops requests answered by the gateway itself, e.g. the
+// login redirects. It is no rejection.
+var errAnswered = errors.New("answered by the gateway")
+
+// Reasons of rejected requests. They are the labels of the rejection
+// metric, errors may contain values of clients and identity providers.
+const REJECT_BAN = "ban"
+const REJECT_ROUTE = "route"
+const REJECT_IP = "ip"
+const REJECT_COUNTRY = "country"
+const REJECT_ASN = "asn"
+const REJECT_USER_AGENT = "ua"
+const REJECT_PATH = "path"
+const REJECT_METHOD = "method"
+const REJECT_WAF = "waf"
+const REJECT_AUTH = "auth"
+const REJECT_OTHER = "other"
+
+// rejection is the error of a request check with the reason of the check
+type rejection struct {
+	reason string
+	err    error
+}
+
+func reject(reason string, err error) error {
+	return rejection{reason: reason, err: err}
+}
+
+func (r rejection) Error() string {
+	return r.err.Error()
+}
+
+func (r rejection) Unwrap() error {
+	return r.err
+}
+
+// rejectionReason returns the reason of a rejection error
+func rejectionReason(err error) string {
+	var r rejection
+	if errors.As(err, &r) {
+		return r.reason
+	}
+	return REJECT_OTHER
+}
+
 // Forward forwards the request to the target URL
 func (s *Server) Handler(w http.ResponseWriter, r *http.Request) {
 	route, remainingPath, err := s.CheckProxyRequest(w, r)
 	if err != nil {
+		if !errors.Is(err, errAnswered) {
+			metrics.FirewallRejections.Inc(rejectionReason(err))
+		}
 		return
 	}
+	info := middleware.GetRequestInfo(r)
 	targetURL, err := s.constructTargetURL(route.URL, remainingPath, r.URL.RawQuery)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("Invalid target URL of route %s: %s request_id=%s\n", route.Name, err, info.RequestID)
+		result := apitypes.ResultError{
+			Code:      http.StatusBadRequest,
+			Message:   "Bad request",
+			Error:     "Invalid target URL",
+			RequestID: info.RequestID,
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(result.String()))
 		return
 	}
+	info.TargetURL = targetURL.String()
 
-	s.proxyRequest(w, r, targetURL)
+	s.proxyRequest(w, r, route, targetURL)
 }
 
 // Handler to refresh the routes
@@ -37,10 +105,11 @@ func (s *Server) Refresh(w http.ResponseWriter, r *http.Request) {
 	}
 	routes, err := s.RefreshRoutes(s.Database)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		internalError(w, r, err)
 		return
 	}
 
+	s.recordRefresh(r, s.Routes, routes)
 	s.SetRoutes(routes)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -63,102 +132,366 @@ func (s *Server) Health(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(result.String()))
 }
 
+// Handler to list and lift the automatic bans, served by the admin listener
+func (s *Server) Bans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.BanManager == nil {
+		result := apitypes.ResultError{
+			Code:      http.StatusNotFound,
+			Message:   "Not found",
+			Error:     "Automatic bans are disabled",
+			RequestID: middleware.GetRequestInfo(r).RequestID,
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(result.String()))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		bans, err := s.BanManager.List()
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		type banResult struct {
+			IP        string    `json:"ip"`
+			Reason    string    `json:"reason"`
+			ExpiresAt time.Time `json:"expires_at"`
+			CreatedAt string    `json:"created_at"`
+		}
+		results := []banResult{}
+		for _, ban := range bans {
+			results = append(results, banResult{IP: ban.IP, Reason: ban.Reason, ExpiresAt: ban.ExpiresAt, CreatedAt: ban.CreatedAt.String})
+		}
+		data, err := json.Marshal(results)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		result := apitypes.ResultData{
+			Code:    http.StatusOK,
+			Message: "Active bans",
+			Data:    string(data),
+		}
+		w.Write([]byte(result.String()))
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if net.ParseIP(ip) == nil {
+			result := apitypes.ResultError{
+				Code:      http.StatusBadRequest,
+				Message:   "Bad request",
+				Error:     "Invalid ip",
+				RequestID: middleware.GetRequestInfo(r).RequestID,
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(result.String()))
+			return
+		}
+		if err := s.BanManager.Lift(ip); err != nil {
+			internalError(w, r, err)
+			return
+		}
+		s.Audit.Record(audit.Event{
+			Type:      audit.EVENT_BAN_LIFTED,
+			Actor:     principal(r),
+			ActorIP:   clientAddress(r.RemoteAddr),
+			Target:    ip,
+			RequestID: middleware.GetRequestInfo(r).RequestID,
+		})
+		w.WriteHeader(http.StatusOK)
+		result := apitypes.Result{
+			Code:    http.StatusOK,
+			Message: "Ban lifted",
+		}
+		w.Write([]byte(result.String()))
+	default:
+		result := apitypes.ResultError{
+			Code:      http.StatusMethodNotAllowed,
+			Message:   "Method not allowed",
+			Error:     "Method not allowed",
+			RequestID: middleware.GetRequestInfo(r).RequestID,
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(result.String()))
+	}
+}
+
 // Check of request
-func (s *Server) CheckProxyRequest(w http.ResponseWriter, r *http.Request) (Route, string, error) {
+func (s *Server) CheckProxyRequest(w http.ResponseWriter, r *http.Request) (route Route, remainingPath string, err error) {
 	clientIP := r.RemoteAddr
 	w.Header().Set("Content-Type", "application/json")
+
+	// Each stage of the checks is traced, a rejection fails the active span.
+	// Rejections after the route lookup are security denials and audited.
+	var span *tracing.Span
+	current := ""
+	stage := func(name string) {
+		span.End()
+		current = name
+		_, span = tracing.Start(r.Context(), name, tracing.KIND_INTERNAL)
+	}
+	defer func() {
+		if err != nil && !errors.Is(err, errAnswered) {
+			span.SetError(err.Error())
+			if current != "route lookup" {
+				s.recordDenial(r, current, err)
+			}
+		}
+		span.End()
+	}()
+
+	// Resolve the origin of the client once for rules, logs and headers
+	location := s.GeoIP.Lookup(clientAddress(clientIP))
+	info := middleware.GetRequestInfo(r)
+	info.Country = location.Country
+	info.ASN = location.ASNString()
+	r.Header.Del(geoip.HEADER_COUNTRY)
+	r.Header.Del(geoip.HEADER_ASN)
+	if s.GeoIP != nil && s.GeoIP.ForwardHeaders {
+		r.Header.Set(geoip.HEADER_COUNTRY, location.Country)
+		r.Header.Set(geoip.HEADER_ASN, location.ASNString())
+	}
+
+	// Check if the client is banned
+	stage("ban check")
+	if s.BanManager.Banned(clientAddress(clientIP)) {
+		result := apitypes.ResultError{
+			Code:      http.StatusForbidden,
+			Message:   "Forbidden",
+			Error:     "IP banned",
+			RequestID: info.RequestID,
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(result.String()))
+		return Route{}, "", reject(REJECT_BAN, fmt.Errorf("ip banned"))
+	}
+
+	stage("route lookup")
 	_, routePath, remainingPath, err := s.extractPaths(r.URL.Path)
 	if err != nil {
 		result := apitypes.ResultError{
-			Code:    http.StatusBadRequest,
-			Message: "Bad request",
-			Error:   err.Error(),
+			Code:      http.StatusBadRequest,
+			Message:   "Bad request",
+			Error:     err.Error(),
+			RequestID: info.RequestID,
 		}
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(result.String()))
-		return Route{}, "", err
+		return Route{}, "", reject(REJECT_ROUTE, err)
 	}
+	// Path rules check the normalized path and the target gets the same path,
+	// so it cannot resolve e.g. "public/../admin" to a path which was not
+	// checked
+	remainingPath = strings.TrimPrefix(NormalizePath(remainingPath), "/")
 
-	route, err := s.GetRoute(routePath)
+	route, err = s.GetRoute(routePath)
 	if err != nil {
+		s.BanManager.Record(clientAddress(clientIP), ban.SIGNAL_NOT_FOUND)
 		result := apitypes.ResultError{
-			Code:    http.StatusNotFound,
-			Message: "Route not found",
-			Error:   err.Error(),
+			Code:      http.StatusNotFound,
+			Message:   "Route not found",
+			Error:     err.Error(),
+			RequestID: info.RequestID,
 		}
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte(result.String()))
-		return Route{}, "", err
+		return Route{}, "", reject(REJECT_ROUTE, err)
 	}
-	// Check if the client IP is allowed
-	if !s.CheckAllowedIP(route, clientIP) {
+	info.RouteName = route.Name
+	span.SetAttribute("gateway.route", route.Name)
+
+	// Check if the client IP is allowed or blocked
+	stage("firewall")
+	if decision := s.CheckIP(route, clientIP); !decision.Allowed {
+		message, err := "IP not allowed", fmt.Errorf("ip not allowed")
+		if decision.Denied() {
+			message, err = "IP blocked", fmt.Errorf("ip blocked")
+		}
 		result := apitypes.ResultError{
-			Code:    http.StatusForbidden,
-			Message: "Forbidden",
-			Error:   "IP not allowed",
+			Code:      http.StatusForbidden,
+			Message:   "Forbidden",
+			Error:     message,
+			RequestID: info.RequestID,
 		}
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte(result.String()))
-		return Route{}, "", fmt.Errorf("ip not allowed")
+		return Route{}, "", reject(REJECT_IP, err)
 	}
 
-	// Check if the client IP is blocked
-	if s.CheckBlockedIPs(route, clientIP) {
+	// Check if the country and the autonomous system are allowed
+	if decision := route.Countries.Evaluate(location.Country, true); !decision.Allowed {
+		message, err := "Country not allowed", fmt.Errorf("country not allowed")
+		if decision.Denied() {
+			message, err = "Country blocked", fmt.Errorf("country blocked")
+		}
+		result := apitypes.ResultError{
+			Code:      http.StatusForbidden,
+			Message:   "Forbidden",
+			Error:     message,
+			RequestID: info.RequestID,
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(result.String()))
+		return Route{}, "", reject(REJECT_COUNTRY, err)
+	}
+	if decision := route.ASNs.Evaluate(location.ASNString(), true); !decision.Allowed {
+		message, err := "ASN not allowed", fmt.Errorf("asn not allowed")
+		if decision.Denied() {
+			message, err = "ASN blocked", fmt.Errorf("asn blocked")
+		}
 		result := apitypes.ResultError{
-			Code:    http.StatusForbidden,
-			Message: "Forbidden",
-			Error:   "IP blocked",
+			Code:      http.StatusForbidden,
+			Message:   "Forbidden",
+			Error:     message,
+			RequestID: info.RequestID,
 		}
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte(result.String()))
-		return Route{}, "", fmt.Errorf("ip blocked")
+		return Route{}, "", reject(REJECT_ASN, err)
 	}
 
 	// Check if the user agent is allowed
 	if !s.CheckUserAgent(route, r.UserAgent()) {
 		result := apitypes.ResultError{
-			Code:    http.StatusForbidden,
-			Message: "Forbidden",
-			Error:   "User agent not allowed",
+			Code:      http.StatusForbidden,
+			Message:   "Forbidden",
+			Error:     "User agent not allowed",
+			RequestID: info.RequestID,
 		}
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte(result.String()))
-		return Route{}, "", fmt.Errorf("user agent not allowed")
+		return Route{}, "", reject(REJECT_USER_AGENT, fmt.Errorf("user agent not allowed"))
 	}
 
-	// Check if the method is allowed
-	if len(route.AllowedMethods) > 0 {
-		methodAllowed := false
-		for _, allowedMethod := range route.AllowedMethods {
-			if Method(r.Method) == allowedMethod {
-				methodAllowed = true
-				break
+	// Check the most specific rule of the sub-path
+	requiredAuth := route.RequiredAuth
+	if pathRule, ok := route.MatchPath(remainingPath); ok {
+		if pathRule.Blocked || !pathRule.AllowsIP(clientIP) {
+			result := apitypes.ResultError{
+				Code:      http.StatusForbidden,
+				Message:   "Forbidden",
+				Error:     "Path not allowed",
+				RequestID: info.RequestID,
 			}
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(result.String()))
+			return Route{}, "", reject(REJECT_PATH, fmt.Errorf("path not allowed"))
 		}
 
-		if !methodAllowed {
+		if !pathRule.AllowsMethod(r.Method) {
 			result := apitypes.ResultError{
-				Code:    http.StatusMethodNotAllowed,
-				Message: "Method not allowed",
-				Error:   "Method not allowed",
+				Code:      http.StatusMethodNotAllowed,
+				Message:   "Method not allowed",
+				Error:     "Method not allowed for path",
+				RequestID: info.RequestID,
 			}
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			w.Write([]byte(result.String()))
-			return Route{}, "", fmt.Errorf("method not allowed")
+			return Route{}, "", reject(REJECT_PATH, fmt.Errorf("method not allowed for path"))
+		}
+
+		if pathRule.RequireAuth != nil {
+			requiredAuth = *pathRule.RequireAuth
 		}
 	}
 
-	// Check if the Authorization header is required
-	if route.RequiredAuth {
-		if err := s.CheckAuthorizationHeader(r); err != nil {
+	// Check if the method is allowed
+	if !route.Methods.Evaluate(r.Method, true).Allowed {
+		result := apitypes.ResultError{
+			Code:      http.StatusMethodNotAllowed,
+			Message:   "Method not allowed",
+			Error:     "Method not allowed",
+			RequestID: info.RequestID,
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(result.String()))
+		return Route{}, "", reject(REJECT_METHOD, fmt.Errorf("method not allowed"))
+	}
+
+	// Inspect the request with the WAF of the route
+	if route.WAF.Enabled() {
+		stage("waf")
+		decision := route.WAF.Inspect(r)
+		info.WAF = "pass"
+		if decision.Blocked {
+			info.WAF = "block:" + decision.Reason
+		} else if len(decision.Matches) > 0 {
+			info.WAF = "detect:" + decision.Reason
+		}
+		span.SetAttribute("waf.score", decision.Score)
+		if len(decision.Matches) > 0 {
+			log.Printf("WAF %s: %s %s from %s scored %d (%s, %d rules matched) request_id=%s\n", route.WAF.Mode, r.Method, r.URL.Path, clientIP, decision.Score, decision.Reason, len(decision.Matches), info.RequestID)
+		}
+		if decision.Blocked {
+			s.BanManager.Record(clientAddress(clientIP), ban.SIGNAL_WAF)
+			status := http.StatusForbidden
+			if decision.Status != 0 {
+				status = decision.Status
+			}
 			result := apitypes.ResultError{
-				Code:    http.StatusUnauthorized,
-				Message: "Unauthorized",
-				Error:   err.Error(),
+				Code:      status,
+				Message:   http.StatusText(status),
+				Error:     "Request blocked by WAF",
+				Reason:    decision.Reason,
+				RequestID: info.RequestID,
 			}
-			w.WriteHeader(http.StatusUnauthorized)
+			w.WriteHeader(status)
 			w.Write([]byte(result.String()))
-			return Route{}, "", err
+			return Route{}, "", reject(REJECT_WAF, fmt.Errorf("request blocked by waf"))
+		}
+	}
+
+	// Identity headers of the gateway are never accepted from the client
+	for _, header := range ClientCertHeaders {
+		r.Header.Del(header)
+	}
+	for _, header := range oidc.IdentityHeaders {
+		r.Header.Del(header)
+	}
+
+	// Browser routes log in with OpenID Connect, all other routes use the
+	// authentication methods of their firewall
+	if requiredAuth && route.OIDC != nil {
+		stage("auth")
+		return s.checkLogin(w, r, route, remainingPath)
+	}
+	if requiredAuth {
+		stage("auth")
+		principal, err := route.Auth.Authenticate(r)
+		if err != nil {
+			status := auth.Status(err)
+			if status == http.StatusServiceUnavailable {
+				// The credentials may be valid, the client is not penalized
+				log.Printf("Authentication for route %s unavailable: %s request_id=%s\n", route.Name, err, info.RequestID)
+				err = auth.ErrUnavailable
+			} else {
+				s.BanManager.Record(clientAddress(clientIP), ban.SIGNAL_AUTH_FAILURE)
+				metrics.AuthFailures.Inc(route.Name)
+				for _, challenge := range route.Auth.Challenges(err) {
+					w.Header().Add("WWW-Authenticate", challenge)
+				}
+			}
+			result := apitypes.ResultError{
+				Code:      status,
+				Message:   http.StatusText(status),
+				Error:     err.Error(),
+				RequestID: info.RequestID,
+			}
+			w.WriteHeader(status)
+			w.Write([]byte(result.String()))
+			return Route{}, "", reject(REJECT_AUTH, err)
+		}
+		info.Principal = principal
+		info.KeyID = principal.ID
+		for header, value := range principal.Headers {
+			r.Header.Set(header, value)
+		}
+		for _, method := range principal.Methods {
+			if method == auth.METHOD_API_KEY {
+				s.Audit.KeyUsage(info.KeyID, clientAddress(clientIP), info.RequestID)
+			}
 		}
 	}
 
@@ -184,80 +517,73 @@ func (s *Server) CheckAuthorizationHeader(r *http.Request) error {
 	return nil
 }
 
-// checkAllowedIP checks if the client IP is allowed
-func (s *Server) CheckAllowedIP(r Route, clientIP string) bool {
-	// Check if IPv4 or IPv6
-	if strings.Contains(clientIP, "[") || strings.Contains(clientIP, "]") {
-		// Get all between []
-		clientIP = strings.Split(clientIP, "[")[1]
-		clientIP = strings.Split(clientIP, "]")[0]
-	} else {
-		// Get all before :
-		clientIP = strings.Split(clientIP, ":")[0]
-	}
-
-	if len(r.AllowedIPs) == 0 {
-		return r.DefaultAllowed
+// checkLogin handles the OpenID Connect login of browser routes. Requests
+// without session are redirected to the login, other clients are rejected.
+func (s *Server) checkLogin(w http.ResponseWriter, r *http.Request, route Route, remainingPath string) (Route, string, error) {
+	info := middleware.GetRequestInfo(r)
+	prefix := s.BasePath + "/" + route.Path
+	status, message := http.StatusUnauthorized, "Unauthorized"
+
+	var session *oidc.Session
+	var err error
+	switch remainingPath {
+	case oidc.CALLBACK_PATH:
+		if err = route.OIDC.Callback(w, r, prefix); err == nil {
+			return Route{}, "", errAnswered
+		}
+		// Errors of the callback contain values of the client and the
+		// provider, they are only logged
+		log.Printf("Login for route %s failed: %s request_id=%s\n", route.Name, err, info.RequestID)
+		err = oidc.ErrLoginFailed
+	case oidc.LOGOUT_PATH:
+		route.OIDC.Logout(w, r, prefix)
+		return Route{}, "", errAnswered
+	default:
+		session, err = route.OIDC.Session(w, r, prefix)
+		if errors.Is(err, oidc.ErrLoginRequired) && oidc.IsBrowser(r) {
+			if err = route.OIDC.Login(w, r, prefix); err == nil {
+				return Route{}, "", errAnswered
+			}
+			log.Printf("Login for route %s failed: %s request_id=%s\n", route.Name, err, info.RequestID)
+			status, message = http.StatusServiceUnavailable, "Service unavailable"
+			err = fmt.Errorf("identity provider unavailable")
+		} else if errors.Is(err, oidc.ErrLoginRequired) && err != oidc.ErrLoginRequired {
+			// A failed refresh contains the answer of the provider
+			log.Printf("Session refresh for route %s failed: %s request_id=%s\n", route.Name, err, info.RequestID)
+			err = oidc.ErrLoginRequired
+		}
 	}
-
-	clientAddr := net.ParseIP(clientIP)
-	for _, ip := range r.AllowedIPs {
-		if net.ParseIP(string(ip)).Equal(clientAddr) {
-			return true
+	if err != nil {
+		if status == http.StatusUnauthorized {
+			s.BanManager.Record(clientAddress(r.RemoteAddr), ban.SIGNAL_AUTH_FAILURE)
+			metrics.AuthFailures.Inc(route.Name)
+		}
+		result := apitypes.ResultError{
+			Code:      status,
+			Message:   message,
+			Error:     err.Error(),
+			RequestID: info.RequestID,
 		}
+		w.WriteHeader(status)
+		w.Write([]byte(result.String()))
+		return Route{}, "", reject(REJECT_AUTH, err)
 	}
 
-	return false
+	info.Principal = auth.NewPrincipal(session.Principal(), auth.METHOD_OIDC)
+	info.KeyID = info.Principal.ID
+	route.OIDC.ForwardIdentity(r, session)
+	route.OIDC.RemoveCookies(r)
+	return route, remainingPath, nil
 }
 
-// Check blocked IPs
-func (s *Server) CheckBlockedIPs(r Route, clientIP string) bool {
-	// Check if IPv4 or IPv6
-	if strings.Contains(clientIP, "[") || strings.Contains(clientIP, "]") {
-		// Get all between []
-		clientIP = strings.Split(clientIP, "[")[1]
-		clientIP = strings.Split(clientIP, "]")[0]
-	} else {
-		// Get all before :
-		clientIP = strings.Split(clientIP, ":")[0]
-	}
-
-	clientAddr := net.ParseIP(clientIP)
-	for _, ip := range r.BlockedIPs {
-		if net.ParseIP(string(ip)).Equal(clientAddr) {
-			return true
-		}
-	}
-
-	return false
+// CheckIP checks if the client IP is allowed by the route and its firewall
+func (s *Server) CheckIP(r Route, clientIP string) AccessDecision {
+	return r.IPs.Evaluate(clientAddress(clientIP), r.DefaultAllowed)
 }
 
 // Check user agent is allowed or rejected
 func (s *Server) CheckUserAgent(r Route, userAgent string) bool {
-	status := true
-	if len(r.AllowedUserAgents) > 0 {
-		status = false
-		for _, allowedUserAgent := range r.AllowedUserAgents {
-			if UserAgent(userAgent) == allowedUserAgent {
-				status = true
-				break
-			}
-		}
-	}
-
-	if !status {
-		return false
-	}
-
-	if len(r.RejectedUserAgents) > 0 {
-		for _, rejectedUserAgent := range r.RejectedUserAgents {
-			if UserAgent(userAgent) == rejectedUserAgent {
-				return false
-			}
-		}
-	}
-
-	return true
+	return r.UserAgents.Evaluate(userAgent, true).Allowed
 }
 
 // extractPaths extracts the route path and the remaining path
@@ -294,15 +620,67 @@ func (s *Server) constructTargetURL(baseURL, remainingPath, rawQuery string) (*u
 	return targetURL, nil
 }
 
-func (s *Server) proxyRequest(w http.ResponseWriter, r *http.Request, targetURL *url.URL) {
-	s.Proxy.Director = func(req *http.Request) {
+func (s *Server) proxyRequest(w http.ResponseWriter, r *http.Request, route Route, targetURL *url.URL) {
+	ctx, span := tracing.Start(r.Context(), "upstream", tracing.KIND_CLIENT)
+	// The director depends on the request, so every request gets its own copy
+	// of the proxy
+	proxy := *s.Proxy
+	if route.Transport != nil {
+		proxy.Transport = route.Transport
+	}
+	proxy.Director = func(req *http.Request) {
 		req.URL = targetURL
 		req.Host = targetURL.Host
 		req.Method = r.Method
+		// Continue the trace in the target with the upstream span as parent
+		if span != nil {
+			req.Header.Set(tracing.HEADER_TRACEPARENT, span.Traceparent())
+			req.Header.Del(tracing.HEADER_TRACESTATE)
+			if span.Context.TraceState != "" {
+				req.Header.Set(tracing.HEADER_TRACESTATE, span.Context.TraceState)
+			}
+		}
+	}
+
+	info := middleware.GetRequestInfo(r)
+	// The credentials of the client are only valid at the gateway, they are
+	// removed on every route after the authentication
+	for _, header := range auth.CredentialHeaders {
+		r.Header.Del(header)
+	}
+	variables := templateVariables(r, route)
+	ApplyHeaderRules(r.Header, route.Headers.Request, variables)
+	for _, credential := range route.Credentials {
+		if err := credential.Apply(r); err != nil {
+			log.Printf("Upstream credentials for route %s unavailable: %s request_id=%s\n", route.Name, err, info.RequestID)
+			span.SetError(err.Error())
+			span.End()
+			result := apitypes.ResultError{
+				Code:      http.StatusBadGateway,
+				Message:   "Bad gateway",
+				Error:     "Upstream credentials unavailable",
+				RequestID: info.RequestID,
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(result.String()))
+			return
+		}
 	}
 
 	rec := httptest.NewRecorder()
-	s.Proxy.ServeHTTP(rec, r)
+	start := time.Now()
+	proxy.ServeHTTP(rec, r.WithContext(ctx))
+	info.UpstreamLatency = time.Since(start)
+	info.UpstreamStatus = rec.Code
+
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.full", targetURL.String())
+	span.SetAttribute("server.address", targetURL.Host)
+	span.SetAttribute("http.response.status_code", rec.Code)
+	if rec.Code >= http.StatusInternalServerError {
+		span.SetError(http.StatusText(rec.Code))
+	}
+	span.End()
 
 	if rec.Code == http.StatusBadGateway {
 		rec.Code = http.StatusNotFound
@@ -311,14 +689,20 @@ func (s *Server) proxyRequest(w http.ResponseWriter, r *http.Request, targetURL
 	for k, v := range rec.Header() {
 		w.Header()[k] = v
 	}
+	route.SecurityHeaders.Apply(w.Header(), r)
+	// The target may not echo the request id, the one of the gateway is kept
+	if info.RequestID != "" {
+		w.Header().Set(middleware.HEADER_REQUEST_ID, info.RequestID)
+	}
+	ApplyHeaderRules(w.Header(), route.Headers.Response, variables)
 	w.WriteHeader(rec.Code)
 	w.Write(rec.Body.Bytes())
 
-	s.logResponseDetails(rec.Body)
+	s.logResponseDetails(rec.Body, info.RequestID)
 }
 
 // logResponseDetails logs the response details
-func (s *Server) logResponseDetails(body *bytes.Buffer) {
+func (s *Server) logResponseDetails(body *bytes.Buffer, requestID string) {
 	bodyBytes, err := io.ReadAll(body)
 	if err == nil {
 		bodyString := string(bodyBytes)
@@ -326,7 +710,7 @@ func (s *Server) logResponseDetails(body *bytes.Buffer) {
 		titleEnd := strings.Index(bodyString, "</title>")
 		if titleStart != -1 && titleEnd != -1 && titleStart < titleEnd {
 			title := bodyString[titleStart+len("<title>") : titleEnd]
-			log.Printf("Page title: %s\n", title)
+			log.Printf("Page title: %s request_id=%s\n", title, requestID)
 		}
 	}
 }
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRejectionReason(t *testing.T) {
+	// The reason is fixed, the error may contain values of the client
+	err := reject(REJECT_AUTH, fmt.Errorf("login failed: %s", "<client value>"))
+	if reason := rejectionReason(err); reason != REJECT_AUTH {
+		t.Errorf("rejectionReason() = %q, want %q", reason, REJECT_AUTH)
+	}
+	if reason := rejectionReason(fmt.Errorf("wrapped: %w", err)); reason != REJECT_AUTH {
+		t.Errorf("rejectionReason() of wrapped error = %q, want %q", reason, REJECT_AUTH)
+	}
+	if reason := rejectionReason(errors.New("unknown")); reason != REJECT_OTHER {
+		t.Errorf("rejectionReason() without reason = %q, want %q", reason, REJECT_OTHER)
+	}
+
+	cause := errors.New("invalid token")
+	if !errors.Is(reject(REJECT_AUTH, cause), cause) || reject(REJECT_AUTH, cause).Error() != "invalid token" {
+		t.Error("rejection does not keep its cause")
+	}
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/audit"
+	"github.com/secnex/secnex-api-gateway/middleware"
+	apitypes "github.com/secnex/secnex-api-gateway/types"
+)
+
+const DEFAULT_AUDIT_LIMIT = 100
+const MAX_AUDIT_LIMIT = 1000
+
+// Actor of events of requests without verified principal
+const ACTOR_ANONYMOUS = "anonymous"
+
+// routeSummary is the audited configuration of a route
+type routeSummary struct {
+	Path           string `json:"path"`
+	URL            string `json:"url"`
+	DefaultAllowed bool   `json:"default_allowed"`
+	RequiredAuth   bool   `json:"required_auth"`
+	ForwardSubPath bool   `json:"forward_sub_path"`
+	WAF            string `json:"waf"`
+	Paths          int    `json:"paths"`
+}
+
+func summarizeRoute(route Route) routeSummary {
+	return routeSummary{
+		Path:           route.Path,
+		URL:            route.URL,
+		DefaultAllowed: route.DefaultAllowed,
+		RequiredAuth:   route.RequiredAuth,
+		ForwardSubPath: route.ForwardSubPath,
+		WAF:            string(route.WAF.Mode),
+		Paths:          len(route.Paths),
+	}
+}
+
+// diffRoutes returns the summaries of the routes which were removed or
+// changed before the refresh and of those added or changed after it
+func diffRoutes(before []Route, after []Route) (map[string]routeSummary, map[string]routeSummary) {
+	removed, added := map[string]routeSummary{}, map[string]routeSummary{}
+	for _, route := range before {
+		removed[route.Name] = summarizeRoute(route)
+	}
+	for _, route := range after {
+		added[route.Name] = summarizeRoute(route)
+	}
+
+	for name, summary := range removed {
+		if current, ok := added[name]; ok && current == summary {
+			delete(removed, name)
+			delete(added, name)
+		}
+	}
+	return removed, added
+}
+
+// principal identifies the caller of an admin endpoint by the id of its
+// key. Only principals verified by an authenticator are recorded.
+func principal(r *http.Request) string {
+	if info := middleware.GetRequestInfo(r); info.Principal != nil {
+		return info.Principal.ID
+	}
+	return ACTOR_ANONYMOUS
+}
+
+// recordRefresh records a route refresh with the changed routes. Periodic
+// refreshes without a request are only recorded if routes changed.
+func (s *Server) recordRefresh(r *http.Request, before []Route, after []Route) {
+	removed, added := diffRoutes(before, after)
+	if r == nil && len(removed)+len(added) == 0 {
+		return
+	}
+	event := audit.Event{
+		Type:   audit.EVENT_ROUTES_REFRESHED,
+		Target: s.Name,
+		Before: removed,
+		After:  added,
+		Details: map[string]interface{}{
+			"routes":  len(after),
+			"changed": len(removed)+len(added) > 0,
+		},
+	}
+	if r != nil {
+		event.Actor = principal(r)
+		event.ActorIP = clientAddress(r.RemoteAddr)
+		event.RequestID = middleware.GetRequestInfo(r).RequestID
+	}
+	s.Audit.Record(event)
+}
+
+// recordDenial records a request rejected by a security check
+func (s *Server) recordDenial(r *http.Request, stage string, err error) {
+	info := middleware.GetRequestInfo(r)
+	s.Audit.Record(audit.Event{
+		Type:      audit.EVENT_SECURITY_DENIED,
+		Actor:     clientAddress(r.RemoteAddr),
+		ActorIP:   clientAddress(r.RemoteAddr),
+		Target:    info.RouteName,
+		RequestID: info.RequestID,
+		Details: map[string]interface{}{
+			"stage":  stage,
+			"reason": err.Error(),
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"key_id": info.KeyID,
+		},
+	})
+}
+
+// Handler to query the audit log, served by the admin listener
+func (s *Server) AuditEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Audit == nil {
+		result := apitypes.ResultError{
+			Code:      http.StatusNotFound,
+			Message:   "Not found",
+			Error:     "Audit log is disabled",
+			RequestID: middleware.GetRequestInfo(r).RequestID,
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(result.String()))
+		return
+	}
+	if r.Method != http.MethodGet {
+		result := apitypes.ResultError{
+			Code:      http.StatusMethodNotAllowed,
+			Message:   "Method not allowed",
+			Error:     "Method not allowed",
+			RequestID: middleware.GetRequestInfo(r).RequestID,
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(result.String()))
+		return
+	}
+
+	query := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	limit := DEFAULT_AUDIT_LIMIT
+	var err error
+	if value := query.Get("from"); value != "" {
+		from, err = time.Parse(time.RFC3339, value)
+	}
+	if value := query.Get("to"); value != "" && err == nil {
+		to, err = time.Parse(time.RFC3339, value)
+	}
+	if value := query.Get("limit"); value != "" && err == nil {
+		limit, err = strconv.Atoi(value)
+		if err == nil && (limit <= 0 || limit > MAX_AUDIT_LIMIT) {
+			limit = MAX_AUDIT_LIMIT
+		}
+	}
+	if err != nil {
+		result := apitypes.ResultError{
+			Code:      http.StatusBadRequest,
+			Message:   "Bad request",
+			Error:     "Invalid from, to or limit",
+			RequestID: middleware.GetRequestInfo(r).RequestID,
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(result.String()))
+		return
+	}
+
+	events, err := s.Database.GetAuditEvents(from, to, query.Get("actor"), query.Get("type"), limit)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	type eventResult struct {
+		ID        string          `json:"id"`
+		Type      string          `json:"type"`
+		Actor     string          `json:"actor"`
+		ActorIP   string          `json:"actor_ip,omitempty"`
+		Target    string          `json:"target,omitempty"`
+		RequestID string          `json:"request_id,omitempty"`
+		Before    json.RawMessage `json:"before,omitempty"`
+		After     json.RawMessage `json:"after,omitempty"`
+		Details   json.RawMessage `json:"details,omitempty"`
+		CreatedAt time.Time       `json:"created_at"`
+	}
+	results := []eventResult{}
+	for _, event := range events {
+		results = append(results, eventResult{
+			ID:        event.ID,
+			Type:      event.Type,
+			Actor:     event.Actor,
+			ActorIP:   event.ActorIP.String,
+			Target:    event.Target.String,
+			RequestID: event.RequestID.String,
+			Before:    rawJSON(event.Before.String),
+			After:     rawJSON(event.After.String),
+			Details:   rawJSON(event.Details.String),
+			CreatedAt: event.CreatedAt,
+		})
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		internalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	result := apitypes.ResultData{
+		Code:    http.StatusOK,
+		Message: "Audit events",
+		Data:    string(data),
+	}
+	w.Write([]byte(result.String()))
+}
+
+func rawJSON(value string) json.RawMessage {
+	if value == "" {
+		return nil
+	}
+	return json.RawMessage(value)
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/secnex/secnex-api-gateway/auth"
+	"github.com/secnex/secnex-api-gateway/db"
+)
+
+// loadAuthChain creates the authentication chain of a route from the methods
+// of its firewall. Without methods the route uses mTLS, JWT or token
+// introspection if configured, otherwise API keys.
+func loadAuthChain(cnx *db.Connection, firewall db.Firewall, routeId string, route Route) (*auth.Chain, error) {
+	methods, err := cnx.GetAuthMethods(firewall.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(methods) == 0 {
+		switch {
+		case route.ClientAuth != nil:
+			return auth.NewChain(auth.MODE_ANY, route.ClientAuth), nil
+		case route.JWT != nil:
+			return auth.NewChain(auth.MODE_ANY, &auth.JWTAuthenticator{Validator: route.JWT}), nil
+		case route.Introspector != nil:
+			return auth.NewChain(auth.MODE_ANY, &auth.IntrospectionAuthenticator{Introspector: route.Introspector, Scopes: route.Scopes}), nil
+		}
+		authenticator, err := newAPIKeyAuthenticator(cnx, routeId)
+		if err != nil {
+			return nil, err
+		}
+		return auth.NewChain(auth.MODE_ANY, authenticator), nil
+	}
+
+	authenticators := []auth.Authenticator{}
+	for _, method := range methods {
+		var authenticator auth.Authenticator
+		switch method.Method {
+		case auth.METHOD_API_KEY:
+			authenticator, err = newAPIKeyAuthenticator(cnx, routeId)
+		case auth.METHOD_BASIC:
+			authenticator, err = newBasicAuthenticator(cnx, firewall)
+		case auth.METHOD_JWT:
+			if route.JWT == nil {
+				return nil, fmt.Errorf("route %s has no JWT settings", route.Name)
+			}
+			authenticator = &auth.JWTAuthenticator{Validator: route.JWT}
+		case auth.METHOD_MTLS:
+			if route.ClientAuth == nil {
+				return nil, fmt.Errorf("route %s has no client certificate settings", route.Name)
+			}
+			authenticator = route.ClientAuth
+		case auth.METHOD_INTROSPECTION:
+			if route.Introspector == nil {
+				return nil, fmt.Errorf("firewall %s has no token introspection", firewall.Name)
+			}
+			authenticator = &auth.IntrospectionAuthenticator{Introspector: route.Introspector, Scopes: route.Scopes}
+		case auth.METHOD_HMAC:
+			authenticator, err = newHMACAuthenticator(cnx, routeId)
+		case auth.METHOD_NONE:
+			authenticator = &auth.NoneAuthenticator{}
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method.Method)
+		}
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	return auth.NewChain(firewall.AuthMode, authenticators...), nil
+}
+
+// newAPIKeyAuthenticator checks API keys of the auths table. Keys are
+// looked up per request, so revoked keys are rejected immediately. If the
+// route has entries in route_auths, only these keys are allowed.
+func newAPIKeyAuthenticator(cnx *db.Connection, routeId string) (*auth.APIKeyAuthenticator, error) {
+	allowed, err := routeAuths(cnx, routeId)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.APIKeyAuthenticator{
+		Lookup: func(id string) (string, bool, error) {
+			key, ok, err := cnx.GetAuth(id)
+			return key.APIKey, ok, err
+		},
+		Allowed: allowed,
+	}, nil
+}
+
+// newHMACAuthenticator checks signatures with the HMAC secrets of the auths
+// table. Like API keys, the route_auths entries of the route restrict the
+// allowed keys. Nonces are stored in the database, so they are shared by all
+// gateway instances.
+func newHMACAuthenticator(cnx *db.Connection, routeId string) (*auth.HMACAuthenticator, error) {
+	allowed, err := routeAuths(cnx, routeId)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.HMACAuthenticator{
+		Lookup: func(id string) (string, bool, error) {
+			secret, ok, err := cnx.GetHMACSecret(id)
+			return secret.Secret, ok, err
+		},
+		UseNonce: cnx.UseSignatureNonce,
+		Allowed:  allowed,
+	}, nil
+}
+
+// routeAuths returns the ids of the auths allowed for the route
+func routeAuths(cnx *db.Connection, routeId string) (map[string]bool, error) {
+	ids, err := cnx.GetRouteAuths(routeId)
+	if err != nil {
+		return nil, err
+	}
+	allowed := map[string]bool{}
+	for _, id := range ids {
+		allowed[id] = true
+	}
+	return allowed, nil
+}
+
+func newBasicAuthenticator(cnx *db.Connection, firewall db.Firewall) (*auth.BasicAuthenticator, error) {
+	users, err := cnx.GetBasicUsers(firewall.ID)
+	if err != nil {
+		return nil, err
+	}
+	authenticator := &auth.BasicAuthenticator{Realm: firewall.Name, Users: map[string]string{}}
+	for _, user := range users {
+		authenticator.Users[user.Username] = user.PasswordHash
+	}
+	return authenticator, nil
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/secnex/secnex-api-gateway/auth"
+	"github.com/secnex/secnex-api-gateway/db"
+)
+
+// Types of upstream credentials
+const CREDENTIAL_HEADER = "HEADER"
+const CREDENTIAL_BEARER = "BEARER"
+const CREDENTIAL_BASIC = "BASIC"
+const CREDENTIAL_OAUTH2 = "OAUTH2"
+
+// UpstreamCredential is a credential of the gateway at the target of a
+// route. The header is set to the value, or to a Bearer token of the token
+// source.
+type UpstreamCredential struct {
+	Header string
+	Value  string
+	Tokens *auth.TokenSource
+}
+
+// Apply sets the credential on the request, replacing the header
+func (c UpstreamCredential) Apply(r *http.Request) error {
+	if c.Tokens == nil {
+		r.Header.Set(c.Header, c.Value)
+		return nil
+	}
+	token, err := c.Tokens.Token()
+	if err != nil {
+		return err
+	}
+	r.Header.Set(c.Header, "Bearer "+token)
+	return nil
+}
+
+// NewUpstreamCredential creates the credential of a route_credentials entry
+func NewUpstreamCredential(credential db.Credential) (UpstreamCredential, error) {
+	upstream := UpstreamCredential{Header: credential.Header.String}
+	if upstream.Header == "" {
+		upstream.Header = "Authorization"
+	}
+	switch credential.Type {
+	case CREDENTIAL_HEADER:
+		upstream.Value = credential.Secret
+	case CREDENTIAL_BEARER:
+		upstream.Value = "Bearer " + credential.Secret
+	case CREDENTIAL_BASIC:
+		upstream.Value = "Basic " + base64.StdEncoding.EncodeToString([]byte(credential.Username.String+":"+credential.Secret))
+	case CREDENTIAL_OAUTH2:
+		upstream.Tokens = auth.SharedTokenSource(auth.ClientCredentialsConfig{
+			TokenURL:     credential.TokenURL.String,
+			ClientID:     credential.ClientID.String,
+			ClientSecret: credential.Secret,
+			Scope:        strings.Join(credential.Scopes, " "),
+		})
+	default:
+		return UpstreamCredential{}, fmt.Errorf("unknown credential type %q", credential.Type)
+	}
+	return upstream, nil
+}
+
+// loadUpstreamCredentials loads the credentials of the gateway at the
+// target of a route
+func loadUpstreamCredentials(cnx *db.Connection, routeId string) ([]UpstreamCredential, error) {
+	credentials, err := cnx.GetCredentials(routeId)
+	if err != nil {
+		return nil, err
+	}
+
+	var __credentials []UpstreamCredential
+	for _, credential := range credentials {
+		__credential, err := NewUpstreamCredential(credential)
+		if err != nil {
+			return nil, fmt.Errorf("credential %s of route %s: %w", credential.ID, routeId, err)
+		}
+		__credentials = append(__credentials, __credential)
+	}
+	return __credentials, nil
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/useragent"
+)
+
+// Matcher is a compiled list of rule values
+type Matcher interface {
+	Empty() bool
+	Match(value string) bool
+}
+
+// AccessList holds the allow and deny rules of the route and its firewall.
+// Rules are evaluated in the following order, the first match wins:
+//
+//  1. route deny
+//  2. route allow
+//  3. firewall deny
+//  4. firewall allow
+//  5. default
+//
+// Allow rules are exclusive: if any allow rule exists and none matched, the
+// value is rejected. Otherwise the default applies, which is the allow_all
+// setting of the firewall for IPs and true for all other rule types.
+type AccessList struct {
+	RouteAllow    Matcher
+	RouteDeny     Matcher
+	FirewallAllow Matcher
+	FirewallDeny  Matcher
+}
+
+// AccessDecision is the result of an access list evaluation
+type AccessDecision struct {
+	Allowed bool
+	Reason  string
+}
+
+const DECISION_ROUTE_DENY = "route deny"
+const DECISION_ROUTE_ALLOW = "route allow"
+const DECISION_FIREWALL_DENY = "firewall deny"
+const DECISION_FIREWALL_ALLOW = "firewall allow"
+const DECISION_NOT_ALLOWED = "not allowed"
+const DECISION_DEFAULT = "default"
+
+// Evaluate applies the precedence order of the access list to the value
+func (a AccessList) Evaluate(value string, defaultAllowed bool) AccessDecision {
+	switch {
+	case matches(a.RouteDeny, value):
+		return AccessDecision{Allowed: false, Reason: DECISION_ROUTE_DENY}
+	case matches(a.RouteAllow, value):
+		return AccessDecision{Allowed: true, Reason: DECISION_ROUTE_ALLOW}
+	case matches(a.FirewallDeny, value):
+		return AccessDecision{Allowed: false, Reason: DECISION_FIREWALL_DENY}
+	case matches(a.FirewallAllow, value):
+		return AccessDecision{Allowed: true, Reason: DECISION_FIREWALL_ALLOW}
+	case !empty(a.RouteAllow) || !empty(a.FirewallAllow):
+		return AccessDecision{Allowed: false, Reason: DECISION_NOT_ALLOWED}
+	default:
+		return AccessDecision{Allowed: defaultAllowed, Reason: DECISION_DEFAULT}
+	}
+}
+
+// Denied returns true if the value was rejected by a deny rule
+func (d AccessDecision) Denied() bool {
+	return d.Reason == DECISION_ROUTE_DENY || d.Reason == DECISION_FIREWALL_DENY
+}
+
+func matches(m Matcher, value string) bool {
+	return !empty(m) && m.Match(value)
+}
+
+func empty(m Matcher) bool {
+	return m == nil || m.Empty()
+}
+
+// MethodList matches HTTP methods
+type MethodList []Method
+
+func (l MethodList) Empty() bool {
+	return len(l) == 0
+}
+
+func (l MethodList) Match(value string) bool {
+	for _, method := range l {
+		if Method(value) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// ValueSet matches exact values such as country codes and AS numbers
+type ValueSet map[string]bool
+
+func (v ValueSet) Empty() bool {
+	return len(v) == 0
+}
+
+func (v ValueSet) Match(value string) bool {
+	return v[value]
+}
+
+// IPList matches client addresses against IPs and CIDR ranges
+type IPList []*net.IPNet
+
+func (l IPList) Empty() bool {
+	return len(l) == 0
+}
+
+func (l IPList) Match(value string) bool {
+	clientAddr := net.ParseIP(value)
+	if clientAddr == nil {
+		return false
+	}
+	for _, network := range l {
+		if network.Contains(clientAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewIPList parses the addresses of the ip rules
+func NewIPList(ips []db.IP) (IPList, error) {
+	list := IPList{}
+	for _, ip := range ips {
+		network, err := parseNetwork(ip.IP)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, network)
+	}
+	return list, nil
+}
+
+// loadMethods loads the method rules of the route and its firewall
+func loadMethods(cnx *db.Connection, firewallId string, routeId string) (AccessList, error) {
+	list := AccessList{}
+	for _, action := range []string{db.ACTION_ALLOW, db.ACTION_REJECT} {
+		methods, err := cnx.GetMethods(firewallId, routeId, action)
+		if err != nil {
+			return AccessList{}, err
+		}
+		var routeMethods, firewallMethods MethodList
+		for _, method := range methods {
+			if method.RouteID.Valid {
+				routeMethods = append(routeMethods, Method(method.Method))
+			} else {
+				firewallMethods = append(firewallMethods, Method(method.Method))
+			}
+		}
+		list.set(action, routeMethods, firewallMethods)
+	}
+	return list, nil
+}
+
+// loadIPs loads the ip rules of the route and its firewall
+func loadIPs(cnx *db.Connection, firewallId string, routeId string) (AccessList, error) {
+	list := AccessList{}
+	for _, action := range []string{db.ACTION_ALLOW, db.ACTION_REJECT} {
+		ips, err := cnx.GetIPs(firewallId, routeId, action)
+		if err != nil {
+			return AccessList{}, err
+		}
+		var routeIPs, firewallIPs []db.IP
+		for _, ip := range ips {
+			if ip.RouteID.Valid {
+				routeIPs = append(routeIPs, ip)
+			} else {
+				firewallIPs = append(firewallIPs, ip)
+			}
+		}
+		routeList, err := NewIPList(routeIPs)
+		if err != nil {
+			return AccessList{}, err
+		}
+		firewallList, err := NewIPList(firewallIPs)
+		if err != nil {
+			return AccessList{}, err
+		}
+		list.set(action, routeList, firewallList)
+	}
+	return list, nil
+}
+
+// loadUserAgents loads and compiles the user agent rules of the route and
+// its firewall
+func loadUserAgents(cnx *db.Connection, firewallId string, routeId string) (AccessList, error) {
+	list := AccessList{}
+	for _, action := range []string{db.ACTION_ALLOW, db.ACTION_REJECT} {
+		useragents, err := cnx.GetUserAgents(firewallId, routeId, action)
+		if err != nil {
+			return AccessList{}, err
+		}
+		var routePatterns, firewallPatterns []useragent.Pattern
+		for _, __useragent := range useragents {
+			pattern := useragent.NewPattern(__useragent.UserAgent, __useragent.MatchType)
+			if __useragent.RouteID.Valid {
+				routePatterns = append(routePatterns, pattern)
+			} else {
+				firewallPatterns = append(firewallPatterns, pattern)
+			}
+		}
+		routeMatcher, err := useragent.Compile(routePatterns)
+		if err != nil {
+			return AccessList{}, err
+		}
+		firewallMatcher, err := useragent.Compile(firewallPatterns)
+		if err != nil {
+			return AccessList{}, err
+		}
+		list.set(action, routeMatcher, firewallMatcher)
+	}
+	return list, nil
+}
+
+// loadCountries loads the country rules of the route and its firewall
+func loadCountries(cnx *db.Connection, firewallId string, routeId string) (AccessList, error) {
+	list := AccessList{}
+	for _, action := range []string{db.ACTION_ALLOW, db.ACTION_REJECT} {
+		countries, err := cnx.GetCountries(firewallId, routeId, action)
+		if err != nil {
+			return AccessList{}, err
+		}
+		routeCountries, firewallCountries := ValueSet{}, ValueSet{}
+		for _, country := range countries {
+			if country.RouteID.Valid {
+				routeCountries[strings.ToUpper(country.Country)] = true
+			} else {
+				firewallCountries[strings.ToUpper(country.Country)] = true
+			}
+		}
+		list.set(action, routeCountries, firewallCountries)
+	}
+	return list, nil
+}
+
+// loadASNs loads the autonomous system rules of the route and its firewall
+func loadASNs(cnx *db.Connection, firewallId string, routeId string) (AccessList, error) {
+	list := AccessList{}
+	for _, action := range []string{db.ACTION_ALLOW, db.ACTION_REJECT} {
+		asns, err := cnx.GetASNs(firewallId, routeId, action)
+		if err != nil {
+			return AccessList{}, err
+		}
+		routeASNs, firewallASNs := ValueSet{}, ValueSet{}
+		for _, asn := range asns {
+			if asn.RouteID.Valid {
+				routeASNs[strconv.FormatInt(asn.ASN, 10)] = true
+			} else {
+				firewallASNs[strconv.FormatInt(asn.ASN, 10)] = true
+			}
+		}
+		list.set(action, routeASNs, firewallASNs)
+	}
+	return list, nil
+}
+
+func (a *AccessList) set(action string, route Matcher, firewall Matcher) {
+	if action == db.ACTION_REJECT {
+		a.RouteDeny = route
+		a.FirewallDeny = firewall
+		return
+	}
+	a.RouteAllow = route
+	a.FirewallAllow = firewall
+}
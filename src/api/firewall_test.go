@@ -0,0 +1,176 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/secnex/secnex-api-gateway/db"
+)
+
+func mustIPList(t *testing.T, ips ...string) IPList {
+	t.Helper()
+	rules := []db.IP{}
+	for _, ip := range ips {
+		rules = append(rules, db.IP{IP: ip})
+	}
+	list, err := NewIPList(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestAccessListEvaluate(t *testing.T) {
+	tests := []struct {
+		name           string
+		list           AccessList
+		value          string
+		defaultAllowed bool
+		allowed        bool
+		reason         string
+	}{
+		{
+			name:           "no rules allows by default",
+			value:          "GET",
+			defaultAllowed: true,
+			allowed:        true,
+			reason:         DECISION_DEFAULT,
+		},
+		{
+			name:           "no rules rejects by default",
+			value:          "GET",
+			defaultAllowed: false,
+			allowed:        false,
+			reason:         DECISION_DEFAULT,
+		},
+		{
+			name:           "route deny over route allow",
+			list:           AccessList{RouteAllow: MethodList{"DELETE"}, RouteDeny: MethodList{"DELETE"}},
+			value:          "DELETE",
+			defaultAllowed: true,
+			allowed:        false,
+			reason:         DECISION_ROUTE_DENY,
+		},
+		{
+			name:           "firewall deny over firewall allow",
+			list:           AccessList{FirewallAllow: ValueSet{"DE": true}, FirewallDeny: ValueSet{"DE": true}},
+			value:          "DE",
+			defaultAllowed: true,
+			allowed:        false,
+			reason:         DECISION_FIREWALL_DENY,
+		},
+		{
+			name:           "route deny over firewall allow",
+			list:           AccessList{RouteDeny: ValueSet{"DE": true}, FirewallAllow: ValueSet{"DE": true}},
+			value:          "DE",
+			defaultAllowed: true,
+			allowed:        false,
+			reason:         DECISION_ROUTE_DENY,
+		},
+		{
+			name:           "route allow over firewall deny",
+			list:           AccessList{RouteAllow: MethodList{"POST"}, FirewallDeny: MethodList{"POST"}},
+			value:          "POST",
+			defaultAllowed: false,
+			allowed:        true,
+			reason:         DECISION_ROUTE_ALLOW,
+		},
+		{
+			name:           "firewall allow",
+			list:           AccessList{FirewallAllow: ValueSet{"64496": true}},
+			value:          "64496",
+			defaultAllowed: false,
+			allowed:        true,
+			reason:         DECISION_FIREWALL_ALLOW,
+		},
+		{
+			name:           "firewall deny without route rules",
+			list:           AccessList{RouteAllow: MethodList{}, FirewallDeny: MethodList{"PUT"}},
+			value:          "PUT",
+			defaultAllowed: true,
+			allowed:        false,
+			reason:         DECISION_FIREWALL_DENY,
+		},
+		{
+			name:           "route allow rules are exclusive",
+			list:           AccessList{RouteAllow: MethodList{"GET"}},
+			value:          "POST",
+			defaultAllowed: true,
+			allowed:        false,
+			reason:         DECISION_NOT_ALLOWED,
+		},
+		{
+			name:           "firewall allow rules are exclusive",
+			list:           AccessList{FirewallAllow: ValueSet{"DE": true}},
+			value:          "FR",
+			defaultAllowed: true,
+			allowed:        false,
+			reason:         DECISION_NOT_ALLOWED,
+		},
+		{
+			name:           "unmatched deny falls back to default",
+			list:           AccessList{RouteDeny: ValueSet{"DE": true}, FirewallDeny: ValueSet{"FR": true}},
+			value:          "US",
+			defaultAllowed: false,
+			allowed:        false,
+			reason:         DECISION_DEFAULT,
+		},
+		{
+			name:           "empty matchers are ignored",
+			list:           AccessList{RouteAllow: ValueSet{}, RouteDeny: MethodList{}, FirewallAllow: IPList{}},
+			value:          "GET",
+			defaultAllowed: true,
+			allowed:        true,
+			reason:         DECISION_DEFAULT,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := test.list.Evaluate(test.value, test.defaultAllowed)
+			if decision.Allowed != test.allowed || decision.Reason != test.reason {
+				t.Errorf("Evaluate(%q, %v) = %+v, want allowed %v by %q", test.value, test.defaultAllowed, decision, test.allowed, test.reason)
+			}
+		})
+	}
+}
+
+func TestCheckIP(t *testing.T) {
+	ips := AccessList{
+		RouteAllow:    mustIPList(t, "10.0.0.0/8"),
+		RouteDeny:     mustIPList(t, "10.0.0.1"),
+		FirewallAllow: mustIPList(t, "192.0.2.0/24"),
+		FirewallDeny:  mustIPList(t, "192.0.2.7", "2001:db8::/32"),
+	}
+	open := AccessList{FirewallDeny: mustIPList(t, "198.51.100.0/24")}
+
+	tests := []struct {
+		name           string
+		ips            AccessList
+		defaultAllowed bool
+		remoteAddr     string
+		allowed        bool
+		denied         bool
+	}{
+		{"route deny over route allow", ips, true, "10.0.0.1:4711", false, true},
+		{"route allow", ips, false, "10.1.2.3:4711", true, false},
+		{"firewall deny over firewall allow", ips, true, "192.0.2.7:4711", false, true},
+		{"firewall allow", ips, false, "192.0.2.8:4711", true, false},
+		{"firewall deny of IPv6 range", ips, true, "[2001:db8::1]:4711", false, true},
+		{"not in allow rules", ips, true, "203.0.113.1:4711", false, false},
+		{"default allowed", open, true, "203.0.113.1:4711", true, false},
+		{"default rejected", open, false, "203.0.113.1:4711", false, false},
+		{"firewall deny with default allowed", open, true, "198.51.100.9:4711", false, true},
+		{"address without port", open, true, "203.0.113.1", true, false},
+	}
+
+	s := &Server{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := Route{IPs: test.ips, DefaultAllowed: test.defaultAllowed}
+			decision := s.CheckIP(route, test.remoteAddr)
+			if decision.Allowed != test.allowed || decision.Denied() != test.denied {
+				t.Errorf("CheckIP(%q) = %+v, want allowed %v denied %v", test.remoteAddr, decision, test.allowed, test.denied)
+			}
+		})
+	}
+}
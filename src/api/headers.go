@@ -0,0 +1,186 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/middleware"
+)
+
+// Directions of header rules
+const HEADER_REQUEST = "REQUEST"
+const HEADER_RESPONSE = "RESPONSE"
+
+// Actions of header rules
+const HEADER_ADD = "ADD"
+const HEADER_SET = "SET"
+const HEADER_REMOVE = "REMOVE"
+const HEADER_RENAME = "RENAME"
+
+// Variables of header values, e.g. "{client_ip}"
+var headerVariables = map[string]bool{
+	"client_ip":  true,
+	"route":      true,
+	"key_id":     true,
+	"request_id": true,
+}
+
+// HeaderRule changes a header of the upstream request or of the response.
+// The value is the new name for HEADER_RENAME, otherwise a template.
+type HeaderRule struct {
+	Action string
+	Header string
+	Value  []templatePart
+}
+
+// templatePart is a literal or, if variable is set, a variable of a value
+type templatePart struct {
+	literal  string
+	variable string
+}
+
+// HeaderRules are the rules of a route in the order of their position
+type HeaderRules struct {
+	Request  []HeaderRule
+	Response []HeaderRule
+}
+
+// NewHeaderRule compiles a header rule
+func NewHeaderRule(rule db.HeaderRule) (HeaderRule, error) {
+	if !validHeaderName(rule.Header) {
+		return HeaderRule{}, fmt.Errorf("invalid header name %q", rule.Header)
+	}
+	headerRule := HeaderRule{Action: rule.Action, Header: textproto.CanonicalMIMEHeaderKey(rule.Header)}
+	switch rule.Action {
+	case HEADER_ADD, HEADER_SET:
+		value, err := parseTemplate(rule.Value.String)
+		if err != nil {
+			return HeaderRule{}, err
+		}
+		headerRule.Value = value
+	case HEADER_RENAME:
+		if !validHeaderName(rule.Value.String) {
+			return HeaderRule{}, fmt.Errorf("invalid header name %q", rule.Value.String)
+		}
+		headerRule.Value = []templatePart{{literal: textproto.CanonicalMIMEHeaderKey(rule.Value.String)}}
+	case HEADER_REMOVE:
+	default:
+		return HeaderRule{}, fmt.Errorf("unknown header action %q", rule.Action)
+	}
+	return headerRule, nil
+}
+
+// Apply changes the headers. Values of variables are set by the client in
+// part, e.g. the key id, line breaks are removed from them.
+func (r HeaderRule) Apply(header http.Header, variables map[string]string) {
+	switch r.Action {
+	case HEADER_ADD:
+		header.Add(r.Header, r.expand(variables))
+	case HEADER_SET:
+		header.Set(r.Header, r.expand(variables))
+	case HEADER_REMOVE:
+		header.Del(r.Header)
+	case HEADER_RENAME:
+		if values, ok := header[r.Header]; ok {
+			header.Del(r.Header)
+			header[r.Value[0].literal] = values
+		}
+	}
+}
+
+// ApplyHeaderRules applies the rules in order
+func ApplyHeaderRules(header http.Header, rules []HeaderRule, variables map[string]string) {
+	for _, rule := range rules {
+		rule.Apply(header, variables)
+	}
+}
+
+func (r HeaderRule) expand(variables map[string]string) string {
+	var value strings.Builder
+	for _, part := range r.Value {
+		if part.variable == "" {
+			value.WriteString(part.literal)
+			continue
+		}
+		value.WriteString(strings.NewReplacer("\r", "", "\n", "").Replace(variables[part.variable]))
+	}
+	return value.String()
+}
+
+// parseTemplate splits a value into literals and variables in braces
+func parseTemplate(value string) ([]templatePart, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return nil, fmt.Errorf("header value contains a line break")
+	}
+	parts := []templatePart{}
+	for value != "" {
+		start := strings.Index(value, "{")
+		if start == -1 {
+			parts = append(parts, templatePart{literal: value})
+			break
+		}
+		end := strings.Index(value[start:], "}")
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated variable in header value %q", value)
+		}
+		name := value[start+1 : start+end]
+		if !headerVariables[name] {
+			return nil, fmt.Errorf("unknown variable {%s} in header value", name)
+		}
+		if start > 0 {
+			parts = append(parts, templatePart{literal: value[:start]})
+		}
+		parts = append(parts, templatePart{variable: name})
+		value = value[start+end+1:]
+	}
+	return parts, nil
+}
+
+// validHeaderName checks the name for token characters (RFC 7230)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c >= 0x7f || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// templateVariables returns the values of the variables for a request
+func templateVariables(r *http.Request, route Route) map[string]string {
+	info := middleware.GetRequestInfo(r)
+	return map[string]string{
+		"client_ip":  clientAddress(r.RemoteAddr),
+		"route":      route.Name,
+		"key_id":     info.KeyID,
+		"request_id": info.RequestID,
+	}
+}
+
+// loadHeaderRules loads the header rules of a route
+func loadHeaderRules(cnx *db.Connection, routeId string) (HeaderRules, error) {
+	rules, err := cnx.GetHeaderRules(routeId)
+	if err != nil {
+		return HeaderRules{}, err
+	}
+
+	__rules := HeaderRules{}
+	for _, rule := range rules {
+		__rule, err := NewHeaderRule(rule)
+		if err != nil {
+			return HeaderRules{}, fmt.Errorf("header rule %s of route %s: %w", rule.ID, routeId, err)
+		}
+		if rule.Direction == HEADER_RESPONSE {
+			__rules.Response = append(__rules.Response, __rule)
+		} else {
+			__rules.Request = append(__rules.Request, __rule)
+		}
+	}
+	return __rules, nil
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/auth"
+	"github.com/secnex/secnex-api-gateway/db"
+)
+
+// loadIntrospection loads the token introspection of the firewall and the
+// scopes required for the route. The introspector is nil if the firewall
+// does not use token introspection.
+func loadIntrospection(cnx *db.Connection, firewallId string, routeId string) (*auth.Introspector, []string, error) {
+	settings, ok, err := cnx.GetIntrospection(firewallId)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	scopes, err := cnx.GetScopes(firewallId, routeId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	introspector := auth.SharedIntrospector(firewallId, auth.IntrospectionConfig{
+		Endpoint:         settings.Endpoint,
+		ClientID:         settings.ClientID.String,
+		ClientSecret:     settings.ClientSecret.String,
+		Timeout:          time.Duration(settings.TimeoutMs) * time.Millisecond,
+		CacheTTL:         time.Duration(settings.CacheSeconds) * time.Second,
+		NegativeTTL:      time.Duration(settings.NegativeCacheSeconds) * time.Second,
+		FailureThreshold: settings.FailureThreshold,
+		Cooldown:         time.Duration(settings.CooldownSeconds) * time.Second,
+	})
+	__scopes := []string{}
+	for _, scope := range scopes {
+		__scopes = append(__scopes, scope.Scope)
+	}
+	return introspector, __scopes, nil
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/jwt"
+)
+
+// NewJWTValidator creates the token validator of a route
+func NewJWTValidator(settings db.JWT, claims []db.JWTClaim) (*jwt.Validator, error) {
+	validator := &jwt.Validator{
+		Issuer:         settings.Issuer.String,
+		Audiences:      settings.Audiences,
+		Algorithms:     settings.Algorithms,
+		Secret:         []byte(settings.Secret.String),
+		ClockSkew:      time.Duration(settings.ClockSkewSeconds) * time.Second,
+		PrincipalClaim: settings.PrincipalClaim,
+	}
+	for _, algorithm := range settings.Algorithms {
+		switch algorithm {
+		case jwt.ALG_RS256, jwt.ALG_ES256, jwt.ALG_EDDSA, jwt.ALG_HS256:
+		default:
+			return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+		}
+	}
+
+	if settings.JWKSURL.Valid {
+		validator.Keys = jwt.NewRemoteKeySet(settings.JWKSURL.String, time.Duration(settings.JWKSRefreshSeconds)*time.Second)
+	} else if settings.JWKSFile.Valid {
+		keys, err := jwt.NewFileKeySet(settings.JWKSFile.String)
+		if err != nil {
+			return nil, err
+		}
+		validator.Keys = keys
+	}
+
+	for _, claim := range claims {
+		validator.Rules = append(validator.Rules, jwt.ClaimRule{
+			Claim:    claim.Claim,
+			Operator: claim.Operator,
+			Value:    claim.Value,
+		})
+	}
+	return validator, nil
+}
+
+// loadJWT loads the JWT settings of a route, the result is nil if the route
+// does not use JWT authentication
+func loadJWT(cnx *db.Connection, routeId string) (*jwt.Validator, error) {
+	settings, ok, err := cnx.GetJWT(routeId)
+	if err != nil || !ok {
+		return nil, err
+	}
+	claims, err := cnx.GetJWTClaims(routeId)
+	if err != nil {
+		return nil, err
+	}
+	validator, err := NewJWTValidator(settings, claims)
+	if err != nil {
+		return nil, fmt.Errorf("jwt of route %s: %w", routeId, err)
+	}
+	return validator, nil
+}
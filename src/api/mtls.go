@@ -0,0 +1,258 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/auth"
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/middleware"
+)
+
+const CERT_MATCH_SUBJECT = "SUBJECT"
+const CERT_MATCH_CN = "CN"
+const CERT_MATCH_DNS = "DNS"
+const CERT_MATCH_URI = "URI"
+const CERT_MATCH_EMAIL = "EMAIL"
+
+// Headers with the identity of a verified client certificate. They are
+// removed from every incoming request.
+const HEADER_CLIENT_PRINCIPAL = "X-Client-Cert-Principal"
+const HEADER_CLIENT_SUBJECT = "X-Client-Cert-Subject"
+const HEADER_CLIENT_FINGERPRINT = "X-Client-Cert-Fingerprint"
+
+// ErrClientCertNotAllowed rejects valid certificates without a principal
+var ErrClientCertNotAllowed = fmt.Errorf("client certificate %w", auth.ErrForbidden)
+
+var ClientCertHeaders = []string{HEADER_CLIENT_PRINCIPAL, HEADER_CLIENT_SUBJECT, HEADER_CLIENT_FINGERPRINT}
+
+// ClientAuth verifies client certificates of a route against its CA bundle
+// and revocation lists and maps them to principals
+type ClientAuth struct {
+	Roots          *x509.CertPool
+	CRLs           []*x509.RevocationList
+	Principals     []CertPrincipal
+	ForwardHeaders bool
+}
+
+// CertPrincipal maps certificates with a matching subject or SAN to a
+// principal
+type CertPrincipal struct {
+	MatchType string
+	Value     string
+	Principal string
+}
+
+// ClientIdentity is a verified client certificate
+type ClientIdentity struct {
+	Principal   string
+	Subject     string
+	Fingerprint string
+}
+
+// NewClientAuth loads the CA bundle and the revocation lists of a route
+func NewClientAuth(mtls db.MTLS, principals []db.MTLSPrincipal) (*ClientAuth, error) {
+	bundle := []byte(mtls.CABundle.String)
+	if mtls.CAFile.Valid {
+		var err error
+		bundle, err = os.ReadFile(mtls.CAFile.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("no certificates in CA bundle of route %s", mtls.RouteID)
+	}
+
+	auth := &ClientAuth{Roots: x509.NewCertPool(), ForwardHeaders: mtls.ForwardHeaders}
+	for _, ca := range cas {
+		auth.Roots.AddCert(ca)
+	}
+
+	for _, file := range mtls.CRLFiles {
+		crl, err := loadCRL(file, cas)
+		if err != nil {
+			return nil, fmt.Errorf("crl %s: %w", file, err)
+		}
+		if time.Now().After(crl.NextUpdate) && !crl.NextUpdate.IsZero() {
+			log.Printf("CRL %s is outdated since %s\n", file, crl.NextUpdate.Format(time.RFC3339))
+		}
+		auth.CRLs = append(auth.CRLs, crl)
+	}
+
+	for _, principal := range principals {
+		auth.Principals = append(auth.Principals, CertPrincipal{
+			MatchType: principal.MatchType,
+			Value:     principal.Value,
+			Principal: principal.Principal,
+		})
+	}
+
+	return auth, nil
+}
+
+// loadCRL parses a PEM or DER revocation list and checks that it was signed
+// by one of the CAs
+func loadCRL(file string, cas []*x509.Certificate) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			return crl, nil
+		}
+	}
+	return nil, fmt.Errorf("not signed by a CA of the bundle")
+}
+
+// Verify checks the client certificates of the request. The error is
+// returned to the client.
+func (a *ClientAuth) Verify(r *http.Request) (ClientIdentity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ClientIdentity{}, fmt.Errorf("client certificate required: %w", auth.ErrNoCredentials)
+	}
+
+	leaf := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, certificate := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         a.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return ClientIdentity{}, fmt.Errorf("invalid client certificate")
+	}
+	for _, certificate := range chains[0] {
+		if a.revoked(certificate) {
+			return ClientIdentity{}, fmt.Errorf("client certificate revoked")
+		}
+	}
+
+	sum := sha256.Sum256(leaf.Raw)
+	identity := ClientIdentity{
+		Subject:     leaf.Subject.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+	if len(a.Principals) == 0 {
+		identity.Principal = leaf.Subject.CommonName
+		return identity, nil
+	}
+	for _, principal := range a.Principals {
+		if principal.Match(leaf) {
+			identity.Principal = principal.Principal
+			return identity, nil
+		}
+	}
+	return ClientIdentity{}, ErrClientCertNotAllowed
+}
+
+func (a *ClientAuth) Method() string {
+	return auth.METHOD_MTLS
+}
+
+// Authenticate verifies the client certificate, the identity headers are
+// forwarded if ForwardHeaders is set
+func (a *ClientAuth) Authenticate(r *http.Request) (*middleware.Principal, error) {
+	identity, err := a.Verify(r)
+	if err != nil {
+		return nil, err
+	}
+	principal := auth.NewPrincipal(identity.Principal, auth.METHOD_MTLS)
+	if a.ForwardHeaders {
+		principal.Headers[HEADER_CLIENT_PRINCIPAL] = identity.Principal
+		principal.Headers[HEADER_CLIENT_SUBJECT] = identity.Subject
+		principal.Headers[HEADER_CLIENT_FINGERPRINT] = identity.Fingerprint
+	}
+	return principal, nil
+}
+
+func (a *ClientAuth) revoked(certificate *x509.Certificate) bool {
+	for _, crl := range a.CRLs {
+		if !bytes.Equal(crl.RawIssuer, certificate.RawIssuer) {
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(certificate.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Match returns true if the subject or a SAN of the certificate matches
+func (p CertPrincipal) Match(certificate *x509.Certificate) bool {
+	switch p.MatchType {
+	case CERT_MATCH_SUBJECT:
+		return certificate.Subject.String() == p.Value
+	case CERT_MATCH_DNS:
+		return containsFold(certificate.DNSNames, p.Value)
+	case CERT_MATCH_EMAIL:
+		return containsFold(certificate.EmailAddresses, p.Value)
+	case CERT_MATCH_URI:
+		for _, uri := range certificate.URIs {
+			if uri.String() == p.Value {
+				return true
+			}
+		}
+		return false
+	default:
+		return certificate.Subject.CommonName == p.Value
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadClientAuth loads the client certificate settings of a route, the
+// result is nil if the route does not use client certificates
+func loadClientAuth(cnx *db.Connection, routeId string) (*ClientAuth, error) {
+	mtls, ok, err := cnx.GetMTLS(routeId)
+	if err != nil || !ok {
+		return nil, err
+	}
+	principals, err := cnx.GetMTLSPrincipals(routeId)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientAuth(mtls, principals)
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/jwt"
+	"github.com/secnex/secnex-api-gateway/oidc"
+)
+
+// loadOIDC loads the OpenID Connect login of a route, the result is nil if
+// the route does not use it
+func loadOIDC(cnx *db.Connection, routeId string) (*oidc.Client, error) {
+	settings, ok, err := cnx.GetOIDC(routeId)
+	if err != nil || !ok {
+		return nil, err
+	}
+	client, err := oidc.NewClient(oidc.Config{
+		Issuer:                settings.Issuer,
+		ClientID:              settings.ClientID,
+		ClientSecret:          settings.ClientSecret,
+		RedirectURL:           settings.RedirectURL.String,
+		PostLogoutRedirectURL: settings.PostLogoutRedirectURL.String,
+		Scopes:                settings.Scopes,
+		CookieName:            settings.CookieName,
+		CookieSecret:          settings.CookieSecret,
+		SessionLifetime:       time.Duration(settings.SessionLifetimeSeconds) * time.Second,
+		ClockSkew:             jwt.DEFAULT_CLOCK_SKEW,
+		PassAccessToken:       settings.PassAccessToken,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("oidc of route %s: %w", routeId, err)
+	}
+	return client, nil
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/secnex/secnex-api-gateway/db"
+)
+
+// PathRule restricts access to a sub-path of a route
+type PathRule struct {
+	Pattern     string
+	Regexp      *regexp.Regexp
+	Blocked     bool
+	Methods     []Method
+	Networks    []*net.IPNet
+	RequireAuth *bool
+	specificity int
+}
+
+const PATH_MATCH_GLOB = "GLOB"
+const PATH_MATCH_REGEX = "REGEX"
+
+// NewPathRule compiles a path rule. Glob patterns support * for a single
+// path segment and ** for any number of segments and ignore the case, so
+// "/Admin" does not bypass a rule for "/admin/*" on targets which ignore
+// the case. Regular expressions are used as written.
+func NewPathRule(path db.Path) (PathRule, error) {
+	rule := PathRule{
+		Pattern: path.Pattern,
+		Blocked: path.Action == db.ACTION_REJECT,
+	}
+
+	var err error
+	switch path.MatchType {
+	case PATH_MATCH_REGEX:
+		rule.Regexp, err = regexp.Compile(path.Pattern)
+		if err != nil {
+			return PathRule{}, fmt.Errorf("path pattern %q: %w", path.Pattern, err)
+		}
+		rule.specificity = len(strings.Map(func(c rune) rune {
+			if strings.ContainsRune(`.*+?()[]{}|^$\`, c) {
+				return -1
+			}
+			return c
+		}, path.Pattern))
+	default:
+		pattern := "/" + strings.TrimPrefix(path.Pattern, "/")
+		rule.Regexp = globPathToRegexp(pattern)
+		rule.specificity = len(strings.NewReplacer("*", "", "?", "").Replace(pattern))
+	}
+
+	for _, method := range path.Methods {
+		rule.Methods = append(rule.Methods, Method(method))
+	}
+
+	for _, ip := range path.IPs {
+		network, err := parseNetwork(ip)
+		if err != nil {
+			return PathRule{}, err
+		}
+		rule.Networks = append(rule.Networks, network)
+	}
+
+	if path.RequireAuth.Valid {
+		requireAuth := path.RequireAuth.Bool
+		rule.RequireAuth = &requireAuth
+	}
+
+	return rule, nil
+}
+
+// SortPathRules orders the rules from the most to the least specific pattern
+func SortPathRules(rules []PathRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].specificity > rules[j].specificity
+	})
+}
+
+// MatchPath returns the most specific path rule for the remaining path.
+// The path is normalized first, like the path which is forwarded.
+func (r Route) MatchPath(remainingPath string) (PathRule, bool) {
+	normalized := NormalizePath(remainingPath)
+	for _, rule := range r.Paths {
+		if rule.Regexp.MatchString(normalized) {
+			return rule, true
+		}
+	}
+	return PathRule{}, false
+}
+
+// AllowsMethod checks the method restriction of the rule
+func (p PathRule) AllowsMethod(method string) bool {
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, allowedMethod := range p.Methods {
+		if Method(method) == allowedMethod {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP checks the IP restriction of the rule
+func (p PathRule) AllowsIP(clientIP string) bool {
+	if len(p.Networks) == 0 {
+		return true
+	}
+	clientAddr := net.ParseIP(clientAddress(clientIP))
+	if clientAddr == nil {
+		return false
+	}
+	for _, network := range p.Networks {
+		if network.Contains(clientAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizePath resolves dot segments and duplicate slashes of a path and
+// returns it with a leading slash, e.g. "admin/../admin//users" becomes
+// "/admin/users". A trailing slash is kept.
+func NormalizePath(remainingPath string) string {
+	normalized := path.Clean("/" + remainingPath)
+	if strings.HasSuffix(remainingPath, "/") && normalized != "/" {
+		normalized += "/"
+	}
+	return normalized
+}
+
+// globPathToRegexp converts a path glob to an anchored, case insensitive
+// regular expression
+func globPathToRegexp(glob string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("(?i)^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "/**"):
+			pattern.WriteString("(/.*)?")
+			i += 2
+		case glob[i] == '*':
+			pattern.WriteString("[^/]*")
+		case glob[i] == '?':
+			pattern.WriteString("[^/]")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(glob[i])))
+		}
+	}
+	pattern.WriteString("/?$")
+	return regexp.MustCompile(pattern.String())
+}
+
+// parseNetwork parses an IP address or CIDR range
+func parseNetwork(ip string) (*net.IPNet, error) {
+	if !strings.Contains(ip, "/") {
+		if strings.Contains(ip, ":") {
+			ip += "/128"
+		} else {
+			ip += "/32"
+		}
+	}
+	_, network, err := net.ParseCIDR(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ip %q: %w", ip, err)
+	}
+	return network, nil
+}
+
+// clientAddress strips the port from the remote address
+func clientAddress(remoteAddr string) string {
+	if strings.Contains(remoteAddr, "[") || strings.Contains(remoteAddr, "]") {
+		// Get all between []
+		remoteAddr = strings.Split(remoteAddr, "[")[1]
+		return strings.Split(remoteAddr, "]")[0]
+	}
+	// Get all before :
+	return strings.Split(remoteAddr, ":")[0]
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/secnex/secnex-api-gateway/db"
+)
+
+func mustPathRule(t *testing.T, path db.Path) PathRule {
+	t.Helper()
+	rule, err := NewPathRule(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func TestGlobPathToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		path    string
+		matched bool
+	}{
+		{"/admin", "/admin", true},
+		{"/admin", "/admin/", true},
+		{"/admin", "/administrator", false},
+		{"/admin/*", "/admin/users", true},
+		{"/admin/*", "/admin/", true},
+		{"/admin/*", "/admin/users/1", false},
+		{"/admin/**", "/admin", true},
+		{"/admin/**", "/admin/users/1/roles", true},
+		{"/admin/**", "/administrator", false},
+		{"/users/*/roles", "/users/1/roles", true},
+		{"/users/*/roles", "/users/1/2/roles", false},
+		{"/users/**/roles", "/users/1/2/roles", true},
+		{"/files/?.txt", "/files/a.txt", true},
+		{"/files/?.txt", "/files/ab.txt", false},
+		{"/files/?.txt", "/files//.txt", false},
+		{"/v1.0/*", "/v1x0/orders", false},
+		{"/search(1)", "/search(1)", true},
+		{"/Admin/*", "/admin/users", true},
+		{"/admin/*", "/ADMIN/Users", true},
+	}
+	for _, test := range tests {
+		if matched := globPathToRegexp(test.glob).MatchString(test.path); matched != test.matched {
+			t.Errorf("glob %q on %q = %v, want %v", test.glob, test.path, matched, test.matched)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := map[string]string{
+		"":                     "/",
+		"/":                    "/",
+		"admin":                "/admin",
+		"admin/":               "/admin/",
+		"admin/../admin":       "/admin",
+		"public/../admin/x":    "/admin/x",
+		"admin/./users":        "/admin/users",
+		"admin//users":         "/admin/users",
+		"../../admin":          "/admin",
+		"admin/users/..":       "/admin",
+		"admin/users/../":      "/admin/",
+		"static/app.v1.2.js":   "/static/app.v1.2.js",
+		"static/..hidden/file": "/static/..hidden/file",
+	}
+	for path, want := range tests {
+		if got := NormalizePath(path); got != want {
+			t.Errorf("NormalizePath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	paths := []PathRule{
+		mustPathRule(t, db.Path{Pattern: "/**", Action: db.ACTION_ALLOW}),
+		mustPathRule(t, db.Path{Pattern: "/admin/*", Action: db.ACTION_REJECT}),
+		mustPathRule(t, db.Path{Pattern: "admin/health", Action: db.ACTION_ALLOW, RequireAuth: sql.NullBool{Bool: false, Valid: true}}),
+		mustPathRule(t, db.Path{Pattern: "/public/**", Action: db.ACTION_ALLOW, RequireAuth: sql.NullBool{Bool: false, Valid: true}}),
+		mustPathRule(t, db.Path{Pattern: `^/orders/\d+$`, MatchType: PATH_MATCH_REGEX, Action: db.ACTION_ALLOW, Methods: []string{"GET"}}),
+	}
+	SortPathRules(paths)
+	route := Route{Paths: paths}
+
+	tests := []struct {
+		name    string
+		path    string
+		pattern string
+	}{
+		{name: "most specific rule", path: "admin/health", pattern: "admin/health"},
+		{name: "glob of a segment", path: "admin/users", pattern: "/admin/*"},
+		{name: "catch all", path: "orders", pattern: "/**"},
+		{name: "regex", path: "orders/42", pattern: `^/orders/\d+$`},
+		{name: "regex is more specific than catch all", path: "orders/42/items", pattern: "/**"},
+		{name: "leading slash", path: "/admin/users", pattern: "/admin/*"},
+		// The blocked rule cannot be bypassed by the case or the form of the path
+		{name: "upper case", path: "Admin/users", pattern: "/admin/*"},
+		{name: "dot dot segment", path: "admin/../admin/users", pattern: "/admin/*"},
+		{name: "dot dot out of public", path: "public/../admin/users", pattern: "/admin/*"},
+		{name: "dot segment", path: "admin/./users", pattern: "/admin/*"},
+		{name: "duplicate slash", path: "admin//users", pattern: "/admin/*"},
+		{name: "above the root", path: "../admin/users", pattern: "/admin/*"},
+		{name: "dot dot into public", path: "admin/../public/index.html", pattern: "/public/**"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, ok := route.MatchPath(test.path)
+			if !ok || rule.Pattern != test.pattern {
+				t.Errorf("MatchPath(%q) = %q, %v, want %q", test.path, rule.Pattern, ok, test.pattern)
+			}
+		})
+	}
+
+	if _, ok := (Route{}).MatchPath("admin"); ok {
+		t.Error("MatchPath() without rules matched")
+	}
+}
+
+func TestSortPathRules(t *testing.T) {
+	rules := []PathRule{
+		mustPathRule(t, db.Path{Pattern: "/**"}),
+		mustPathRule(t, db.Path{Pattern: "/users/*"}),
+		mustPathRule(t, db.Path{Pattern: "/users/*/roles"}),
+		mustPathRule(t, db.Path{Pattern: "/users/me"}),
+		mustPathRule(t, db.Path{Pattern: `^/users/.*$`, MatchType: PATH_MATCH_REGEX}),
+	}
+	SortPathRules(rules)
+
+	want := []string{"/users/*/roles", "/users/me", "/users/*", `^/users/.*$`, "/**"}
+	for i, rule := range rules {
+		if rule.Pattern != want[i] {
+			t.Errorf("rule %d = %q, want %q", i, rule.Pattern, want[i])
+		}
+	}
+}
+
+func TestPathRuleRestrictions(t *testing.T) {
+	rule := mustPathRule(t, db.Path{Pattern: "/internal/**", Methods: []string{"GET", "HEAD"}, IPs: []string{"10.0.0.0/8", "2001:db8::1"}})
+
+	for method, allowed := range map[string]bool{"GET": true, "HEAD": true, "POST": false, "get": false} {
+		if rule.AllowsMethod(method) != allowed {
+			t.Errorf("AllowsMethod(%q) = %v, want %v", method, !allowed, allowed)
+		}
+	}
+	for addr, allowed := range map[string]bool{"10.1.2.3:4711": true, "[2001:db8::1]:4711": true, "192.0.2.1:4711": false, "invalid": false} {
+		if rule.AllowsIP(addr) != allowed {
+			t.Errorf("AllowsIP(%q) = %v, want %v", addr, !allowed, allowed)
+		}
+	}
+
+	if _, err := NewPathRule(db.Path{Pattern: "(", MatchType: PATH_MATCH_REGEX}); err == nil {
+		t.Error("NewPathRule() accepted an invalid regex")
+	}
+	if _, err := NewPathRule(db.Path{Pattern: "/a", IPs: []string{"10.0.0.300"}}); err == nil {
+		t.Error("NewPathRule() accepted an invalid ip")
+	}
+}
@@ -1 +1,25 @@
 package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/secnex/secnex-api-gateway/middleware"
+	apitypes "github.com/secnex/secnex-api-gateway/types"
+)
+
+// internalError logs the error and answers with a 500 error without its
+// details
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	info := middleware.GetRequestInfo(r)
+	log.Printf("Error handling %s %s: %s request_id=%s\n", r.Method, r.URL.Path, err, info.RequestID)
+	result := apitypes.ResultError{
+		Code:      http.StatusInternalServerError,
+		Message:   "Internal server error",
+		Error:     "Internal server error",
+		RequestID: info.RequestID,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(result.String()))
+}
@@ -3,45 +3,74 @@ package api
 import (
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
+	"time"
 
+	"github.com/secnex/secnex-api-gateway/auth"
 	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/jwt"
+	"github.com/secnex/secnex-api-gateway/metrics"
+	"github.com/secnex/secnex-api-gateway/oidc"
+	"github.com/secnex/secnex-api-gateway/waf"
 )
 
 // Route struct
 type Route struct {
-	Path               string
-	URL                string
-	AllowedMethods     []Method
-	AllowedIPs         []IPAddress
-	BlockedIPs         []IPAddress
-	AllowedUserAgents  []UserAgent
-	RejectedUserAgents []UserAgent
-	DefaultAllowed     bool
-	RequiredAuth       bool
-	ForwardSubPath     bool
+	Name           string
+	Path           string
+	URL            string
+	Methods        AccessList
+	IPs            AccessList
+	UserAgents     AccessList
+	Countries      AccessList
+	ASNs           AccessList
+	DefaultAllowed bool
+	RequiredAuth   bool
+	ForwardSubPath bool
+	WAF            waf.Policy
+	Paths          []PathRule
+	ClientAuth     *ClientAuth
+	JWT            *jwt.Validator
+	OIDC           *oidc.Client
+	Introspector   *auth.Introspector
+	Scopes         []string
+	Auth           *auth.Chain
+	// Transport with the TLS settings toward the target, nil for the shared
+	// transport of the proxy
+	Transport *http.Transport
+	// Credentials of the gateway at the target
+	Credentials     []UpstreamCredential
+	Headers         HeaderRules
+	SecurityHeaders *SecurityHeaders
 }
 
 type Method string
-type IPAddress string
-type UserAgent string
 
-func NewRoute(path string, url string, methods []Method, allowedIPs []IPAddress, blockedIPs []IPAddress, allowedUserAgents []UserAgent, rejectedUserAgents []UserAgent, defaultAllowed bool, requiredAuth bool, forwardSubPath bool) Route {
+func NewRoute(name string, path string, url string, methods AccessList, ips AccessList, userAgents AccessList, defaultAllowed bool, requiredAuth bool, forwardSubPath bool) Route {
 	return Route{
-		Path:               path,
-		URL:                url,
-		AllowedMethods:     methods,
-		AllowedIPs:         allowedIPs,
-		BlockedIPs:         blockedIPs,
-		AllowedUserAgents:  allowedUserAgents,
-		RejectedUserAgents: rejectedUserAgents,
-		DefaultAllowed:     defaultAllowed,
-		RequiredAuth:       requiredAuth,
-		ForwardSubPath:     forwardSubPath,
+		Name:           name,
+		Path:           path,
+		URL:            url,
+		Methods:        methods,
+		IPs:            ips,
+		UserAgents:     userAgents,
+		DefaultAllowed: defaultAllowed,
+		RequiredAuth:   requiredAuth,
+		ForwardSubPath: forwardSubPath,
 	}
 }
 
 func (s *Server) SetRoutes(routes []Route) {
+	previous := s.Routes
 	s.Routes = routes
+	// Replaced transports keep serving running requests, only their idle
+	// connections are closed
+	for _, route := range previous {
+		if route.Transport != nil {
+			route.Transport.CloseIdleConnections()
+		}
+	}
 }
 
 // getRoute returns the route for the given path
@@ -54,6 +83,16 @@ func (s *Server) GetRoute(path string) (Route, error) {
 	return Route{}, fmt.Errorf("Route not found")
 }
 
+// GetRouteByName returns the route with the given name
+func (s *Server) GetRouteByName(name string) (Route, error) {
+	for _, route := range s.Routes {
+		if route.Name == name {
+			return route, nil
+		}
+	}
+	return Route{}, fmt.Errorf("Route not found")
+}
+
 func GetRoutes(cnx *db.Connection, serverId string) ([]Route, error) {
 	routes, err := cnx.GetRoutes(serverId)
 	if err != nil {
@@ -66,47 +105,99 @@ func GetRoutes(cnx *db.Connection, serverId string) ([]Route, error) {
 		if err != nil {
 			return nil, err
 		}
-		var __methods []Method
-		methods, err := cnx.GetMethods(firewall.ID, __route.ID)
+		__methods, err := loadMethods(cnx, firewall.ID, __route.ID)
 		if err != nil {
 			return nil, err
 		}
-		for _, method := range methods {
-			__methods = append(__methods, Method(method.Method))
+		__ips, err := loadIPs(cnx, firewall.ID, __route.ID)
+		if err != nil {
+			return nil, err
 		}
-		var __allowedIPs []IPAddress
-		ips, err := cnx.GetIPs(firewall.ID, __route.ID, db.ACTION_ALLOW)
+		__useragents, err := loadUserAgents(cnx, firewall.ID, __route.ID)
 		if err != nil {
 			return nil, err
 		}
-		for _, ip := range ips {
-			__allowedIPs = append(__allowedIPs, IPAddress(ip.IP))
+		__countries, err := loadCountries(cnx, firewall.ID, __route.ID)
+		if err != nil {
+			return nil, err
 		}
-		var __blockedIPs []IPAddress
-		blockedIPs, err := cnx.GetIPs(firewall.ID, __route.ID, db.ACTION_REJECT)
+		__asns, err := loadASNs(cnx, firewall.ID, __route.ID)
 		if err != nil {
 			return nil, err
 		}
-		for _, blockedIP := range blockedIPs {
-			__blockedIPs = append(__blockedIPs, IPAddress(blockedIP.IP))
+		var __paths []PathRule
+		paths, err := cnx.GetPaths(firewall.ID, __route.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			__path, err := NewPathRule(path)
+			if err != nil {
+				return nil, err
+			}
+			__paths = append(__paths, __path)
 		}
-		var __useragents []UserAgent
-		useragents, err := cnx.GetUserAgents(firewall.ID, __route.ID, db.ACTION_ALLOW)
+		SortPathRules(__paths)
+		__waf, err := cnx.GetWAF(__route.ID)
 		if err != nil {
 			return nil, err
 		}
-		for _, useragent := range useragents {
-			__useragents = append(__useragents, UserAgent(useragent.UserAgent))
+		__wafRules, err := loadWAFRules(cnx, __route.ID)
+		if err != nil {
+			return nil, err
 		}
-		var __rejectedUserAgents []UserAgent
-		rejectedUserAgents, err := cnx.GetUserAgents(firewall.ID, __route.ID, db.ACTION_REJECT)
+		__clientAuth, err := loadClientAuth(cnx, __route.ID)
 		if err != nil {
 			return nil, err
 		}
-		for _, rejectedUserAgent := range rejectedUserAgents {
-			__rejectedUserAgents = append(__rejectedUserAgents, UserAgent(rejectedUserAgent.UserAgent))
+		__jwt, err := loadJWT(cnx, __route.ID)
+		if err != nil {
+			return nil, err
+		}
+		__oidc, err := loadOIDC(cnx, __route.ID)
+		if err != nil {
+			return nil, err
+		}
+		__introspector, __scopes, err := loadIntrospection(cnx, firewall.ID, __route.ID)
+		if err != nil {
+			return nil, err
+		}
+		__transport, err := loadUpstreamTransport(cnx, __route.ID)
+		if err != nil {
+			return nil, err
+		}
+		__credentials, err := loadUpstreamCredentials(cnx, __route.ID)
+		if err != nil {
+			return nil, err
+		}
+		__headers, err := loadHeaderRules(cnx, __route.ID)
+		if err != nil {
+			return nil, err
+		}
+		__securityHeaders, err := loadSecurityHeaders(cnx, __route.ID, __route.Name)
+		if err != nil {
+			return nil, err
+		}
+		__routeID := __route.ID
+		__route := NewRoute(__route.Name, __route.Path, __route.URL, __methods, __ips, __useragents, firewall.AllowAll, firewall.RequireAuth, __route.ForwardSubPath)
+		__route.WAF = waf.NewPolicy(waf.ParseMode(__waf.Mode), __waf.Threshold, __waf.MaxBodySize)
+		__route.WAF.Rules = __wafRules
+		__route.Paths = __paths
+		__route.Countries = __countries
+		__route.ASNs = __asns
+		__route.ClientAuth = __clientAuth
+		__route.JWT = __jwt
+		__route.OIDC = __oidc
+		__route.Introspector = __introspector
+		__route.Scopes = __scopes
+		__route.Transport = __transport
+		__route.Credentials = __credentials
+		__route.Headers = __headers
+		__route.SecurityHeaders = __securityHeaders
+		__route.Auth, err = loadAuthChain(cnx, firewall, __routeID, __route)
+		if err != nil {
+			return nil, err
 		}
-		__route := NewRoute(__route.Path, __route.URL, __methods, __allowedIPs, __blockedIPs, __useragents, __rejectedUserAgents, firewall.AllowAll, firewall.RequireAuth, __route.ForwardSubPath)
 		__routes = append(__routes, __route)
 	}
 
@@ -115,9 +206,39 @@ func GetRoutes(cnx *db.Connection, serverId string) ([]Route, error) {
 	return __routes, nil
 }
 
+// loadWAFRules compiles the SecLang rules of a route from files and the database
+func loadWAFRules(cnx *db.Connection, routeId string) (*waf.RuleSet, error) {
+	rules, err := cnx.GetWAFRules(routeId)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	var __rules []waf.SecRule
+	for _, rule := range rules {
+		var compiled []waf.SecRule
+		if rule.File.Valid {
+			compiled, err = waf.ParseRuleFile(rule.File.String)
+		} else {
+			compiled, err = waf.ParseRules(strings.NewReader(rule.Rules.String))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("waf rules %s: %w", rule.Name, err)
+		}
+		__rules = append(__rules, compiled...)
+	}
+
+	return waf.NewRuleSet(__rules), nil
+}
+
 func (s *Server) RefreshRoutes(cnx *db.Connection) ([]Route, error) {
+	start := time.Now()
 	routes, err := GetRoutes(cnx, s.ID)
+	metrics.RouteRefreshDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.RouteRefreshErrors.Inc()
 		return nil, err
 	}
 
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/metrics"
+	"github.com/secnex/secnex-api-gateway/middleware"
+)
+
+// Profiles of security headers
+const SECURITY_PROFILE_NONE = "NONE"
+const SECURITY_PROFILE_API = "API"
+const SECURITY_PROFILE_STRICT = "STRICT"
+
+// Endpoint of the gateway which collects CSP violation reports
+const CSP_REPORT_PATH = "/api/gateway/csp-report"
+
+// Maximum size of a CSP report
+const MAX_CSP_REPORT_SIZE = 64 << 10
+
+// At most this many reports are logged per minute, browsers send a report
+// for every violation
+const CSP_REPORT_LOG_LIMIT = 100
+
+const HEADER_HSTS = "Strict-Transport-Security"
+const HEADER_CSP = "Content-Security-Policy"
+const HEADER_CSP_REPORT_ONLY = "Content-Security-Policy-Report-Only"
+
+// Security headers of the profiles
+var securityProfiles = map[string]map[string]string{
+	SECURITY_PROFILE_NONE: {},
+	SECURITY_PROFILE_API: {
+		HEADER_HSTS:              "max-age=31536000",
+		HEADER_CSP:               "default-src 'none'; frame-ancestors 'none'",
+		"X-Frame-Options":        "DENY",
+		"X-Content-Type-Options": "nosniff",
+		"Referrer-Policy":        "no-referrer",
+	},
+	SECURITY_PROFILE_STRICT: {
+		HEADER_HSTS:              "max-age=63072000; includeSubDomains",
+		HEADER_CSP:               "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'",
+		"X-Frame-Options":        "DENY",
+		"X-Content-Type-Options": "nosniff",
+		"Referrer-Policy":        "strict-origin-when-cross-origin",
+		"Permissions-Policy":     "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+	},
+}
+
+// SecurityHeaders is the security header policy of the responses of a
+// route. Headers of the target are kept unless Override is set.
+type SecurityHeaders struct {
+	Headers  map[string]string
+	Override bool
+}
+
+// NewSecurityHeaders creates the policy of a route from its profile and
+// the headers which replace the values of the profile
+func NewSecurityHeaders(settings db.SecurityHeaders, routeName string) *SecurityHeaders {
+	policy := &SecurityHeaders{Headers: map[string]string{}, Override: settings.Override}
+	for header, value := range securityProfiles[settings.Profile] {
+		policy.Headers[header] = value
+	}
+
+	columns := map[string]sql.NullString{
+		HEADER_HSTS:              settings.HSTS,
+		HEADER_CSP:               settings.ContentSecurityPolicy,
+		"X-Frame-Options":        settings.FrameOptions,
+		"X-Content-Type-Options": settings.ContentTypeOptions,
+		"Referrer-Policy":        settings.ReferrerPolicy,
+		"Permissions-Policy":     settings.PermissionsPolicy,
+	}
+	for header, value := range columns {
+		if !value.Valid {
+			continue
+		}
+		if value.String == "" {
+			delete(policy.Headers, header)
+		} else {
+			policy.Headers[header] = value.String
+		}
+	}
+
+	// In report-only mode the policy is not enforced, violations are
+	// reported to the gateway
+	if csp, ok := policy.Headers[HEADER_CSP]; ok && settings.CSPReportOnly {
+		delete(policy.Headers, HEADER_CSP)
+		policy.Headers[HEADER_CSP_REPORT_ONLY] = strings.TrimRight(csp, "; ") + "; report-uri " + CSP_REPORT_PATH + "?route=" + url.QueryEscape(routeName)
+	}
+	return policy
+}
+
+// Apply sets the headers on a response. HSTS is only sent over TLS.
+func (p *SecurityHeaders) Apply(header http.Header, r *http.Request) {
+	if p == nil {
+		return
+	}
+	for name, value := range p.Headers {
+		if name == HEADER_HSTS && r.TLS == nil {
+			continue
+		}
+		if p.Override || header.Get(name) == "" {
+			header.Set(name, value)
+		}
+	}
+}
+
+// loadSecurityHeaders loads the security header policy of a route, the
+// result is nil if the route has none
+func loadSecurityHeaders(cnx *db.Connection, routeId string, routeName string) (*SecurityHeaders, error) {
+	settings, ok, err := cnx.GetSecurityHeaders(routeId)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return NewSecurityHeaders(settings, routeName), nil
+}
+
+// cspReport is a violation report of the report-uri directive
+// (application/csp-report) or of the Reporting API (application/reports+json)
+type cspReport struct {
+	DocumentURI        string `json:"document-uri"`
+	BlockedURI         string `json:"blocked-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	DocumentURL        string `json:"documentURL"`
+	BlockedURL         string `json:"blockedURL"`
+	EffectiveDirective string `json:"effectiveDirective"`
+}
+
+var cspReportWindow time.Time
+var cspReportCount int
+var cspReportMu sync.Mutex
+
+// CSPReport collects the CSP violation reports of browsers and logs them
+func (s *Server) CSPReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	routeName := r.URL.Query().Get("route")
+	if _, err := s.GetRouteByName(routeName); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, MAX_CSP_REPORT_SIZE))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	reports := []cspReport{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/reports+json" {
+		var batch []struct {
+			Type string    `json:"type"`
+			Body cspReport `json:"body"`
+		}
+		err = json.Unmarshal(data, &batch)
+		for _, report := range batch {
+			if report.Type == "csp-violation" {
+				reports = append(reports, report.Body)
+			}
+		}
+	} else {
+		var report struct {
+			Report cspReport `json:"csp-report"`
+		}
+		err = json.Unmarshal(data, &report)
+		reports = append(reports, report.Report)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, report := range reports {
+		metrics.CSPReports.Inc(routeName)
+		if !allowCSPReportLog() {
+			continue
+		}
+		document := firstNonEmpty(report.DocumentURI, report.DocumentURL)
+		blocked := firstNonEmpty(report.BlockedURI, report.BlockedURL)
+		directive := firstNonEmpty(report.ViolatedDirective, report.EffectiveDirective)
+		log.Printf("CSP violation on route %s: %q blocked %q on %q from %s request_id=%s\n", routeName, directive, blocked, document, clientAddress(r.RemoteAddr), middleware.GetRequestInfo(r).RequestID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowCSPReportLog limits the logged reports per minute
+func allowCSPReportLog() bool {
+	cspReportMu.Lock()
+	defer cspReportMu.Unlock()
+	if time.Since(cspReportWindow) >= time.Minute {
+		cspReportWindow = time.Now()
+		cspReportCount = 0
+	}
+	cspReportCount++
+	return cspReportCount <= CSP_REPORT_LOG_LIMIT
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -1,39 +1,68 @@
 package api
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/secnex/secnex-api-gateway/audit"
+	"github.com/secnex/secnex-api-gateway/auth"
+	"github.com/secnex/secnex-api-gateway/ban"
+	"github.com/secnex/secnex-api-gateway/certs"
 	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/geoip"
+	"github.com/secnex/secnex-api-gateway/metrics"
 	"github.com/secnex/secnex-api-gateway/middleware"
+	"github.com/secnex/secnex-api-gateway/tracing"
 )
 
 // Server struct
 type Server struct {
-	ID       string
-	Name     string
-	Port     string
-	BasePath string
-	Proxy    *httputil.ReverseProxy
-	Routes   []Route
-	Database *db.Connection
-	MU       sync.Mutex
+	ID         string
+	Name       string
+	Port       string
+	BasePath   string
+	Proxy      *httputil.ReverseProxy
+	Routes     []Route
+	Database   *db.Connection
+	GeoIP      *geoip.Resolver
+	BanManager *ban.Manager
+	AccessLog  *middleware.AccessLog
+	Tracer     *tracing.Tracer
+	Audit      *audit.Logger
+	// Address of the admin listener serving /metrics, disabled if empty
+	AdminAddress string
+	// Authentication of the admin API on the admin listener, the API is
+	// disabled if nil
+	AdminAuth *auth.Chain
+	// HTTPS listener, disabled if TLSConfig is nil. The plain listener
+	// redirects to it if TLSRedirect is set.
+	TLSPort      string
+	TLSRedirect  bool
+	TLSConfig    *tls.Config
+	Certificates *certs.Store
+	ACME         *certs.ACMEManager
+	MU           sync.Mutex
 }
 
 // NewServer creates a new server
 func NewServer(server db.Server, database *db.Connection) *Server {
 	return &Server{
-		ID:       server.ID,
-		Name:     server.Name,
-		Port:     fmt.Sprintf(":%d", server.Port),
-		Proxy:    &httputil.ReverseProxy{},
-		Routes:   []Route{},
-		BasePath: server.BasePath,
-		Database: database,
+		ID:          server.ID,
+		Name:        server.Name,
+		Port:        fmt.Sprintf(":%d", server.Port),
+		Proxy:       &httputil.ReverseProxy{},
+		Routes:      []Route{},
+		BasePath:    server.BasePath,
+		Database:    database,
+		TLSPort:     fmt.Sprintf(":%d", server.TLSPort),
+		TLSRedirect: server.TLSRedirect,
 	}
 }
 
@@ -54,13 +83,97 @@ func (s *Server) RunServer() {
 
 	r.HandleFunc("/api/gateway/refresh", s.Refresh)
 
+	r.HandleFunc(CSP_REPORT_PATH, s.CSPReport)
+
 	s.MU.Unlock()
 
 	go s.StartRouteRefresher(5)
+	go s.StartNonceCleanup(time.Minute)
+	if s.GeoIP != nil {
+		go s.GeoIP.StartReloader(30 * time.Second)
+	}
+	if s.BanManager != nil {
+		go s.BanManager.StartSync(10 * time.Second)
+	}
+
+	if s.Audit != nil {
+		go s.Audit.Start(time.Second)
+	}
+	if s.Tracer != nil {
+		go s.Tracer.Exporter.StartExporter(5 * time.Second)
+	}
+
+	if s.AdminAddress != "" {
+		go s.RunAdminServer()
+	}
+
+	instrumentedRouter := middleware.MetricsMiddleware(middleware.TracingMiddleware(s.Tracer, r))
+	loggedRouter := middleware.LoggingMiddleware(instrumentedRouter)
+	if s.AccessLog != nil {
+		loggedRouter = s.AccessLog.Middleware(instrumentedRouter)
+	}
+	if s.TLSConfig == nil {
+		log.Printf("Starting %s (%s) on port %s\n", s.Name, s.ID, s.Port)
+		log.Fatal(http.ListenAndServe(s.Port, loggedRouter))
+	}
+
+	if s.Certificates != nil {
+		go s.Certificates.StartReloader(time.Minute)
+	}
+	if s.ACME != nil {
+		go s.ACME.StartRenewer(12 * time.Hour)
+	}
+	go s.RunPlainServer(loggedRouter)
+
+	tlsServer := &http.Server{
+		Addr:      s.TLSPort,
+		Handler:   loggedRouter,
+		TLSConfig: s.TLSConfig,
+	}
+	log.Printf("Starting %s (%s) with TLS on port %s\n", s.Name, s.ID, s.TLSPort)
+	log.Fatal(tlsServer.ListenAndServeTLS("", ""))
+}
+
+// RunPlainServer runs the plain HTTP listener next to the HTTPS listener
+func (s *Server) RunPlainServer(handler http.Handler) {
+	if s.TLSRedirect {
+		handler = http.HandlerFunc(s.RedirectToHTTPS)
+	}
+	if s.ACME != nil {
+		handler = s.ACME.HTTPHandler(handler)
+	}
 
-	loggedRouter := middleware.LoggingMiddleware(r)
 	log.Printf("Starting %s (%s) on port %s\n", s.Name, s.ID, s.Port)
-	log.Fatal(http.ListenAndServe(s.Port, loggedRouter))
+	log.Fatal(http.ListenAndServe(s.Port, handler))
+}
+
+// RedirectToHTTPS redirects plain HTTP requests to the HTTPS listener
+func (s *Server) RedirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	if s.TLSPort != ":443" {
+		host = net.JoinHostPort(host, strings.TrimPrefix(s.TLSPort, ":"))
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// RunAdminServer runs the admin listener with the metrics endpoint and the
+// admin API
+func (s *Server) RunAdminServer() {
+	r := http.NewServeMux()
+	r.Handle("/metrics", metrics.DefaultRegistry.Handler())
+	if s.AdminAuth != nil {
+		r.HandleFunc("/api/gateway/bans", s.adminHandler(s.Bans))
+		r.HandleFunc("/api/gateway/audit", s.adminHandler(s.AuditEvents))
+	} else {
+		log.Println("Admin API disabled, no ADMIN_KEYS configured")
+	}
+
+	log.Printf("Starting admin listener on %s\n", s.AdminAddress)
+	log.Fatal(http.ListenAndServe(s.AdminAddress, r))
 }
 
 func (s *Server) StartRouteRefresher(minutes int) {
@@ -74,6 +187,19 @@ func (s *Server) StartRouteRefresher(minutes int) {
 	}
 }
 
+// StartNonceCleanup deletes the expired nonces of signed requests in the
+// given interval
+func (s *Server) StartNonceCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := s.Database.DeleteExpiredSignatureNonces(); err != nil {
+			log.Printf("Error deleting expired signature nonces: %s\n", err)
+		}
+	}
+}
+
 func (s *Server) RefreshRoutesPeriodically() {
 	routes, err := s.RefreshRoutes(s.Database)
 	if err != nil {
@@ -81,5 +207,6 @@ func (s *Server) RefreshRoutesPeriodically() {
 		return
 	}
 
+	s.recordRefresh(nil, s.Routes, routes)
 	s.SetRoutes(routes)
 }
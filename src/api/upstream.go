@@ -0,0 +1,115 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/secnex/secnex-api-gateway/certs"
+	"github.com/secnex/secnex-api-gateway/db"
+)
+
+// NewUpstreamTransport creates a dedicated transport for the target of a
+// route with its TLS settings. InsecureSkipVerify is only accepted if
+// UPSTREAM_TLS_ALLOW_INSECURE=true is set, e.g. in development.
+func NewUpstreamTransport(upstream db.UpstreamTLS) (*http.Transport, error) {
+	version, err := certs.ParseVersion(upstream.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion: version,
+		ServerName: upstream.ServerName.String,
+	}
+
+	if upstream.CAFile.Valid || upstream.CABundle.Valid {
+		bundle := []byte(upstream.CABundle.String)
+		if upstream.CAFile.Valid {
+			bundle, err = os.ReadFile(upstream.CAFile.String)
+			if err != nil {
+				return nil, err
+			}
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates in CA bundle of route %s", upstream.RouteID)
+		}
+	}
+
+	if upstream.CertFile.Valid {
+		certificate, err := tls.LoadX509KeyPair(upstream.CertFile.String, upstream.KeyFile.String)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	} else if upstream.Certificate.Valid {
+		certificate, err := tls.X509KeyPair([]byte(upstream.Certificate.String), []byte(upstream.PrivateKey.String))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if upstream.InsecureSkipVerify {
+		if allowed, _ := strconv.ParseBool(os.Getenv("UPSTREAM_TLS_ALLOW_INSECURE")); !allowed {
+			return nil, fmt.Errorf("insecure_skip_verify of route %s requires UPSTREAM_TLS_ALLOW_INSECURE=true", upstream.RouteID)
+		}
+		log.Printf("Warning: certificates of the target of route %s are not verified\n", upstream.RouteID)
+		config.InsecureSkipVerify = true
+	}
+
+	if len(upstream.Pins) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range upstream.Pins {
+			pins[strings.ToLower(strings.ReplaceAll(pin, ":", ""))] = true
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPins(state, pins)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+// verifyPins accepts the connection if the public key of the target
+// certificate or of a CA of its verified chain is pinned. Other certificates
+// sent by the target are not verified, any target could send the pinned CA.
+func verifyPins(state tls.ConnectionState, pins map[string]bool) error {
+	certificates := []*x509.Certificate{}
+	if len(state.PeerCertificates) > 0 {
+		certificates = append(certificates, state.PeerCertificates[0])
+	}
+	for _, chain := range state.VerifiedChains {
+		certificates = append(certificates, chain...)
+	}
+	for _, certificate := range certificates {
+		sum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+		if pins[hex.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return fmt.Errorf("no pinned public key in the certificate chain of %s", state.ServerName)
+}
+
+// loadUpstreamTransport loads the TLS settings toward the target of a route,
+// the result is nil if the route uses the shared transport
+func loadUpstreamTransport(cnx *db.Connection, routeId string) (*http.Transport, error) {
+	upstream, ok, err := cnx.GetUpstreamTLS(routeId)
+	if err != nil || !ok {
+		return nil, err
+	}
+	transport, err := NewUpstreamTransport(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("upstream tls of route %s: %w", routeId, err)
+	}
+	return transport, nil
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newCertificate creates a certificate signed by the parent, or a self-signed
+// one without parent
+func newCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{name},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func pin(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca, caKey := newCertificate(t, "Pinned CA", true, nil, nil)
+	leaf, _ := newCertificate(t, "orders.internal", false, ca, caKey)
+	otherCA, otherKey := newCertificate(t, "Public CA", true, nil, nil)
+	otherLeaf, _ := newCertificate(t, "orders.internal", false, otherCA, otherKey)
+	selfSigned, _ := newCertificate(t, "orders.internal", false, nil, nil)
+
+	tests := []struct {
+		name     string
+		pins     []string
+		state    tls.ConnectionState
+		accepted bool
+	}{
+		{
+			name:     "pinned target certificate",
+			pins:     []string{pin(leaf)},
+			state:    tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}, VerifiedChains: [][]*x509.Certificate{{leaf, ca}}},
+			accepted: true,
+		},
+		{
+			name:     "pinned CA of the verified chain",
+			pins:     []string{pin(ca)},
+			state:    tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}, VerifiedChains: [][]*x509.Certificate{{leaf, ca}}},
+			accepted: true,
+		},
+		{
+			name:  "no pinned certificate",
+			pins:  []string{pin(ca)},
+			state: tls.ConnectionState{PeerCertificates: []*x509.Certificate{otherLeaf, otherCA}, VerifiedChains: [][]*x509.Certificate{{otherLeaf, otherCA}}},
+		},
+		{
+			// A target with a trusted certificate appends the public pinned CA,
+			// which is not part of its verified chain
+			name:  "pinned CA appended to another chain",
+			pins:  []string{pin(ca)},
+			state: tls.ConnectionState{PeerCertificates: []*x509.Certificate{otherLeaf, otherCA, ca}, VerifiedChains: [][]*x509.Certificate{{otherLeaf, otherCA}}},
+		},
+		{
+			// Without verification (insecure_skip_verify) there are no
+			// verified chains
+			name:  "pinned CA appended to a self-signed certificate",
+			pins:  []string{pin(ca)},
+			state: tls.ConnectionState{PeerCertificates: []*x509.Certificate{selfSigned, ca}},
+		},
+		{
+			name:     "pinned self-signed certificate without verification",
+			pins:     []string{pin(selfSigned)},
+			state:    tls.ConnectionState{PeerCertificates: []*x509.Certificate{selfSigned}},
+			accepted: true,
+		},
+		{
+			name:  "without certificates",
+			pins:  []string{pin(ca)},
+			state: tls.ConnectionState{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pins := map[string]bool{}
+			for _, pin := range test.pins {
+				pins[pin] = true
+			}
+			err := verifyPins(test.state, pins)
+			if (err == nil) != test.accepted {
+				t.Errorf("verifyPins() = %v, want accepted %v", err, test.accepted)
+			}
+		})
+	}
+}
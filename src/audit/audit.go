@@ -0,0 +1,281 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/metrics"
+)
+
+// Event types
+const EVENT_ROUTES_REFRESHED = "config.routes_refreshed"
+const EVENT_BAN_CREATED = "ban.created"
+const EVENT_BAN_LIFTED = "ban.lifted"
+const EVENT_KEY_ANOMALY = "key.anomaly"
+const EVENT_KEY_SECRET_CREATED = "key.secret_created"
+const EVENT_SECURITY_DENIED = "security.denied"
+
+// Actor of events triggered by the gateway itself
+const ACTOR_SYSTEM = "system"
+
+const DEFAULT_BUFFER_SIZE = 4096
+const DEFAULT_BATCH_SIZE = 256
+const DEFAULT_KEY_WINDOW = 10 * time.Minute
+const DEFAULT_KEY_MAX_ADDRESSES = 20
+
+var DroppedEvents = metrics.NewCounter("gateway_audit_events_dropped_total", "Audit events dropped because the buffer was full.")
+
+// Event is a security relevant action. Before, After and Details are stored
+// as JSON.
+type Event struct {
+	Type      string
+	Actor     string
+	ActorIP   string
+	Target    string
+	RequestID string
+	Before    interface{}
+	After     interface{}
+	Details   map[string]interface{}
+	Time      time.Time
+}
+
+// Logger writes audit events asynchronously to the audit_events table.
+// Recording never blocks, events are dropped and counted if the buffer is
+// full.
+type Logger struct {
+	Database        *db.Connection
+	BatchSize       int
+	KeyWindow       time.Duration
+	KeyMaxAddresses int
+	queue           chan Event
+	keys            map[string]map[string]time.Time
+	mu              sync.Mutex
+	dropped         atomic.Int64
+}
+
+func NewLogger(database *db.Connection, bufferSize int) *Logger {
+	return &Logger{
+		Database:        database,
+		BatchSize:       DEFAULT_BATCH_SIZE,
+		KeyWindow:       DEFAULT_KEY_WINDOW,
+		KeyMaxAddresses: DEFAULT_KEY_MAX_ADDRESSES,
+		queue:           make(chan Event, bufferSize),
+		keys:            map[string]map[string]time.Time{},
+	}
+}
+
+// NewLoggerEnv creates a logger from the AUDIT_* environment variables:
+//
+//	AUDIT_ENABLED=false         disables the audit log
+//	AUDIT_BUFFER_SIZE=4096      events buffered before they are dropped
+//	AUDIT_KEY_WINDOW=10m        window of the key usage anomaly detection
+//	AUDIT_KEY_MAX_ADDRESSES=20  client addresses per key within the window
+func NewLoggerEnv(database *db.Connection) (*Logger, error) {
+	if enabled, err := strconv.ParseBool(os.Getenv("AUDIT_ENABLED")); err == nil && !enabled {
+		return nil, nil
+	}
+
+	bufferSize := DEFAULT_BUFFER_SIZE
+	if value := os.Getenv("AUDIT_BUFFER_SIZE"); value != "" {
+		var err error
+		bufferSize, err = strconv.Atoi(value)
+		if err != nil || bufferSize <= 0 {
+			return nil, fmt.Errorf("invalid AUDIT_BUFFER_SIZE %q", value)
+		}
+	}
+	l := NewLogger(database, bufferSize)
+
+	if value := os.Getenv("AUDIT_KEY_WINDOW"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AUDIT_KEY_WINDOW: %w", err)
+		}
+		l.KeyWindow = window
+	}
+	if value := os.Getenv("AUDIT_KEY_MAX_ADDRESSES"); value != "" {
+		maxAddresses, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AUDIT_KEY_MAX_ADDRESSES: %w", err)
+		}
+		l.KeyMaxAddresses = maxAddresses
+	}
+
+	return l, nil
+}
+
+// Record queues the event for writing
+func (l *Logger) Record(event Event) {
+	if l == nil {
+		return
+	}
+	event = withDefaults(event)
+
+	select {
+	case l.queue <- event:
+	default:
+		l.dropped.Add(1)
+		DroppedEvents.Inc()
+	}
+}
+
+// Write writes the event immediately, e.g. for commands which exit before
+// queued events are written
+func (l *Logger) Write(event Event) error {
+	if l == nil {
+		return nil
+	}
+	return l.write([]Event{withDefaults(event)})
+}
+
+func withDefaults(event Event) Event {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Actor == "" {
+		event.Actor = ACTOR_SYSTEM
+	}
+	return event
+}
+
+// KeyUsage tracks the client addresses of an API key and records an anomaly
+// once the key is used from more than KeyMaxAddresses addresses within the
+// KeyWindow
+func (l *Logger) KeyUsage(keyID string, clientIP string, requestID string) {
+	if l == nil || keyID == "" || l.KeyMaxAddresses <= 0 {
+		return
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	addresses, ok := l.keys[keyID]
+	if !ok {
+		addresses = map[string]time.Time{}
+		l.keys[keyID] = addresses
+	}
+	for address, seen := range addresses {
+		if now.Sub(seen) > l.KeyWindow {
+			delete(addresses, address)
+		}
+	}
+	addresses[clientIP] = now
+	count := len(addresses)
+	if count > l.KeyMaxAddresses {
+		// Start over to report the key again only after another burst
+		delete(l.keys, keyID)
+	}
+	l.mu.Unlock()
+
+	if count > l.KeyMaxAddresses {
+		l.Record(Event{
+			Type:      EVENT_KEY_ANOMALY,
+			Actor:     keyID,
+			ActorIP:   clientIP,
+			Target:    keyID,
+			RequestID: requestID,
+			Details: map[string]interface{}{
+				"addresses": count,
+				"window":    l.KeyWindow.String(),
+			},
+		})
+	}
+}
+
+// Start writes the queued events in batches. Events are written when a batch
+// is full or the interval elapsed.
+func (l *Logger) Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, l.BatchSize)
+	for {
+		select {
+		case event := <-l.queue:
+			batch = append(batch, event)
+			if len(batch) < l.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if dropped := l.dropped.Swap(0); dropped > 0 {
+				log.Printf("Audit buffer full, %d events dropped.\n", dropped)
+			}
+			l.pruneKeys()
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := l.write(batch); err != nil {
+			log.Printf("Error writing %d audit events: %s\n", len(batch), err)
+		}
+		batch = make([]Event, 0, l.BatchSize)
+	}
+}
+
+func (l *Logger) write(batch []Event) error {
+	events := make([]db.AuditEvent, 0, len(batch))
+	for _, event := range batch {
+		__event := db.AuditEvent{
+			Type:      event.Type,
+			Actor:     event.Actor,
+			ActorIP:   nullString(event.ActorIP),
+			Target:    nullString(event.Target),
+			RequestID: nullString(event.RequestID),
+			CreatedAt: event.Time,
+		}
+		var errBefore, errAfter, errDetails error
+		__event.Before, errBefore = toJSON(event.Before)
+		__event.After, errAfter = toJSON(event.After)
+		__event.Details, errDetails = toJSON(event.Details)
+		if err := errors.Join(errBefore, errAfter, errDetails); err != nil {
+			log.Printf("Error encoding audit event %s: %s\n", event.Type, err)
+			continue
+		}
+		events = append(events, __event)
+	}
+
+	return l.Database.CreateAuditEvents(events)
+}
+
+// pruneKeys forgets keys which were not used within the window
+func (l *Logger) pruneKeys() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for keyID, addresses := range l.keys {
+		for address, seen := range addresses {
+			if now.Sub(seen) > l.KeyWindow {
+				delete(addresses, address)
+			}
+		}
+		if len(addresses) == 0 {
+			delete(l.keys, keyID)
+		}
+	}
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+func toJSON(value interface{}) (sql.NullString, error) {
+	if value == nil {
+		return sql.NullString{}, nil
+	}
+	if m, ok := value.(map[string]interface{}); ok && m == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
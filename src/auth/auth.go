@@ -41,7 +41,10 @@ func Base64ToIDAndToken(s string) (uuid.UUID, string, error) {
 	if err != nil {
 		return uuid.Nil, "", err
 	}
-	split := strings.Split(string(data), ":")
+	split := strings.SplitN(string(data), ":", 2)
+	if len(split) != 2 {
+		return uuid.Nil, "", fmt.Errorf("invalid token format")
+	}
 	id, err := uuid.Parse(split[0])
 	if err != nil {
 		return uuid.Nil, "", err
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/secnex/secnex-api-gateway/middleware"
+)
+
+// Authentication methods
+const METHOD_API_KEY = "API_KEY"
+const METHOD_BASIC = "BASIC"
+const METHOD_JWT = "JWT"
+const METHOD_MTLS = "MTLS"
+const METHOD_INTROSPECTION = "INTROSPECTION"
+const METHOD_HMAC = "HMAC"
+const METHOD_NONE = "NONE"
+
+// Method of principals logged in with OpenID Connect, which is handled by
+// the login flow instead of a chain
+const METHOD_OIDC = "OIDC"
+
+// Modes of a chain
+const MODE_ANY = "ANY"
+const MODE_ALL = "ALL"
+
+// ErrNoCredentials is returned by authenticators if the request carries no
+// credentials for them, e.g. no Authorization header of their scheme
+var ErrNoCredentials = errors.New("no credentials")
+
+// ErrForbidden rejects valid credentials which are not allowed for the route
+var ErrForbidden = errors.New("not allowed")
+
+// ErrUnavailable is returned if credentials cannot be checked, e.g. because
+// the database is down. The client is not at fault.
+var ErrUnavailable = errors.New("authentication unavailable")
+
+// CredentialHeaders carry the credentials of clients at the gateway. They
+// are removed from all forwarded requests, so targets never see them.
+var CredentialHeaders = []string{"Authorization", "X-Api-Key", HEADER_SIGNATURE_TIMESTAMP, HEADER_SIGNATURE_NONCE}
+
+// Authenticator checks the credentials of a request
+type Authenticator interface {
+	// Method returns one of the METHOD_* constants
+	Method() string
+	Authenticate(r *http.Request) (*middleware.Principal, error)
+}
+
+// Challenger is implemented by authenticators which announce their scheme
+// in the WWW-Authenticate header of rejections
+type Challenger interface {
+	Challenge(err error) string
+}
+
+// Chain authenticates with an ordered list of authenticators. In MODE_ANY
+// the first successful authenticator wins, in MODE_ALL every authenticator
+// must succeed and the principal is the one of the first.
+type Chain struct {
+	Mode           string
+	Authenticators []Authenticator
+}
+
+func NewChain(mode string, authenticators ...Authenticator) *Chain {
+	if mode != MODE_ALL {
+		mode = MODE_ANY
+	}
+	return &Chain{Mode: mode, Authenticators: authenticators}
+}
+
+// Authenticate returns the principal of the request. If no authenticator
+// succeeds, the error of the first one which rejected credentials is
+// returned, otherwise the first ErrNoCredentials.
+func (c *Chain) Authenticate(r *http.Request) (*middleware.Principal, error) {
+	if len(c.Authenticators) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	var principal *middleware.Principal
+	var rejection, missing error
+	for _, authenticator := range c.Authenticators {
+		current, err := authenticator.Authenticate(r)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", strings.ToLower(authenticator.Method()), err)
+			if c.Mode == MODE_ALL {
+				return nil, err
+			}
+			if errors.Is(err, ErrNoCredentials) {
+				if missing == nil {
+					missing = err
+				}
+			} else if rejection == nil {
+				rejection = err
+			}
+			continue
+		}
+		if c.Mode == MODE_ANY {
+			return current, nil
+		}
+		if principal == nil {
+			principal = current
+			continue
+		}
+		principal.Methods = append(principal.Methods, current.Methods...)
+		for header, value := range current.Headers {
+			if _, ok := principal.Headers[header]; !ok {
+				principal.Headers[header] = value
+			}
+		}
+	}
+
+	if principal != nil {
+		return principal, nil
+	}
+	if rejection != nil {
+		return nil, rejection
+	}
+	return nil, missing
+}
+
+// Challenges returns the WWW-Authenticate values for a rejection
+func (c *Chain) Challenges(err error) []string {
+	challenges := []string{}
+	for _, authenticator := range c.Authenticators {
+		if challenger, ok := authenticator.(Challenger); ok {
+			if challenge := challenger.Challenge(err); challenge != "" {
+				challenges = append(challenges, challenge)
+			}
+		}
+	}
+	return challenges
+}
+
+// Status returns the HTTP status of an authentication error
+func Status(err error) int {
+	switch {
+	case errors.Is(err, ErrUnavailable), errors.Is(err, ErrIntrospectionUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrInsufficientScope):
+		return http.StatusForbidden
+	default:
+		return http.StatusUnauthorized
+	}
+}
+
+// NewPrincipal creates the principal of a single method
+func NewPrincipal(id string, method string) *middleware.Principal {
+	return &middleware.Principal{ID: id, Methods: []string{method}, Headers: map[string]string{}}
+}
+
+// bearerToken returns the token of a Bearer Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
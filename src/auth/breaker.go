@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const BREAKER_CLOSED = "closed"
+const BREAKER_OPEN = "open"
+const BREAKER_HALF_OPEN = "half-open"
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+// Breaker stops calls to a failing dependency. After Threshold consecutive
+// failures the circuit opens and calls fail immediately. After the Cooldown
+// a single trial call is let through, its result closes or reopens the
+// circuit.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	mu        sync.Mutex
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		state:     BREAKER_CLOSED,
+	}
+}
+
+// Allow returns ErrCircuitOpen if the call must not be made
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BREAKER_OPEN:
+		if time.Since(b.openedAt) < b.Cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BREAKER_HALF_OPEN
+		return nil
+	case BREAKER_HALF_OPEN:
+		// Only the trial call is made
+		return ErrCircuitOpen
+	default:
+		return nil
+	}
+}
+
+// Done records the result of an allowed call
+func (b *Breaker) Done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.state = BREAKER_CLOSED
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BREAKER_HALF_OPEN || b.failures >= b.Threshold {
+		b.state = BREAKER_OPEN
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns the current state of the circuit
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_TOKEN_TIMEOUT = 10 * time.Second
+
+// Tokens are renewed this long before they expire
+const TOKEN_EXPIRY_MARGIN = 30 * time.Second
+
+// Lifetime of tokens without expires_in
+const DEFAULT_TOKEN_LIFETIME = 5 * time.Minute
+
+// Maximum size of a token response
+const MAX_TOKEN_RESPONSE_SIZE = 1 << 20
+
+// ClientCredentialsConfig is a client of the gateway at an OAuth2
+// authorization server
+type ClientCredentialsConfig struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+}
+
+// TokenSource obtains access tokens with the client credentials grant and
+// caches them until shortly before they expire
+type TokenSource struct {
+	Config    ClientCredentialsConfig
+	Client    *http.Client
+	token     string
+	expiresAt time.Time
+	mu        sync.Mutex
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// Token sources are shared by all routes with the same client, so tokens
+// survive route refreshes
+var tokenSources = map[string]*TokenSource{}
+var tokenSourcesMu sync.Mutex
+
+func NewTokenSource(config ClientCredentialsConfig) *TokenSource {
+	return &TokenSource{
+		Config: config,
+		Client: &http.Client{Timeout: DEFAULT_TOKEN_TIMEOUT},
+	}
+}
+
+// SharedTokenSource returns the token source of the client. It is replaced
+// if the configuration changed.
+func SharedTokenSource(config ClientCredentialsConfig) *TokenSource {
+	key := config.TokenURL + " " + config.ClientID + " " + config.Scope
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+	if source, ok := tokenSources[key]; ok && source.Config == config {
+		return source
+	}
+	source := NewTokenSource(config)
+	tokenSources[key] = source
+	return source
+}
+
+// Token returns a valid access token. Concurrent callers wait for a single
+// request to the authorization server. If the renewal fails, the current
+// token is used until it expires.
+func (t *TokenSource) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.token != "" && now.Add(TOKEN_EXPIRY_MARGIN).Before(t.expiresAt) {
+		return t.token, nil
+	}
+	token, lifetime, err := t.request()
+	if err != nil {
+		if t.token != "" && now.Before(t.expiresAt) {
+			return t.token, nil
+		}
+		return "", fmt.Errorf("token of client %s: %w", t.Config.ClientID, err)
+	}
+	t.token = token
+	t.expiresAt = now.Add(lifetime)
+	return t.token, nil
+}
+
+func (t *TokenSource) request() (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if t.Config.Scope != "" {
+		form.Set("scope", t.Config.Scope)
+	}
+	request, err := http.NewRequest(http.MethodPost, t.Config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(t.Config.ClientID), url.QueryEscape(t.Config.ClientSecret))
+
+	response, err := t.Client.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+	defer response.Body.Close()
+
+	result := tokenResponse{}
+	data, err := io.ReadAll(io.LimitReader(response.Body, MAX_TOKEN_RESPONSE_SIZE))
+	if err != nil {
+		return "", 0, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", 0, fmt.Errorf("token endpoint status %d: %w", response.StatusCode, err)
+	}
+	if result.Error != "" {
+		return "", 0, fmt.Errorf("token endpoint: %s %s", result.Error, result.Description)
+	}
+	if response.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", 0, fmt.Errorf("token endpoint status %d", response.StatusCode)
+	}
+
+	lifetime := DEFAULT_TOKEN_LIFETIME
+	if result.ExpiresIn > 0 {
+		lifetime = time.Duration(result.ExpiresIn) * time.Second
+	}
+	return result.AccessToken, lifetime, nil
+}
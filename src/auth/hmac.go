@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/middleware"
+)
+
+// Scheme of signed requests in the Authorization header:
+// HMAC-SHA256 KeyId=<id>, SignedHeaders=<h1;h2>, Signature=<hex>
+const HMAC_SCHEME = "HMAC-SHA256"
+
+// Headers with the time of the signature in Unix seconds and a unique
+// value of the request. Both are always signed.
+const HEADER_SIGNATURE_TIMESTAMP = "X-Signature-Timestamp"
+const HEADER_SIGNATURE_NONCE = "X-Signature-Nonce"
+
+// Signatures older or newer than this are rejected
+const DEFAULT_SIGNATURE_MAX_AGE = 5 * time.Minute
+
+// Larger bodies cannot be signed
+const DEFAULT_SIGNATURE_MAX_BODY_SIZE = 10 << 20
+
+// Nonces of authenticators without UseNonce are remembered in the process
+// until their signature is stale. If the cache is full, signed requests are
+// rejected instead of forgetting nonces.
+const NONCE_CACHE_SIZE = 100000
+
+// Headers which must be signed, host binds the signature to the gateway
+var requiredSignedHeaders = []string{"host", strings.ToLower(HEADER_SIGNATURE_TIMESTAMP), strings.ToLower(HEADER_SIGNATURE_NONCE)}
+
+var ErrInvalidSignature = errors.New("invalid signature")
+var ErrStaleSignature = errors.New("stale signature timestamp")
+var ErrReplayedSignature = errors.New("signature nonce already used")
+
+// Local nonces are shared by all routes, so a reload does not open a replay
+// window
+var nonces = map[string]time.Time{}
+var noncesMu sync.Mutex
+
+// HMACAuthenticator checks requests signed with a shared secret of the
+// key id. The string to sign is built by StringToSign. Lookup returns the
+// secret of a key id. If Allowed is set, only these key ids are accepted.
+// UseNonce stores a nonce until it expires and returns false if it is
+// already stored. It must be shared by all gateway instances, without it
+// nonces are only remembered by this process.
+type HMACAuthenticator struct {
+	Lookup      func(id string) (secret string, ok bool, err error)
+	UseNonce    func(nonce string, expiresAt time.Time) (fresh bool, err error)
+	Allowed     map[string]bool
+	MaxAge      time.Duration
+	MaxBodySize int64
+}
+
+// signatureParameters is the parsed Authorization header
+type signatureParameters struct {
+	KeyID         string
+	SignedHeaders []string
+	Signature     []byte
+}
+
+func (a *HMACAuthenticator) Method() string {
+	return METHOD_HMAC
+}
+
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (*middleware.Principal, error) {
+	scheme, value, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, HMAC_SCHEME) {
+		return nil, ErrNoCredentials
+	}
+	parameters, err := parseSignature(value)
+	if err != nil {
+		return nil, err
+	}
+
+	maxAge := a.MaxAge
+	if maxAge <= 0 {
+		maxAge = DEFAULT_SIGNATURE_MAX_AGE
+	}
+	seconds, err := strconv.ParseInt(r.Header.Get(HEADER_SIGNATURE_TIMESTAMP), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidSignature, HEADER_SIGNATURE_TIMESTAMP)
+	}
+	timestamp := time.Unix(seconds, 0)
+	if age := time.Since(timestamp); age > maxAge || age < -maxAge {
+		return nil, ErrStaleSignature
+	}
+	nonce := r.Header.Get(HEADER_SIGNATURE_NONCE)
+	if nonce == "" {
+		return nil, fmt.Errorf("%w: missing %s", ErrInvalidSignature, HEADER_SIGNATURE_NONCE)
+	}
+
+	secret, ok, err := a.Lookup(parameters.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	if !ok {
+		return nil, ErrInvalidSignature
+	}
+
+	maxBodySize := a.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DEFAULT_SIGNATURE_MAX_BODY_SIZE
+	}
+	digest, err := bodyDigest(r, maxBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(StringToSign(r, parameters.SignedHeaders, digest)))
+	if !hmac.Equal(mac.Sum(nil), parameters.Signature) {
+		return nil, ErrInvalidSignature
+	}
+	if len(a.Allowed) > 0 && !a.Allowed[parameters.KeyID] {
+		return nil, fmt.Errorf("key %w", ErrForbidden)
+	}
+
+	// Only valid signatures use up a nonce, forged requests cannot block
+	// the nonces of the client
+	if err := a.checkNonce(parameters.KeyID+":"+nonce, timestamp.Add(maxAge)); err != nil {
+		return nil, err
+	}
+	return NewPrincipal(parameters.KeyID, METHOD_HMAC), nil
+}
+
+func (a *HMACAuthenticator) Challenge(err error) string {
+	return HMAC_SCHEME + ` realm="gateway"`
+}
+
+// StringToSign returns the canonical form of the request which is signed
+// by the client, the lines are separated by \n:
+//
+//	HMAC-SHA256
+//	<method>
+//	<escaped path>
+//	<query, sorted by name and value>
+//	<name:value of each signed header, lower case, in the signed order>
+//	<signed header names joined by ;>
+//	<hex SHA-256 of the body>
+func StringToSign(r *http.Request, signedHeaders []string, bodyDigest string) string {
+	lines := []string{HMAC_SCHEME, r.Method, r.URL.EscapedPath(), canonicalQuery(r.URL.Query())}
+	for _, name := range signedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		lines = append(lines, name+":"+strings.TrimSpace(value))
+	}
+	lines = append(lines, strings.Join(signedHeaders, ";"), bodyDigest)
+	return strings.Join(lines, "\n")
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func parseSignature(value string) (signatureParameters, error) {
+	parameters := signatureParameters{}
+	for _, part := range strings.Split(value, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return parameters, fmt.Errorf("%w: malformed header", ErrInvalidSignature)
+		}
+		switch name {
+		case "KeyId":
+			parameters.KeyID = value
+		case "SignedHeaders":
+			parameters.SignedHeaders = strings.Split(strings.ToLower(value), ";")
+		case "Signature":
+			signature, err := hex.DecodeString(value)
+			if err != nil {
+				return parameters, fmt.Errorf("%w: malformed signature", ErrInvalidSignature)
+			}
+			parameters.Signature = signature
+		}
+	}
+	if parameters.KeyID == "" || len(parameters.Signature) == 0 {
+		return parameters, fmt.Errorf("%w: missing KeyId or Signature", ErrInvalidSignature)
+	}
+	for _, required := range requiredSignedHeaders {
+		found := false
+		for _, name := range parameters.SignedHeaders {
+			found = found || name == required
+		}
+		if !found {
+			return parameters, fmt.Errorf("%w: %s not signed", ErrInvalidSignature, required)
+		}
+	}
+	return parameters, nil
+}
+
+// bodyDigest returns the hex SHA-256 of the body. The body is restored so
+// it can still be forwarded to the target.
+func bodyDigest(r *http.Request, maxBodySize int64) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return hex.EncodeToString(sha256.New().Sum(nil)), nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("%w: cannot read body", ErrInvalidSignature)
+	}
+	if int64(len(data)) > maxBodySize {
+		return "", fmt.Errorf("%w: body too large", ErrInvalidSignature)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checkNonce stores the nonce with UseNonce or in the process and fails if
+// it was used before. Stored nonces are hashed, so their size is fixed.
+func (a *HMACAuthenticator) checkNonce(nonce string, expiresAt time.Time) error {
+	if a.UseNonce == nil {
+		return useLocalNonce(nonce, expiresAt)
+	}
+	sum := sha256.Sum256([]byte(nonce))
+	fresh, err := a.UseNonce(hex.EncodeToString(sum[:]), expiresAt)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	if !fresh {
+		return ErrReplayedSignature
+	}
+	return nil
+}
+
+// useLocalNonce remembers the nonce in the process until it expires and
+// fails if it was used before
+func useLocalNonce(nonce string, expiresAt time.Time) error {
+	now := time.Now()
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+
+	if expiry, ok := nonces[nonce]; ok && now.Before(expiry) {
+		return ErrReplayedSignature
+	}
+	if len(nonces) >= NONCE_CACHE_SIZE {
+		for key, expiry := range nonces {
+			if !now.Before(expiry) {
+				delete(nonces, key)
+			}
+		}
+		if len(nonces) >= NONCE_CACHE_SIZE {
+			return fmt.Errorf("%w: nonce cache full", ErrUnavailable)
+		}
+	}
+	nonces[nonce] = expiresAt
+	return nil
+}
@@ -0,0 +1,313 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const testSignedHeaders = "host;x-signature-timestamp;x-signature-nonce;content-type"
+
+// Known answer of StringToSign and the signature, computed independently of
+// the gateway. Clients must produce exactly this.
+const knownStringToSign = "HMAC-SHA256\n" +
+	"POST\n" +
+	"/api/orders/items%2F1\n" +
+	"a=1&a=x+y&b=2\n" +
+	"host:gateway.example\n" +
+	"x-signature-timestamp:1700000000\n" +
+	"x-signature-nonce:n-1\n" +
+	"content-type:application/json\n" +
+	"host;x-signature-timestamp;x-signature-nonce;content-type\n" +
+	"92438ddd4266b3271fcebff491a7db7f0995332bade824c704f83596b7f36f74"
+const knownSignature = "85eda7b5608c4821422e5cc1918ac3fd02c5a33c1fd5de071927ad734900306c"
+
+func TestStringToSignKnownAnswer(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "https://gateway.example/api/orders/items%2F1?b=2&a=x%20y&a=1", strings.NewReader(`{"qty":1}`))
+	r.Header.Set(HEADER_SIGNATURE_TIMESTAMP, "1700000000")
+	r.Header.Set(HEADER_SIGNATURE_NONCE, "n-1")
+	r.Header.Set("Content-Type", " application/json ")
+
+	digest, err := bodyDigest(r, DEFAULT_SIGNATURE_MAX_BODY_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringToSign := StringToSign(r, strings.Split(testSignedHeaders, ";"), digest)
+	if stringToSign != knownStringToSign {
+		t.Fatalf("StringToSign() = %q, want %q", stringToSign, knownStringToSign)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(stringToSign))
+	if signature := hex.EncodeToString(mac.Sum(nil)); signature != knownSignature {
+		t.Errorf("signature = %s, want %s", signature, knownSignature)
+	}
+
+	// The body is still forwarded
+	body, _ := io.ReadAll(r.Body)
+	if string(body) != `{"qty":1}` {
+		t.Errorf("body after digest = %q", body)
+	}
+}
+
+func TestEmptyBodyDigest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	digest, err := bodyDigest(r, DEFAULT_SIGNATURE_MAX_BODY_SIZE)
+	if err != nil || digest != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("bodyDigest() of empty body = %s, %v", digest, err)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("0123456789"))
+	if _, err := bodyDigest(r, 9); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("bodyDigest() of too large body = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"b=2&a=1", "a=1&b=2"},
+		{"a=2&a=10&a=1", "a=1&a=10&a=2"},
+		{"a=x%20y&a=x+y", "a=x+y&a=x+y"},
+		{"q=a%26b%3Dc", "q=a%26b%3Dc"},
+		{"q=%2B1", "q=%2B1"},
+		{"name=%C3%A4", "name=%C3%A4"},
+		{"flag&empty=", "empty=&flag="},
+		{"z=1&a%20b=2", "a+b=2&z=1"},
+	}
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := canonicalQuery(query); got != test.want {
+			t.Errorf("canonicalQuery(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseSignature(t *testing.T) {
+	signature := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "valid", value: "KeyId=key-1, SignedHeaders=" + testSignedHeaders + ", Signature=" + signature},
+		{name: "header names ignore the case", value: "KeyId=key-1, SignedHeaders=Host;X-Signature-Timestamp;X-Signature-Nonce, Signature=" + signature},
+		{name: "host not signed", value: "KeyId=key-1, SignedHeaders=x-signature-timestamp;x-signature-nonce, Signature=" + signature, wantErr: "invalid signature: host not signed"},
+		{name: "timestamp not signed", value: "KeyId=key-1, SignedHeaders=host;x-signature-nonce, Signature=" + signature, wantErr: "invalid signature: x-signature-timestamp not signed"},
+		{name: "nonce not signed", value: "KeyId=key-1, SignedHeaders=host;x-signature-timestamp, Signature=" + signature, wantErr: "invalid signature: x-signature-nonce not signed"},
+		{name: "without key id", value: "SignedHeaders=" + testSignedHeaders + ", Signature=" + signature, wantErr: "invalid signature: missing KeyId or Signature"},
+		{name: "without signature", value: "KeyId=key-1, SignedHeaders=" + testSignedHeaders, wantErr: "invalid signature: missing KeyId or Signature"},
+		{name: "signature not hex", value: "KeyId=key-1, SignedHeaders=" + testSignedHeaders + ", Signature=xyz", wantErr: "invalid signature: malformed signature"},
+		{name: "malformed", value: "KeyId=key-1, " + testSignedHeaders, wantErr: "invalid signature: malformed header"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parameters, err := parseSignature(test.value)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("parseSignature() = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSignature() = %v", err)
+			}
+			if parameters.KeyID != "key-1" || hex.EncodeToString(parameters.Signature) != signature || parameters.SignedHeaders[0] != "host" {
+				t.Errorf("parseSignature() = %+v", parameters)
+			}
+		})
+	}
+}
+
+// signedRequest builds a request signed with the secret. The headers are
+// changed by tamper after the signature.
+func signedRequest(t *testing.T, keyID string, secret string, timestamp time.Time, nonce string, tamper func(r *http.Request)) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "https://gateway.example/api/orders?id=1", strings.NewReader(`{"qty":1}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(HEADER_SIGNATURE_TIMESTAMP, strconv.FormatInt(timestamp.Unix(), 10))
+	r.Header.Set(HEADER_SIGNATURE_NONCE, nonce)
+	digest, err := bodyDigest(r, DEFAULT_SIGNATURE_MAX_BODY_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(StringToSign(r, strings.Split(testSignedHeaders, ";"), digest)))
+	r.Header.Set("Authorization", HMAC_SCHEME+" KeyId="+keyID+", SignedHeaders="+testSignedHeaders+", Signature="+hex.EncodeToString(mac.Sum(nil)))
+	if tamper != nil {
+		tamper(r)
+	}
+	return r
+}
+
+// nonceStore is a shared nonce store of several gateway instances
+type nonceStore map[string]time.Time
+
+func (s nonceStore) use(nonce string, expiresAt time.Time) (bool, error) {
+	if _, ok := s[nonce]; ok {
+		return false, nil
+	}
+	s[nonce] = expiresAt
+	return true, nil
+}
+
+func newTestHMACAuthenticator(store nonceStore) *HMACAuthenticator {
+	return &HMACAuthenticator{
+		Lookup: func(id string) (string, bool, error) {
+			return "secret", id == "key-1" || id == "key-2", nil
+		},
+		UseNonce: store.use,
+		Allowed:  map[string]bool{"key-1": true},
+	}
+}
+
+func TestHMACAuthenticate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		keyID     string
+		secret    string
+		timestamp time.Time
+		tamper    func(r *http.Request)
+		wantErr   error
+	}{
+		{name: "valid"},
+		{name: "within the clock skew", timestamp: now.Add(DEFAULT_SIGNATURE_MAX_AGE - time.Minute)},
+		{name: "old signature", timestamp: now.Add(-DEFAULT_SIGNATURE_MAX_AGE - time.Minute), wantErr: ErrStaleSignature},
+		{name: "signature from the future", timestamp: now.Add(DEFAULT_SIGNATURE_MAX_AGE + time.Minute), wantErr: ErrStaleSignature},
+		{name: "wrong secret", secret: "other", wantErr: ErrInvalidSignature},
+		{name: "unknown key", keyID: "key-3", wantErr: ErrInvalidSignature},
+		{name: "key not allowed", keyID: "key-2", wantErr: ErrForbidden},
+		{name: "changed body", tamper: func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"qty":9}`)) }, wantErr: ErrInvalidSignature},
+		{name: "changed query", tamper: func(r *http.Request) { r.URL.RawQuery = "id=2" }, wantErr: ErrInvalidSignature},
+		{name: "changed method", tamper: func(r *http.Request) { r.Method = http.MethodDelete }, wantErr: ErrInvalidSignature},
+		{name: "other host", tamper: func(r *http.Request) { r.Host = "other.example" }, wantErr: ErrInvalidSignature},
+		{name: "changed signed header", tamper: func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") }, wantErr: ErrInvalidSignature},
+		{name: "changed nonce", tamper: func(r *http.Request) { r.Header.Set(HEADER_SIGNATURE_NONCE, uuid.NewString()) }, wantErr: ErrInvalidSignature},
+		{name: "missing timestamp", tamper: func(r *http.Request) { r.Header.Del(HEADER_SIGNATURE_TIMESTAMP) }, wantErr: ErrInvalidSignature},
+		{name: "missing nonce", tamper: func(r *http.Request) { r.Header.Del(HEADER_SIGNATURE_NONCE) }, wantErr: ErrInvalidSignature},
+		{name: "other scheme", tamper: func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") }, wantErr: ErrNoCredentials},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.keyID == "" {
+				test.keyID = "key-1"
+			}
+			if test.secret == "" {
+				test.secret = "secret"
+			}
+			if test.timestamp.IsZero() {
+				test.timestamp = now
+			}
+			r := signedRequest(t, test.keyID, test.secret, test.timestamp, uuid.NewString(), test.tamper)
+			principal, err := newTestHMACAuthenticator(nonceStore{}).Authenticate(r)
+			if test.wantErr == nil {
+				if err != nil || principal.ID != "key-1" {
+					t.Fatalf("Authenticate() = %v, %v", principal, err)
+				}
+				return
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Authenticate() = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHMACNonce(t *testing.T) {
+	store := nonceStore{}
+	nonce := uuid.NewString()
+	now := time.Now()
+
+	// A forged signature does not use up the nonce of the client
+	forged := signedRequest(t, "key-1", "guessed", now, nonce, nil)
+	if _, err := newTestHMACAuthenticator(store).Authenticate(forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Authenticate() of forged request = %v", err)
+	}
+	if len(store) != 0 {
+		t.Fatalf("forged request stored %d nonces", len(store))
+	}
+
+	if _, err := newTestHMACAuthenticator(store).Authenticate(signedRequest(t, "key-1", "secret", now, nonce, nil)); err != nil {
+		t.Fatalf("Authenticate() = %v", err)
+	}
+	// Another instance with the same store rejects the replay
+	if _, err := newTestHMACAuthenticator(store).Authenticate(signedRequest(t, "key-1", "secret", now, nonce, nil)); !errors.Is(err, ErrReplayedSignature) {
+		t.Fatalf("Authenticate() of replay = %v, want %v", err, ErrReplayedSignature)
+	}
+
+	// The stored nonce is hashed with the key id and expires with the
+	// signature
+	sum := sha256.Sum256([]byte("key-1:" + nonce))
+	expiresAt, ok := store[hex.EncodeToString(sum[:])]
+	if !ok || expiresAt.Unix() != now.Add(DEFAULT_SIGNATURE_MAX_AGE).Unix() {
+		t.Errorf("stored nonces = %v", store)
+	}
+
+	failing := newTestHMACAuthenticator(store)
+	failing.UseNonce = func(string, time.Time) (bool, error) { return false, errors.New("connection refused") }
+	if _, err := failing.Authenticate(signedRequest(t, "key-1", "secret", now, uuid.NewString(), nil)); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Authenticate() with failing store = %v, want %v", err, ErrUnavailable)
+	}
+}
+
+func TestUseLocalNonce(t *testing.T) {
+	noncesMu.Lock()
+	saved := nonces
+	nonces = map[string]time.Time{}
+	noncesMu.Unlock()
+	t.Cleanup(func() {
+		noncesMu.Lock()
+		nonces = saved
+		noncesMu.Unlock()
+	})
+
+	now := time.Now()
+	if err := useLocalNonce("n-1", now.Add(time.Minute)); err != nil {
+		t.Fatalf("useLocalNonce() = %v", err)
+	}
+	if err := useLocalNonce("n-1", now.Add(time.Minute)); !errors.Is(err, ErrReplayedSignature) {
+		t.Fatalf("useLocalNonce() of used nonce = %v, want %v", err, ErrReplayedSignature)
+	}
+	if err := useLocalNonce("n-2", now.Add(-time.Second)); err != nil {
+		t.Fatalf("useLocalNonce() = %v", err)
+	}
+	if err := useLocalNonce("n-2", now.Add(time.Minute)); err != nil {
+		t.Fatalf("useLocalNonce() of expired nonce = %v", err)
+	}
+
+	// A full cache rejects new nonces instead of forgetting valid ones
+	for i := 0; len(nonces) < NONCE_CACHE_SIZE; i++ {
+		nonces["fill-"+strconv.Itoa(i)] = now.Add(time.Minute)
+	}
+	if err := useLocalNonce("n-3", now.Add(time.Minute)); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("useLocalNonce() with full cache = %v, want %v", err, ErrUnavailable)
+	}
+	if err := useLocalNonce("n-1", now.Add(time.Minute)); !errors.Is(err, ErrReplayedSignature) {
+		t.Fatalf("useLocalNonce() of used nonce with full cache = %v, want %v", err, ErrReplayedSignature)
+	}
+
+	// Expired nonces make room
+	nonces["fill-0"] = now.Add(-time.Second)
+	if err := useLocalNonce("n-3", now.Add(time.Minute)); err != nil {
+		t.Errorf("useLocalNonce() after expiry = %v", err)
+	}
+}
@@ -3,15 +3,17 @@ package auth
 import (
 	"net/http"
 
+	"github.com/secnex/secnex-api-gateway/middleware"
 	apitypes "github.com/secnex/secnex-api-gateway/types"
 )
 
 func CheckAuthentication(w http.ResponseWriter, r *http.Request) bool {
 	if r.Header.Get("Authorization") == "" {
 		result := apitypes.ResultError{
-			Code:    http.StatusUnauthorized,
-			Message: "Unauthorized",
-			Error:   "Authorization header not present",
+			Code:      http.StatusUnauthorized,
+			Message:   "Unauthorized",
+			Error:     "Authorization header not present",
+			RequestID: middleware.GetRequestInfo(r).RequestID,
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/metrics"
+)
+
+const DEFAULT_INTROSPECTION_CACHE_TTL = 5 * time.Minute
+const DEFAULT_INTROSPECTION_NEGATIVE_TTL = 30 * time.Second
+const DEFAULT_INTROSPECTION_TIMEOUT = 5 * time.Second
+const DEFAULT_INTROSPECTION_CACHE_SIZE = 10000
+const DEFAULT_BREAKER_THRESHOLD = 5
+const DEFAULT_BREAKER_COOLDOWN = 30 * time.Second
+
+// Maximum size of an introspection response
+const MAX_INTROSPECTION_SIZE = 1 << 20
+
+var ErrTokenInactive = errors.New("token inactive")
+var ErrInsufficientScope = errors.New("insufficient scope")
+var ErrIntrospectionUnavailable = errors.New("token introspection unavailable")
+
+var IntrospectionRequests = metrics.NewCounter("gateway_introspection_requests_total", "Token introspections by result.", "result")
+
+// IntrospectionConfig is the authorization server of a firewall
+type IntrospectionConfig struct {
+	Endpoint     string
+	ClientID     string
+	ClientSecret string
+	Timeout      time.Duration
+	CacheTTL     time.Duration
+	NegativeTTL  time.Duration
+	// Consecutive failures until the circuit opens and the time until the
+	// next trial
+	FailureThreshold int
+	Cooldown         time.Duration
+}
+
+// Introspection is the response of the authorization server (RFC 7662)
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope"`
+	ClientID  string `json:"client_id"`
+	Username  string `json:"username"`
+	Subject   string `json:"sub"`
+	TokenType string `json:"token_type"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type introspectionEntry struct {
+	result    Introspection
+	expiresAt time.Time
+}
+
+// Introspector validates opaque tokens at the introspection endpoint of an
+// authorization server. Active tokens are cached until they expire, at most
+// for the CacheTTL, inactive tokens for the NegativeTTL. A circuit breaker
+// stops calls while the server fails, tokens which are not cached are then
+// rejected as unavailable.
+type Introspector struct {
+	Config     IntrospectionConfig
+	Client     *http.Client
+	Breaker    *Breaker
+	MaxEntries int
+	cache      map[string]introspectionEntry
+	mu         sync.Mutex
+}
+
+// Introspectors are shared by the routes of a firewall and keep their cache
+// across route refreshes
+var introspectors = map[string]*Introspector{}
+var introspectorsMu sync.Mutex
+
+func NewIntrospector(config IntrospectionConfig) *Introspector {
+	config = config.withDefaults()
+	return &Introspector{
+		Config:     config,
+		Client:     &http.Client{Timeout: config.Timeout},
+		Breaker:    NewBreaker(config.FailureThreshold, config.Cooldown),
+		MaxEntries: DEFAULT_INTROSPECTION_CACHE_SIZE,
+		cache:      map[string]introspectionEntry{},
+	}
+}
+
+func (c IntrospectionConfig) withDefaults() IntrospectionConfig {
+	if c.Timeout <= 0 {
+		c.Timeout = DEFAULT_INTROSPECTION_TIMEOUT
+	}
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = DEFAULT_INTROSPECTION_CACHE_TTL
+	}
+	if c.NegativeTTL <= 0 {
+		c.NegativeTTL = DEFAULT_INTROSPECTION_NEGATIVE_TTL
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = DEFAULT_BREAKER_THRESHOLD
+	}
+	if c.Cooldown <= 0 {
+		c.Cooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+	return c
+}
+
+// SharedIntrospector returns the introspector of the firewall. It is
+// replaced if the configuration changed.
+func SharedIntrospector(firewallId string, config IntrospectionConfig) *Introspector {
+	config = config.withDefaults()
+	introspectorsMu.Lock()
+	defer introspectorsMu.Unlock()
+	if introspector, ok := introspectors[firewallId]; ok && introspector.Config == config {
+		return introspector
+	}
+	introspector := NewIntrospector(config)
+	introspectors[firewallId] = introspector
+	return introspector
+}
+
+// Introspect returns the state of the token. The error is
+// ErrIntrospectionUnavailable if the authorization server cannot be reached.
+func (i *Introspector) Introspect(token string) (Introspection, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if result, ok := i.cached(key); ok {
+		IntrospectionRequests.Inc("cached")
+		return result, nil
+	}
+
+	if err := i.Breaker.Allow(); err != nil {
+		IntrospectionRequests.Inc("circuit_open")
+		return Introspection{}, fmt.Errorf("%w: %s", ErrIntrospectionUnavailable, err)
+	}
+	result, err := i.request(token)
+	i.Breaker.Done(err)
+	if err != nil {
+		IntrospectionRequests.Inc("error")
+		return Introspection{}, fmt.Errorf("%w: %s", ErrIntrospectionUnavailable, err)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(i.Config.NegativeTTL)
+	if result.Active {
+		expiresAt = now.Add(i.Config.CacheTTL)
+		if result.ExpiresAt > 0 {
+			tokenExpiresAt := time.Unix(result.ExpiresAt, 0)
+			if !tokenExpiresAt.After(now) {
+				result.Active = false
+			} else if tokenExpiresAt.Before(expiresAt) {
+				expiresAt = tokenExpiresAt
+			}
+		}
+	}
+	if result.Active {
+		IntrospectionRequests.Inc("active")
+	} else {
+		IntrospectionRequests.Inc("inactive")
+	}
+	i.store(key, introspectionEntry{result: result, expiresAt: expiresAt})
+	return result, nil
+}
+
+// Authenticate introspects the token and checks that it is active and has
+// all scopes
+func (i *Introspector) Authenticate(token string, scopes []string) (Introspection, error) {
+	result, err := i.Introspect(token)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if !result.Active {
+		return Introspection{}, ErrTokenInactive
+	}
+	granted := strings.Fields(result.Scope)
+	for _, scope := range scopes {
+		if !containsString(granted, scope) {
+			return Introspection{}, fmt.Errorf("%w: %s required", ErrInsufficientScope, scope)
+		}
+	}
+	return result, nil
+}
+
+// Principal returns the subject of the token, the username or the client
+func (r Introspection) Principal() string {
+	for _, principal := range []string{r.Subject, r.Username, r.ClientID} {
+		if principal != "" {
+			return principal
+		}
+	}
+	return "unknown"
+}
+
+func (i *Introspector) request(token string) (Introspection, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	request, err := http.NewRequest(http.MethodPost, i.Config.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Introspection{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if i.Config.ClientID != "" {
+		request.SetBasicAuth(url.QueryEscape(i.Config.ClientID), url.QueryEscape(i.Config.ClientSecret))
+	}
+
+	response, err := i.Client.Do(request)
+	if err != nil {
+		return Introspection{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return Introspection{}, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	result := Introspection{}
+	data, err := io.ReadAll(io.LimitReader(response.Body, MAX_INTROSPECTION_SIZE))
+	if err != nil {
+		return Introspection{}, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return Introspection{}, err
+	}
+	return result, nil
+}
+
+func (i *Introspector) cached(key string) (Introspection, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	entry, ok := i.cache[key]
+	if !ok {
+		return Introspection{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(i.cache, key)
+		return Introspection{}, false
+	}
+	return entry.result, true
+}
+
+func (i *Introspector) store(key string, entry introspectionEntry) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.cache) >= i.MaxEntries {
+		now := time.Now()
+		for k, e := range i.cache {
+			if now.After(e.expiresAt) {
+				delete(i.cache, k)
+			}
+		}
+		// Without room the token is introspected again next time
+		if len(i.cache) >= i.MaxEntries {
+			return
+		}
+	}
+	i.cache[key] = entry
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/jwt"
+	"github.com/secnex/secnex-api-gateway/middleware"
+)
+
+// Successful password verifications are cached, argon2id is too expensive
+// to run on every request
+const VERIFICATION_CACHE_TTL = 5 * time.Minute
+const VERIFICATION_CACHE_SIZE = 10000
+
+// Failed verifications are cached shortly, so repeated wrong credentials do
+// not run argon2id again
+const FAILURE_CACHE_TTL = time.Minute
+
+// Each verification uses 64 MB, at most this many run at once. Requests wait
+// up to VERIFICATION_WAIT for a slot.
+const MAX_CONCURRENT_VERIFICATIONS = 4
+const VERIFICATION_WAIT = 2 * time.Second
+
+var verified = map[[sha256.Size]byte]time.Time{}
+var failed = map[[sha256.Size]byte]time.Time{}
+var verifiedMu sync.Mutex
+var verifications = make(chan struct{}, MAX_CONCURRENT_VERIFICATIONS)
+
+// verifyPassword checks the password against the argon2id hash. The cache
+// key includes the hash, so changed passwords are verified again. An error
+// is returned if no verification slot became free in time.
+func verifyPassword(encodedHash string, password string) (bool, error) {
+	key := sha256.Sum256([]byte(encodedHash + "\x00" + password))
+	now := time.Now()
+	verifiedMu.Lock()
+	verifiedAt, ok := verified[key]
+	failedAt, failedOk := failed[key]
+	verifiedMu.Unlock()
+	if ok && now.Sub(verifiedAt) < VERIFICATION_CACHE_TTL {
+		return true, nil
+	}
+	if failedOk && now.Sub(failedAt) < FAILURE_CACHE_TTL {
+		return false, nil
+	}
+
+	timer := time.NewTimer(VERIFICATION_WAIT)
+	select {
+	case verifications <- struct{}{}:
+		timer.Stop()
+	case <-timer.C:
+		return false, fmt.Errorf("%w: too many password verifications", ErrUnavailable)
+	}
+	match, err := compareHashAndPassword(encodedHash, password)
+	<-verifications
+	match = err == nil && match
+
+	verifiedMu.Lock()
+	defer verifiedMu.Unlock()
+	if match {
+		remember(verified, key, now, VERIFICATION_CACHE_TTL)
+	} else {
+		remember(failed, key, now, FAILURE_CACHE_TTL)
+	}
+	return match, nil
+}
+
+// remember adds the key to the cache, expired keys are removed if it is full
+func remember(cache map[[sha256.Size]byte]time.Time, key [sha256.Size]byte, now time.Time, ttl time.Duration) {
+	if len(cache) >= VERIFICATION_CACHE_SIZE {
+		for k, at := range cache {
+			if now.Sub(at) >= ttl {
+				delete(cache, k)
+			}
+		}
+	}
+	if len(cache) < VERIFICATION_CACHE_SIZE {
+		cache[key] = now
+	}
+}
+
+// APIKeyAuthenticator checks gateway API keys, Bearer tokens of the form
+// base64(id:secret). Lookup returns the argon2id hash of the key. If Allowed
+// is set, only these key ids are accepted.
+type APIKeyAuthenticator struct {
+	Lookup  func(id string) (hash string, ok bool, err error)
+	Allowed map[string]bool
+}
+
+func (a *APIKeyAuthenticator) Method() string {
+	return METHOD_API_KEY
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*middleware.Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	id, secret, err := Base64ToIDAndToken(token)
+	if err != nil {
+		// Not an API key, e.g. a JWT for another authenticator
+		return nil, ErrNoCredentials
+	}
+
+	hash, ok, err := a.Lookup(id.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	match, err := verifyPassword(hash, secret)
+	if err != nil {
+		return nil, err
+	}
+	if !match {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	if len(a.Allowed) > 0 && !a.Allowed[id.String()] {
+		return nil, fmt.Errorf("API key %w", ErrForbidden)
+	}
+	return NewPrincipal(id.String(), METHOD_API_KEY), nil
+}
+
+func (a *APIKeyAuthenticator) Challenge(err error) string {
+	return `Bearer realm="gateway"`
+}
+
+// BasicAuthenticator checks HTTP Basic credentials against argon2id hashes
+// of the passwords by user name
+type BasicAuthenticator struct {
+	Realm string
+	Users map[string]string
+}
+
+func (a *BasicAuthenticator) Method() string {
+	return METHOD_BASIC
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*middleware.Principal, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	hash, ok := a.Users[username]
+	if !ok {
+		return nil, fmt.Errorf("invalid user name or password")
+	}
+	match, err := verifyPassword(hash, password)
+	if err != nil {
+		return nil, err
+	}
+	if !match {
+		return nil, fmt.Errorf("invalid user name or password")
+	}
+	return NewPrincipal(username, METHOD_BASIC), nil
+}
+
+func (a *BasicAuthenticator) Challenge(err error) string {
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.Realm)
+}
+
+// JWTAuthenticator checks JWT Bearer tokens
+type JWTAuthenticator struct {
+	Validator *jwt.Validator
+}
+
+func (a *JWTAuthenticator) Method() string {
+	return METHOD_JWT
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*middleware.Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	t, err := a.Validator.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+	return NewPrincipal(a.Validator.Principal(t), METHOD_JWT), nil
+}
+
+func (a *JWTAuthenticator) Challenge(err error) string {
+	if errors.Is(err, ErrNoCredentials) {
+		return `Bearer realm="gateway"`
+	}
+	return `Bearer error="invalid_token"`
+}
+
+// IntrospectionAuthenticator checks opaque Bearer tokens at the
+// authorization server and requires the scopes
+type IntrospectionAuthenticator struct {
+	Introspector *Introspector
+	Scopes       []string
+}
+
+func (a *IntrospectionAuthenticator) Method() string {
+	return METHOD_INTROSPECTION
+}
+
+func (a *IntrospectionAuthenticator) Authenticate(r *http.Request) (*middleware.Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	result, err := a.Introspector.Authenticate(token, a.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	return NewPrincipal(result.Principal(), METHOD_INTROSPECTION), nil
+}
+
+func (a *IntrospectionAuthenticator) Challenge(err error) string {
+	switch Status(err) {
+	case http.StatusForbidden:
+		return fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(a.Scopes, " "))
+	case http.StatusServiceUnavailable:
+		return ""
+	default:
+		return `Bearer error="invalid_token"`
+	}
+}
+
+// NoneAuthenticator accepts every request as anonymous. In a chain of
+// MODE_ANY it makes the other methods optional.
+type NoneAuthenticator struct{}
+
+func (a *NoneAuthenticator) Method() string {
+	return METHOD_NONE
+}
+
+func (a *NoneAuthenticator) Authenticate(r *http.Request) (*middleware.Principal, error) {
+	return NewPrincipal("anonymous", METHOD_NONE), nil
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Cheap argon2id parameters, the tests verify many passwords
+var testHashConfig = NewHashConfig(1024, 1, 1, 16, 32)
+
+func testHash(t *testing.T, password string) string {
+	t.Helper()
+	_, encodedHash, err := NewHash(testHashConfig).HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodedHash
+}
+
+// resetVerificationCaches clears the caches of other tests
+func resetVerificationCaches(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		verifiedMu.Lock()
+		defer verifiedMu.Unlock()
+		verified = map[[sha256.Size]byte]time.Time{}
+		failed = map[[sha256.Size]byte]time.Time{}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func cacheKey(encodedHash string, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(encodedHash + "\x00" + password))
+}
+
+// occupyVerifications takes all verification slots until the test ends.
+// Verifications which are not answered by the caches fail then.
+func occupyVerifications(t *testing.T) {
+	t.Helper()
+	for i := 0; i < MAX_CONCURRENT_VERIFICATIONS; i++ {
+		verifications <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for i := 0; i < MAX_CONCURRENT_VERIFICATIONS; i++ {
+			<-verifications
+		}
+	})
+}
+
+func TestCachedFailureDoesNotHideCorrectSecret(t *testing.T) {
+	resetVerificationCaches(t)
+	id := uuid.New()
+	hash := testHash(t, "correct")
+	authenticator := &APIKeyAuthenticator{
+		Lookup: func(string) (string, bool, error) { return hash, true, nil },
+	}
+	authenticate := func(secret string) error {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+StringToBase64(id.String()+":"+secret))
+		_, err := authenticator.Authenticate(r)
+		return err
+	}
+
+	if err := authenticate("wrong"); err == nil {
+		t.Fatal("wrong secret accepted")
+	}
+	if err := authenticate("correct"); err != nil {
+		t.Fatalf("correct secret after a failure of the same key = %v", err)
+	}
+	if err := authenticate("wrong"); err == nil {
+		t.Fatal("wrong secret accepted after the correct one")
+	}
+}
+
+func TestVerifyPasswordCaches(t *testing.T) {
+	resetVerificationCaches(t)
+	hash := testHash(t, "correct")
+
+	if match, err := verifyPassword(hash, "correct"); err != nil || !match {
+		t.Fatalf("verifyPassword(correct) = %v, %v", match, err)
+	}
+	if match, err := verifyPassword(hash, "wrong"); err != nil || match {
+		t.Fatalf("verifyPassword(wrong) = %v, %v", match, err)
+	}
+
+	// Without free slots only cached results are answered
+	occupyVerifications(t)
+	if match, err := verifyPassword(hash, "correct"); err != nil || !match {
+		t.Errorf("cached verifyPassword(correct) = %v, %v", match, err)
+	}
+	if match, err := verifyPassword(hash, "wrong"); err != nil || match {
+		t.Errorf("cached verifyPassword(wrong) = %v, %v", match, err)
+	}
+
+	// A new hash of the same password is verified again
+	if _, err := verifyPassword(testHash(t, "correct"), "correct"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("verifyPassword() of a changed hash = %v, want %v", err, ErrUnavailable)
+	}
+}
+
+func TestVerifyPasswordCacheExpiry(t *testing.T) {
+	resetVerificationCaches(t)
+	hash := testHash(t, "correct")
+	now := time.Now()
+
+	// An expired success is verified again and remembered anew
+	key := cacheKey(hash, "correct")
+	verified[key] = now.Add(-VERIFICATION_CACHE_TTL - time.Second)
+	if match, err := verifyPassword(hash, "correct"); err != nil || !match {
+		t.Fatalf("verifyPassword() with expired success = %v, %v", match, err)
+	}
+	if !verified[key].After(now) {
+		t.Error("verified password is not cached again")
+	}
+
+	// A failure expires after FAILURE_CACHE_TTL, e.g. after a password was
+	// set with a hash which was used before
+	key = cacheKey(hash, "other")
+	failed[key] = now.Add(-FAILURE_CACHE_TTL - time.Second)
+	occupyVerifications(t)
+	if _, err := verifyPassword(hash, "other"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("verifyPassword() with expired failure = %v, want a new verification", err)
+	}
+}
+
+func TestVerifyPasswordConcurrencyBound(t *testing.T) {
+	resetVerificationCaches(t)
+	hash := testHash(t, "correct")
+	occupyVerifications(t)
+
+	start := time.Now()
+	_, err := verifyPassword(hash, "correct")
+	if !errors.Is(err, ErrUnavailable) || Status(err) != http.StatusServiceUnavailable {
+		t.Fatalf("verifyPassword() without free slot = %v, want %v", err, ErrUnavailable)
+	}
+	if waited := time.Since(start); waited < VERIFICATION_WAIT {
+		t.Errorf("verifyPassword() gave up after %s, want %s", waited, VERIFICATION_WAIT)
+	}
+
+	// The failed wait is not cached as wrong password
+	verifiedMu.Lock()
+	_, cached := failed[cacheKey(hash, "correct")]
+	verifiedMu.Unlock()
+	if cached {
+		t.Error("unavailable verification is cached as failure")
+	}
+}
+
+func TestRememberBound(t *testing.T) {
+	now := time.Now()
+	cache := map[[sha256.Size]byte]time.Time{}
+	for i := 0; i < VERIFICATION_CACHE_SIZE; i++ {
+		cache[sha256.Sum256([]byte{byte(i), byte(i >> 8)})] = now
+	}
+
+	// A full cache of valid entries keeps its entries
+	key := sha256.Sum256([]byte("new"))
+	remember(cache, key, now, time.Minute)
+	if _, ok := cache[key]; ok || len(cache) != VERIFICATION_CACHE_SIZE {
+		t.Fatalf("full cache has %d entries with the new key %v", len(cache), ok)
+	}
+
+	// Expired entries make room
+	expired := 0
+	for k := range cache {
+		if expired == 10 {
+			break
+		}
+		cache[k] = now.Add(-2 * time.Minute)
+		expired++
+	}
+	remember(cache, key, now, time.Minute)
+	if _, ok := cache[key]; !ok || len(cache) != VERIFICATION_CACHE_SIZE-expired+1 {
+		t.Errorf("cache has %d entries with the new key %v, want %d", len(cache), ok, VERIFICATION_CACHE_SIZE-expired+1)
+	}
+}
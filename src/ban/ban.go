@@ -0,0 +1,247 @@
+package ban
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/audit"
+	"github.com/secnex/secnex-api-gateway/db"
+)
+
+type Signal string
+
+const SIGNAL_AUTH_FAILURE Signal = "auth"
+const SIGNAL_WAF Signal = "waf"
+const SIGNAL_NOT_FOUND Signal = "notfound"
+
+const DEFAULT_DURATION = 15 * time.Minute
+
+// Policy bans a client after Threshold signals within Window
+type Policy struct {
+	Threshold int
+	Window    time.Duration
+}
+
+// Manager tracks failure signals per client and bans offenders. Bans are
+// stored in the dynamic_bans table and shared by all gateway instances.
+type Manager struct {
+	Database *db.Connection
+	Duration time.Duration
+	Policies map[Signal]Policy
+	Audit    *audit.Logger
+	windows  map[string][]time.Time
+	bans     map[string]time.Time
+	mu       sync.Mutex
+}
+
+func DefaultPolicies() map[Signal]Policy {
+	return map[Signal]Policy{
+		SIGNAL_AUTH_FAILURE: {Threshold: 10, Window: 5 * time.Minute},
+		SIGNAL_WAF:          {Threshold: 5, Window: 5 * time.Minute},
+		SIGNAL_NOT_FOUND:    {Threshold: 30, Window: time.Minute},
+	}
+}
+
+func NewManager(database *db.Connection, duration time.Duration, policies map[Signal]Policy) *Manager {
+	return &Manager{
+		Database: database,
+		Duration: duration,
+		Policies: policies,
+		windows:  map[string][]time.Time{},
+		bans:     map[string]time.Time{},
+	}
+}
+
+// NewManagerEnv creates a manager from the BAN_* environment variables.
+// Clients are identified by their address, so bans are only enabled on
+// request, e.g. not behind a load balancer without the client address.
+//
+//	BAN_ENABLED=true             enables automatic bans
+//	BAN_DURATION=15m             duration of a ban
+//	BAN_POLICIES=auth=10/5m,...  threshold and window per signal
+func NewManagerEnv(database *db.Connection) (*Manager, error) {
+	if enabled, err := strconv.ParseBool(os.Getenv("BAN_ENABLED")); err != nil || !enabled {
+		return nil, nil
+	}
+
+	duration := DEFAULT_DURATION
+	if value := os.Getenv("BAN_DURATION"); value != "" {
+		var err error
+		duration, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BAN_DURATION: %w", err)
+		}
+	}
+
+	policies := DefaultPolicies()
+	if value := os.Getenv("BAN_POLICIES"); value != "" {
+		for _, item := range strings.Split(value, ",") {
+			signal, policy, err := parsePolicy(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid BAN_POLICIES: %w", err)
+			}
+			policies[signal] = policy
+		}
+	}
+
+	return NewManager(database, duration, policies), nil
+}
+
+// parsePolicy parses a policy in the form signal=threshold/window
+func parsePolicy(item string) (Signal, Policy, error) {
+	signal, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+	if !ok {
+		return "", Policy{}, fmt.Errorf("missing = in %q", item)
+	}
+	threshold, window, ok := strings.Cut(value, "/")
+	if !ok {
+		return "", Policy{}, fmt.Errorf("missing / in %q", item)
+	}
+
+	policy := Policy{}
+	var err error
+	policy.Threshold, err = strconv.Atoi(threshold)
+	if err != nil {
+		return "", Policy{}, err
+	}
+	policy.Window, err = time.ParseDuration(window)
+	if err != nil {
+		return "", Policy{}, err
+	}
+	return Signal(signal), policy, nil
+}
+
+// Banned returns true if the client is currently banned
+func (m *Manager) Banned(clientIP string) bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expiresAt, ok := m.bans[clientIP]
+	return ok && time.Now().Before(expiresAt)
+}
+
+// Record counts a failure signal of the client and bans the client once the
+// threshold of the signal is reached within its window
+func (m *Manager) Record(clientIP string, signal Signal) {
+	if m == nil || clientIP == "" {
+		return
+	}
+	policy, ok := m.Policies[signal]
+	if !ok || policy.Threshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+	key := string(signal) + "|" + clientIP
+
+	m.mu.Lock()
+	if expiresAt, banned := m.bans[clientIP]; banned && now.Before(expiresAt) {
+		m.mu.Unlock()
+		return
+	}
+	window := m.windows[key]
+	start := 0
+	for start < len(window) && now.Sub(window[start]) > policy.Window {
+		start++
+	}
+	window = append(window[start:], now)
+	exceeded := len(window) >= policy.Threshold
+	if exceeded {
+		delete(m.windows, key)
+	} else {
+		m.windows[key] = window
+	}
+	m.mu.Unlock()
+
+	if exceeded {
+		reason := fmt.Sprintf("%d %s signals within %s", len(window), signal, policy.Window)
+		if err := m.Ban(clientIP, reason); err != nil {
+			log.Printf("Error banning %s: %s\n", clientIP, err)
+		}
+	}
+}
+
+// Ban bans the client for the configured duration
+func (m *Manager) Ban(clientIP string, reason string) error {
+	expiresAt := time.Now().Add(m.Duration)
+
+	m.mu.Lock()
+	m.bans[clientIP] = expiresAt
+	m.mu.Unlock()
+
+	log.Printf("Banned %s until %s: %s\n", clientIP, expiresAt.Format(time.RFC3339), reason)
+	m.Audit.Record(audit.Event{
+		Type:    audit.EVENT_BAN_CREATED,
+		Target:  clientIP,
+		Details: map[string]interface{}{"reason": reason, "expires_at": expiresAt},
+	})
+	if m.Database == nil {
+		return nil
+	}
+	return m.Database.CreateBan(clientIP, reason, expiresAt)
+}
+
+// Lift removes the ban of the client
+func (m *Manager) Lift(clientIP string) error {
+	m.mu.Lock()
+	delete(m.bans, clientIP)
+	m.mu.Unlock()
+
+	log.Printf("Lifted ban of %s\n", clientIP)
+	if m.Database == nil {
+		return nil
+	}
+	return m.Database.LiftBan(clientIP)
+}
+
+// List returns the active bans of all gateway instances
+func (m *Manager) List() ([]db.Ban, error) {
+	return m.Database.GetActiveBans()
+}
+
+// Sync replaces the local bans with the active bans from the database
+func (m *Manager) Sync() error {
+	bans, err := m.Database.GetActiveBans()
+	if err != nil {
+		return err
+	}
+
+	active := map[string]time.Time{}
+	for _, ban := range bans {
+		if ban.ExpiresAt.After(active[ban.IP]) {
+			active[ban.IP] = ban.ExpiresAt
+		}
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	m.bans = active
+	for key, window := range m.windows {
+		if len(window) == 0 || now.Sub(window[len(window)-1]) > time.Hour {
+			delete(m.windows, key)
+		}
+	}
+	m.mu.Unlock()
+
+	return nil
+}
+
+// StartSync synchronizes the bans with the database in the given interval
+func (m *Manager) StartSync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := m.Sync(); err != nil {
+			log.Printf("Error synchronizing bans: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/secrets"
+	"golang.org/x/crypto/acme"
+)
+
+const CHALLENGE_HTTP_01 = "http-01"
+const CHALLENGE_TLS_ALPN_01 = "tls-alpn-01"
+
+const DEFAULT_RENEW_BEFORE = 30 * 24 * time.Hour
+
+// Time an instance may spend on issuing a certificate
+const ISSUE_TIMEOUT = 5 * time.Minute
+
+const HTTP_CHALLENGE_PREFIX = "/.well-known/acme-challenge/"
+
+// ACMEManager issues and renews certificates via ACME (RFC 8555). Account,
+// certificates and pending challenges are stored in the database, so any
+// gateway instance can answer the challenges and all instances share the
+// certificates. Renewals are serialized by an advisory lock per domain.
+type ACMEManager struct {
+	Database     *db.Connection
+	Store        *Store
+	ServerID     string
+	DirectoryURL string
+	Email        string
+	Challenge    string
+	RenewBefore  time.Duration
+	Client       *acme.Client
+}
+
+// NewACMEManagerEnv creates a manager from the ACME_* environment variables.
+// The result is nil if ACME is not enabled.
+//
+//	ACME_ENABLED=true                  enables ACME
+//	ACME_DIRECTORY_URL=https://...     directory, default Let's Encrypt
+//	ACME_EMAIL=ops@example.com         contact of the account
+//	ACME_CHALLENGE=http-01             http-01 or tls-alpn-01
+//	ACME_RENEW_BEFORE=720h             renewal ahead of expiry
+//	ACME_CA_FILE=pebble.minica.pem     CA bundle to trust the directory
+func NewACMEManagerEnv(database *db.Connection, store *Store, serverId string) (*ACMEManager, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("ACME_ENABLED")); !enabled {
+		return nil, nil
+	}
+	// Account keys and issued certificates are stored encrypted
+	if database.Secrets == nil {
+		return nil, fmt.Errorf("ACME requires a master key: %w", secrets.ErrNoMasterKey)
+	}
+
+	m := &ACMEManager{
+		Database:     database,
+		Store:        store,
+		ServerID:     serverId,
+		DirectoryURL: os.Getenv("ACME_DIRECTORY_URL"),
+		Email:        os.Getenv("ACME_EMAIL"),
+		Challenge:    strings.ToLower(os.Getenv("ACME_CHALLENGE")),
+		RenewBefore:  DEFAULT_RENEW_BEFORE,
+	}
+	if m.DirectoryURL == "" {
+		m.DirectoryURL = acme.LetsEncryptURL
+	}
+	if m.Challenge == "" {
+		m.Challenge = CHALLENGE_HTTP_01
+	}
+	if m.Challenge != CHALLENGE_HTTP_01 && m.Challenge != CHALLENGE_TLS_ALPN_01 {
+		return nil, fmt.Errorf("unknown ACME_CHALLENGE %q", m.Challenge)
+	}
+	if value := os.Getenv("ACME_RENEW_BEFORE"); value != "" {
+		renewBefore, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACME_RENEW_BEFORE: %w", err)
+		}
+		m.RenewBefore = renewBefore
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if caFile := os.Getenv("ACME_CA_FILE"); caFile != "" {
+		bundle, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates in ACME_CA_FILE %s", caFile)
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	m.Client = &acme.Client{Key: key, DirectoryURL: m.DirectoryURL, HTTPClient: httpClient}
+
+	return m, nil
+}
+
+// accountKey loads the shared account key or stores a new one
+func (m *ACMEManager) accountKey() (crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := m.Database.GetACMEAccount(m.DirectoryURL, m.Email, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(account.PrivateKey)
+}
+
+// register creates the account at the directory. Existing accounts of the
+// key are reused.
+func (m *ACMEManager) register(ctx context.Context) error {
+	account := &acme.Account{}
+	if m.Email != "" {
+		account.Contact = []string{"mailto:" + m.Email}
+	}
+	_, err := m.Client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+// StartRenewer checks the certificates of all domains in the given interval.
+// The first check runs immediately.
+func (m *ACMEManager) StartRenewer(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.RenewAll()
+		<-ticker.C
+	}
+}
+
+// RenewAll issues missing certificates and renews expiring ones
+func (m *ACMEManager) RenewAll() {
+	domains, err := m.Database.GetACMEDomains(m.ServerID)
+	if err != nil {
+		log.Printf("Error loading ACME domains: %s\n", err)
+		return
+	}
+
+	renewed := false
+	for _, domain := range domains {
+		issued, err := m.Renew(domain)
+		if err != nil {
+			log.Printf("Error renewing certificate for %s: %s\n", domain, err)
+			continue
+		}
+		renewed = renewed || issued
+	}
+
+	if renewed && m.Store != nil {
+		if _, err := m.Store.Reload(); err != nil {
+			log.Printf("Error reloading certificates: %s\n", err)
+		}
+	}
+}
+
+// Renew issues a certificate for the domain if there is none or it expires
+// within RenewBefore. Only one instance issues at a time, the others skip
+// the domain and pick up the certificate on their next reload.
+func (m *ACMEManager) Renew(domain string) (bool, error) {
+	if renew, err := m.needsRenewal(domain); err != nil || !renew {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ISSUE_TIMEOUT)
+	defer cancel()
+
+	unlock, locked, err := m.Database.TryLock(ctx, "acme:"+domain)
+	if err != nil || !locked {
+		return false, err
+	}
+	defer unlock()
+
+	// Another instance may have renewed while we waited for the lock
+	if renew, err := m.needsRenewal(domain); err != nil || !renew {
+		return false, err
+	}
+
+	log.Printf("Requesting certificate for %s from %s\n", domain, m.DirectoryURL)
+	certPEM, keyPEM, err := m.issue(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+	if err := m.Database.SaveACMECertificate(domain, certPEM, keyPEM); err != nil {
+		return false, err
+	}
+	log.Printf("Certificate for %s issued.\n", domain)
+
+	return true, nil
+}
+
+// needsRenewal returns true if the certificate of the domain is missing,
+// invalid or expires within RenewBefore. Errors of the database are
+// returned, an outage must not make every instance issue certificates.
+func (m *ACMEManager) needsRenewal(domain string) (bool, error) {
+	row, ok, err := m.Database.GetACMECertificate(domain)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return true, nil
+	}
+	certificate, err := loadPEM(row.Certificate.String, row.PrivateKey.String)
+	if err != nil {
+		log.Printf("Stored certificate for %s is invalid: %s\n", domain, err)
+		return true, nil
+	}
+	return time.Until(certificate.Leaf.NotAfter) < m.RenewBefore, nil
+}
+
+// issue runs an order for the domain and returns the certificate chain and
+// the private key as PEM
+func (m *ACMEManager) issue(ctx context.Context, domain string) (string, string, error) {
+	if err := m.register(ctx); err != nil {
+		return "", "", fmt.Errorf("register account: %w", err)
+	}
+
+	order, err := m.Client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return "", "", fmt.Errorf("create order: %w", err)
+	}
+
+	for _, url := range order.AuthzURLs {
+		authorization, err := m.Client.GetAuthorization(ctx, url)
+		if err != nil {
+			return "", "", err
+		}
+		if authorization.Status == acme.StatusValid {
+			continue
+		}
+		if err := m.authorize(ctx, authorization); err != nil {
+			return "", "", fmt.Errorf("authorize %s: %w", domain, err)
+		}
+	}
+
+	order, err = m.Client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return "", "", fmt.Errorf("wait for order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	if err != nil {
+		return "", "", err
+	}
+	chain, _, err := m.Client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return "", "", fmt.Errorf("finalize order: %w", err)
+	}
+
+	certPEM := ""
+	for _, der := range chain {
+		certPEM += string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// authorize publishes the configured challenge and waits for its validation
+func (m *ACMEManager) authorize(ctx context.Context, authorization *acme.Authorization) error {
+	var challenge *acme.Challenge
+	for _, c := range authorization.Challenges {
+		if c.Type == m.Challenge {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("challenge %s not offered", m.Challenge)
+	}
+
+	domain := authorization.Identifier.Value
+	err := m.Database.CreateACMEChallenge(challenge.Token, domain, challenge.Type, time.Now().Add(ISSUE_TIMEOUT))
+	if err != nil {
+		return err
+	}
+	defer m.Database.DeleteACMEChallenge(challenge.Token)
+
+	if _, err := m.Client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = m.Client.WaitAuthorization(ctx, authorization.URI)
+	return err
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes all other requests to
+// next
+func (m *ACMEManager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, HTTP_CHALLENGE_PREFIX) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.URL.Path, HTTP_CHALLENGE_PREFIX)
+		_, ok, err := m.Database.GetACMEChallenge(token, "", CHALLENGE_HTTP_01)
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		response, err := m.Client.HTTP01ChallengeResponse(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(response))
+	})
+}
+
+// GetCertificate answers TLS-ALPN-01 challenges and selects the certificate
+// from the store for all other handshakes
+func (m *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acme.ALPNProto {
+		return m.Store.GetCertificate(hello)
+	}
+
+	challenge, ok, err := m.Database.GetACMEChallenge("", strings.ToLower(hello.ServerName), CHALLENGE_TLS_ALPN_01)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("no pending challenge for %q", hello.ServerName)
+	}
+	certificate, err := m.Client.TLSALPN01ChallengeCert(challenge.Token, challenge.Domain)
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// ConfigureTLS enables TLS-ALPN-01 challenges on the TLS configuration
+func (m *ACMEManager) ConfigureTLS(config *tls.Config) {
+	config.GetCertificate = m.GetCertificate
+	config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+}
+
+func encodeKey(key *ecdsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})), nil
+}
+
+func decodeKey(keyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("invalid account key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
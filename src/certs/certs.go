@@ -0,0 +1,250 @@
+package certs
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/db"
+)
+
+// Store holds the certificates of a server and selects them by the server
+// name of the TLS handshake. Certificates are loaded from files and the
+// certificates table and replaced atomically on reload, established
+// connections are not affected.
+type Store struct {
+	Database *db.Connection
+	ServerID string
+	CertFile string
+	KeyFile  string
+	names    map[string]*tls.Certificate
+	fallback *tls.Certificate
+	digest   string
+	mu       sync.RWMutex
+}
+
+func NewStore(database *db.Connection, serverId string, certFile string, keyFile string) *Store {
+	return &Store{
+		Database: database,
+		ServerID: serverId,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		names:    map[string]*tls.Certificate{},
+	}
+}
+
+// Reload loads all certificates and replaces the current ones. It returns
+// true if the certificates changed.
+func (s *Store) Reload() (bool, error) {
+	var certificates []*tls.Certificate
+	var fallback *tls.Certificate
+
+	if s.CertFile != "" {
+		certificate, err := loadFile(s.CertFile, s.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		certificates = append(certificates, certificate)
+		fallback = certificate
+	}
+
+	if s.Database != nil {
+		rows, err := s.Database.GetCertificates(s.ServerID)
+		if err != nil {
+			return false, err
+		}
+		for _, row := range rows {
+			var certificate *tls.Certificate
+			if row.CertFile.Valid {
+				certificate, err = loadFile(row.CertFile.String, row.KeyFile.String)
+			} else {
+				certificate, err = loadPEM(row.Certificate.String, row.PrivateKey.String)
+			}
+			if err != nil {
+				// A broken certificate must not take down the others
+				log.Printf("Error loading certificate %s: %s\n", row.Name, err)
+				continue
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+
+	if len(certificates) == 0 {
+		return false, fmt.Errorf("no certificates configured")
+	}
+	if fallback == nil {
+		fallback = certificates[0]
+	}
+
+	names := map[string]*tls.Certificate{}
+	fingerprints := []string{}
+	for _, certificate := range certificates {
+		for _, name := range certificate.Leaf.DNSNames {
+			name = strings.ToLower(name)
+			// The certificate valid for the longest time wins
+			if current, ok := names[name]; !ok || certificate.Leaf.NotAfter.After(current.Leaf.NotAfter) {
+				names[name] = certificate
+			}
+		}
+		sum := sha256.Sum256(certificate.Leaf.Raw)
+		fingerprints = append(fingerprints, hex.EncodeToString(sum[:]))
+	}
+	sort.Strings(fingerprints)
+	digest := strings.Join(fingerprints, ",")
+
+	s.mu.Lock()
+	changed := digest != s.digest
+	s.names = names
+	s.fallback = fallback
+	s.digest = digest
+	s.mu.Unlock()
+
+	return changed, nil
+}
+
+// GetCertificate selects the certificate for the server name of the client.
+// Exact names are preferred over wildcards. Clients without SNI or with an
+// unknown name get the default certificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if certificate, ok := s.names[name]; ok {
+		return certificate, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if certificate, ok := s.names["*."+parent]; ok {
+			return certificate, nil
+		}
+	}
+	if s.fallback == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return s.fallback, nil
+}
+
+// StartReloader reloads the certificates in the given interval and on SIGHUP
+func (s *Store) StartReloader(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-hangup:
+		}
+		changed, err := s.Reload()
+		if err != nil {
+			log.Printf("Error reloading certificates: %s\n", err)
+			continue
+		}
+		if changed {
+			log.Println("Certificates reloaded.")
+		}
+	}
+}
+
+// NewTLSConfig creates the TLS configuration of the HTTPS listener. With
+// clientAuth the listener requests client certificates, which are verified
+// by the routes.
+func (s *Store) NewTLSConfig(minVersion string, cipherSuites []string, clientAuth bool) (*tls.Config, error) {
+	version, err := ParseVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := ParseCipherSuites(cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     version,
+		CipherSuites:   suites,
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if clientAuth {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config, nil
+}
+
+// ParseVersion parses TLS versions in the form 1.2
+func ParseVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToUpper(version), "TLS") {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+}
+
+// ParseCipherSuites resolves the names of cipher suites, e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only suites considered secure by Go
+// are accepted. The suites do not apply to TLS 1.3.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	available := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+
+	suites := []uint16{}
+	for _, name := range names {
+		id, ok := available[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+func loadFile(certFile string, keyFile string) (*tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return withLeaf(certificate)
+}
+
+func loadPEM(certPEM string, keyPEM string) (*tls.Certificate, error) {
+	certificate, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	return withLeaf(certificate)
+}
+
+func withLeaf(certificate tls.Certificate) (*tls.Certificate, error) {
+	if certificate.Leaf == nil {
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		certificate.Leaf = leaf
+	}
+	return &certificate, nil
+}
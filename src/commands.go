@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os/user"
+
+	"github.com/secnex/secnex-api-gateway/audit"
+	"github.com/secnex/secnex-api-gateway/auth"
+	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/secrets"
+)
+
+// runCommand runs an administrative command instead of the gateway
+func runCommand(cnx *db.Connection, args []string) error {
+	switch args[0] {
+	case "hmac-secret":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: hmac-secret <auth id>")
+		}
+		return createHMACSecret(cnx, args[1])
+	case "reencrypt-secrets":
+		return reencryptSecrets(cnx)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// createHMACSecret generates a new HMAC secret for the auth and prints it.
+// The secret is only stored encrypted and cannot be shown again.
+func createHMACSecret(cnx *db.Connection, authId string) error {
+	if cnx.Secrets == nil {
+		return secrets.ErrNoMasterKey
+	}
+	auditLog, err := audit.NewLoggerEnv(cnx)
+	if err != nil {
+		return err
+	}
+	_, ok, err := cnx.GetAuth(authId)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("auth %s not found", authId)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	secret := hex.EncodeToString(key)
+	if err := cnx.SaveHMACSecret(authId, secret); err != nil {
+		return err
+	}
+	err = auditLog.Write(audit.Event{
+		Type:    audit.EVENT_KEY_SECRET_CREATED,
+		Actor:   commandActor(),
+		Target:  authId,
+		Details: map[string]interface{}{"method": auth.METHOD_HMAC},
+	})
+	if err != nil {
+		return fmt.Errorf("secret created but not audited: %w", err)
+	}
+	fmt.Println(secret)
+	return nil
+}
+
+// commandActor identifies the operating system user who runs a command
+func commandActor() string {
+	current, err := user.Current()
+	if err != nil {
+		return "cli"
+	}
+	return "cli:" + current.Username
+}
+
+// reencryptSecrets encrypts all secrets with the current master key, e.g.
+// after a new master key was added. The gateways can keep running if they
+// know the old and the new master key.
+func reencryptSecrets(cnx *db.Connection) error {
+	updated, err := cnx.ReencryptSecrets()
+	if err != nil {
+		return err
+	}
+	log.Printf("Encrypted %d secrets with master key %d\n", updated, cnx.Secrets.Version())
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"strconv"
 
 	_ "github.com/lib/pq"
+	"github.com/secnex/secnex-api-gateway/secrets"
 )
 
 type DB struct {
@@ -22,6 +23,8 @@ type DB struct {
 type Connection struct {
 	DB         *DB
 	Connection *sql.DB
+	// Secrets encrypts and decrypts secrets stored in the database
+	Secrets *secrets.Keyring
 }
 
 func NewDBEnv() *Connection {
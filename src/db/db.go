@@ -1,20 +1,47 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type Server struct {
-	ID        string
-	Name      string
-	Address   string
-	Port      int
-	BasePath  string
-	CreatedAt sql.NullString
-	UpdatedAt sql.NullString
-	DeletedAt sql.NullString
+	ID              string
+	Name            string
+	Address         string
+	Port            int
+	BasePath        string
+	TLSEnabled      bool
+	TLSPort         int
+	TLSMinVersion   string
+	TLSCipherSuites []string
+	TLSCertFile     sql.NullString
+	TLSKeyFile      sql.NullString
+	TLSRedirect     bool
+	TLSClientAuth   bool
+	CreatedAt       sql.NullString
+	UpdatedAt       sql.NullString
+	DeletedAt       sql.NullString
+}
+
+type Certificate struct {
+	ID          string
+	ServerID    sql.NullString
+	Name        string
+	CertFile    sql.NullString
+	KeyFile     sql.NullString
+	Certificate sql.NullString
+	PrivateKey  sql.NullString
+	ACMEDomain  sql.NullString
+	CreatedAt   sql.NullString
+	UpdatedAt   sql.NullString
+	DeletedAt   sql.NullString
 }
 
 type Route struct {
@@ -36,14 +63,50 @@ type Firewall struct {
 	Name        string
 	AllowAll    bool
 	RequireAuth bool
+	AuthMode    string
 	CreatedAt   sql.NullString
 	UpdatedAt   sql.NullString
 	DeletedAt   sql.NullString
 }
 
+type AuthMethod struct {
+	FirewallID string
+	Method     string
+	Position   int
+	CreatedAt  sql.NullString
+	UpdatedAt  sql.NullString
+	DeletedAt  sql.NullString
+}
+
+type BasicUser struct {
+	ID           string
+	FirewallID   string
+	Username     string
+	PasswordHash string
+	CreatedAt    sql.NullString
+	UpdatedAt    sql.NullString
+	DeletedAt    sql.NullString
+}
+
+type Auth struct {
+	ID        string
+	APIKey    string
+	CreatedAt sql.NullString
+	UpdatedAt sql.NullString
+	DeletedAt sql.NullString
+}
+
+type HMACSecret struct {
+	AuthID    string
+	Secret    string
+	CreatedAt sql.NullString
+	UpdatedAt sql.NullString
+	DeletedAt sql.NullString
+}
+
 type Method struct {
 	FirewallID string
-	RouteID    string
+	RouteID    sql.NullString
 	Method     string
 	Action     string
 	CreatedAt  sql.NullString
@@ -53,7 +116,7 @@ type Method struct {
 
 type IP struct {
 	FirewallID string
-	RouteID    string
+	RouteID    sql.NullString
 	IP         string
 	Action     string
 	CreatedAt  sql.NullString
@@ -63,17 +126,275 @@ type IP struct {
 
 type UserAgent struct {
 	FirewallID string
-	RouteID    string
+	RouteID    sql.NullString
 	UserAgent  string
 	Action     string
+	MatchType  string
+	CreatedAt  sql.NullString
+	UpdatedAt  sql.NullString
+	DeletedAt  sql.NullString
+}
+
+type Country struct {
+	FirewallID string
+	RouteID    sql.NullString
+	Country    string
+	Action     string
+	CreatedAt  sql.NullString
+	UpdatedAt  sql.NullString
+	DeletedAt  sql.NullString
+}
+
+type ASN struct {
+	FirewallID string
+	RouteID    sql.NullString
+	ASN        int64
+	Action     string
+	CreatedAt  sql.NullString
+	UpdatedAt  sql.NullString
+	DeletedAt  sql.NullString
+}
+
+type Path struct {
+	ID          string
+	FirewallID  string
+	RouteID     sql.NullString
+	Pattern     string
+	MatchType   string
+	Action      string
+	Methods     []string
+	IPs         []string
+	RequireAuth sql.NullBool
+	CreatedAt   sql.NullString
+	UpdatedAt   sql.NullString
+	DeletedAt   sql.NullString
+}
+
+type WAF struct {
+	RouteID     string
+	Mode        string
+	Threshold   int
+	MaxBodySize int64
+	CreatedAt   sql.NullString
+	UpdatedAt   sql.NullString
+	DeletedAt   sql.NullString
+}
+
+type WAFRule struct {
+	ID        string
+	RouteID   string
+	Name      string
+	File      sql.NullString
+	Rules     sql.NullString
+	Position  int
+	CreatedAt sql.NullString
+	UpdatedAt sql.NullString
+	DeletedAt sql.NullString
+}
+
+type Ban struct {
+	ID        string
+	IP        string
+	Reason    string
+	ExpiresAt time.Time
+	CreatedAt sql.NullString
+	UpdatedAt sql.NullString
+	DeletedAt sql.NullString
+}
+
+type MTLS struct {
+	ID             string
+	RouteID        string
+	CAFile         sql.NullString
+	CABundle       sql.NullString
+	CRLFiles       []string
+	ForwardHeaders bool
+	CreatedAt      sql.NullString
+	UpdatedAt      sql.NullString
+	DeletedAt      sql.NullString
+}
+
+type MTLSPrincipal struct {
+	ID        string
+	RouteID   string
+	MatchType string
+	Value     string
+	Principal string
+	CreatedAt sql.NullString
+	UpdatedAt sql.NullString
+	DeletedAt sql.NullString
+}
+
+type UpstreamTLS struct {
+	ID                 string
+	RouteID            string
+	CAFile             sql.NullString
+	CABundle           sql.NullString
+	CertFile           sql.NullString
+	KeyFile            sql.NullString
+	Certificate        sql.NullString
+	PrivateKey         sql.NullString
+	ServerName         sql.NullString
+	InsecureSkipVerify bool
+	MinVersion         string
+	Pins               []string
+	CreatedAt          sql.NullString
+	UpdatedAt          sql.NullString
+	DeletedAt          sql.NullString
+}
+
+type Credential struct {
+	ID        string
+	RouteID   string
+	Type      string
+	Header    sql.NullString
+	Username  sql.NullString
+	Secret    string
+	TokenURL  sql.NullString
+	ClientID  sql.NullString
+	Scopes    []string
+	CreatedAt sql.NullString
+	UpdatedAt sql.NullString
+	DeletedAt sql.NullString
+}
+
+type HeaderRule struct {
+	ID        string
+	RouteID   string
+	Direction string
+	Action    string
+	Header    string
+	Value     sql.NullString
+	Position  int
+	CreatedAt sql.NullString
+	UpdatedAt sql.NullString
+	DeletedAt sql.NullString
+}
+
+type SecurityHeaders struct {
+	ID                    string
+	RouteID               string
+	Profile               string
+	Override              bool
+	HSTS                  sql.NullString
+	ContentSecurityPolicy sql.NullString
+	CSPReportOnly         bool
+	FrameOptions          sql.NullString
+	ContentTypeOptions    sql.NullString
+	ReferrerPolicy        sql.NullString
+	PermissionsPolicy     sql.NullString
+	CreatedAt             sql.NullString
+	UpdatedAt             sql.NullString
+	DeletedAt             sql.NullString
+}
+
+type JWT struct {
+	ID                 string
+	RouteID            string
+	Issuer             sql.NullString
+	Audiences          []string
+	Algorithms         []string
+	JWKSURL            sql.NullString
+	JWKSFile           sql.NullString
+	Secret             sql.NullString
+	JWKSRefreshSeconds int
+	ClockSkewSeconds   int
+	PrincipalClaim     string
+	CreatedAt          sql.NullString
+	UpdatedAt          sql.NullString
+	DeletedAt          sql.NullString
+}
+
+type JWTClaim struct {
+	ID        string
+	RouteID   string
+	Claim     string
+	Operator  string
+	Value     string
+	CreatedAt sql.NullString
+	UpdatedAt sql.NullString
+	DeletedAt sql.NullString
+}
+
+type OIDC struct {
+	ID                     string
+	RouteID                string
+	Issuer                 string
+	ClientID               string
+	ClientSecret           string
+	RedirectURL            sql.NullString
+	PostLogoutRedirectURL  sql.NullString
+	Scopes                 []string
+	CookieName             string
+	CookieSecret           string
+	SessionLifetimeSeconds int
+	PassAccessToken        bool
+	CreatedAt              sql.NullString
+	UpdatedAt              sql.NullString
+	DeletedAt              sql.NullString
+}
+
+type Introspection struct {
+	ID                   string
+	FirewallID           string
+	Endpoint             string
+	ClientID             sql.NullString
+	ClientSecret         sql.NullString
+	TimeoutMs            int
+	CacheSeconds         int
+	NegativeCacheSeconds int
+	FailureThreshold     int
+	CooldownSeconds      int
+	CreatedAt            sql.NullString
+	UpdatedAt            sql.NullString
+	DeletedAt            sql.NullString
+}
+
+type Scope struct {
+	FirewallID string
+	RouteID    sql.NullString
+	Scope      string
 	CreatedAt  sql.NullString
 	UpdatedAt  sql.NullString
 	DeletedAt  sql.NullString
 }
 
+type ACMEAccount struct {
+	ID           string
+	DirectoryURL string
+	Email        sql.NullString
+	PrivateKey   string
+	CreatedAt    sql.NullString
+	UpdatedAt    sql.NullString
+	DeletedAt    sql.NullString
+}
+
+type ACMEChallenge struct {
+	Token     string
+	Domain    string
+	Type      string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+type AuditEvent struct {
+	ID        string
+	Type      string
+	Actor     string
+	ActorIP   sql.NullString
+	Target    sql.NullString
+	RequestID sql.NullString
+	Before    sql.NullString
+	After     sql.NullString
+	Details   sql.NullString
+	CreatedAt time.Time
+}
+
 const ACTION_ALLOW = "ALLOW"
 const ACTION_REJECT = "BLOCK"
 
+const WAF_MODE_OFF = "OFF"
+
 func (db *DB) ConnectInit() (*Connection, error) {
 	log.Printf("Connecting to database %s...\n", "postgres")
 	cnx, err := db.ConnectDatabase("postgres")
@@ -139,7 +460,7 @@ func (c *Connection) GetFirewall(id string) (Firewall, error) {
 
 	firewall := Firewall{}
 	for rows.Next() {
-		err := rows.Scan(&firewall.ID, &firewall.Name, &firewall.AllowAll, &firewall.RequireAuth, &firewall.CreatedAt, &firewall.UpdatedAt, &firewall.DeletedAt)
+		err := rows.Scan(&firewall.ID, &firewall.Name, &firewall.AllowAll, &firewall.RequireAuth, &firewall.AuthMode, &firewall.CreatedAt, &firewall.UpdatedAt, &firewall.DeletedAt)
 		if err != nil {
 			return Firewall{}, err
 		}
@@ -148,8 +469,137 @@ func (c *Connection) GetFirewall(id string) (Firewall, error) {
 	return firewall, nil
 }
 
-func (c *Connection) GetMethods(firewall string, route string) ([]Method, error) {
-	rows, err := c.Connection.Query("SELECT * FROM methods WHERE firewall_id = $1 AND route_id = $2 AND action = $3 AND deleted_at IS NULL", firewall, route, ACTION_ALLOW)
+func (c *Connection) GetAuthMethods(firewall string) ([]AuthMethod, error) {
+	rows, err := c.Connection.Query("SELECT * FROM auth_methods WHERE firewall_id = $1 AND deleted_at IS NULL ORDER BY position", firewall)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	methods := []AuthMethod{}
+	for rows.Next() {
+		method := AuthMethod{}
+		err := rows.Scan(&method.FirewallID, &method.Method, &method.Position, &method.CreatedAt, &method.UpdatedAt, &method.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		methods = append(methods, method)
+	}
+
+	return methods, nil
+}
+
+func (c *Connection) GetBasicUsers(firewall string) ([]BasicUser, error) {
+	rows, err := c.Connection.Query("SELECT * FROM basic_users WHERE firewall_id = $1 AND deleted_at IS NULL", firewall)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []BasicUser{}
+	for rows.Next() {
+		user := BasicUser{}
+		err := rows.Scan(&user.ID, &user.FirewallID, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// GetAuth returns the API key with the id, ok is false if it does not exist
+func (c *Connection) GetAuth(id string) (Auth, bool, error) {
+	rows, err := c.Connection.Query("SELECT * FROM auths WHERE id = $1 AND deleted_at IS NULL", id)
+	if err != nil {
+		return Auth{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return Auth{}, false, rows.Err()
+	}
+	auth := Auth{}
+	err = rows.Scan(&auth.ID, &auth.APIKey, &auth.CreatedAt, &auth.UpdatedAt, &auth.DeletedAt)
+	return auth, err == nil, err
+}
+
+// GetHMACSecret returns the decrypted HMAC secret of the auth
+func (c *Connection) GetHMACSecret(id string) (HMACSecret, bool, error) {
+	rows, err := c.Connection.Query("SELECT * FROM hmac_secrets WHERE auth_id = $1 AND deleted_at IS NULL", id)
+	if err != nil {
+		return HMACSecret{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return HMACSecret{}, false, rows.Err()
+	}
+	secret := HMACSecret{}
+	err = rows.Scan(&secret.AuthID, &secret.Secret, &secret.CreatedAt, &secret.UpdatedAt, &secret.DeletedAt)
+	if err != nil {
+		return HMACSecret{}, false, err
+	}
+	secret.Secret, err = c.decryptSecret(secret.Secret, "hmac_secrets", "secret", secret.AuthID)
+	return secret, err == nil, err
+}
+
+// SaveHMACSecret encrypts and stores the HMAC secret of the auth
+func (c *Connection) SaveHMACSecret(id string, secret string) error {
+	encrypted, err := c.encryptSecret(secret, "hmac_secrets", "secret", id)
+	if err != nil {
+		return err
+	}
+	_, err = c.Connection.Exec("INSERT INTO hmac_secrets (auth_id, secret) VALUES ($1, $2) ON CONFLICT (auth_id) DO UPDATE SET secret = $2, updated_at = now(), deleted_at = NULL", id, encrypted)
+	return err
+}
+
+// UseSignatureNonce stores the nonce until it expires. It returns false if
+// the nonce is stored and not expired, i.e. the request is replayed.
+func (c *Connection) UseSignatureNonce(nonce string, expiresAt time.Time) (bool, error) {
+	result, err := c.Connection.Exec("INSERT INTO signature_nonces (nonce, expires_at) VALUES ($1, $2) ON CONFLICT (nonce) DO UPDATE SET expires_at = EXCLUDED.expires_at WHERE signature_nonces.expires_at <= now()", nonce, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted == 1, err
+}
+
+// DeleteExpiredSignatureNonces deletes the nonces which cannot be replayed
+// anymore
+func (c *Connection) DeleteExpiredSignatureNonces() (int64, error) {
+	result, err := c.Connection.Exec("DELETE FROM signature_nonces WHERE expires_at <= now()")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetRouteAuths returns the ids of the API keys allowed for the route
+func (c *Connection) GetRouteAuths(route string) ([]string, error) {
+	rows, err := c.Connection.Query("SELECT auth_id FROM route_auths WHERE route_id = $1 AND deleted_at IS NULL", route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func (c *Connection) GetMethods(firewall string, route string, action string) ([]Method, error) {
+	rows, err := c.Connection.Query("SELECT * FROM methods WHERE firewall_id = $1 AND (route_id = $2 OR route_id IS NULL) AND action = $3 AND deleted_at IS NULL", firewall, route, action)
 	if err != nil {
 		return nil, err
 	}
@@ -170,7 +620,7 @@ func (c *Connection) GetMethods(firewall string, route string) ([]Method, error)
 }
 
 func (c *Connection) GetIPs(firewall string, route string, action string) ([]IP, error) {
-	rows, err := c.Connection.Query("SELECT * FROM ips WHERE firewall_id = $1 AND route_id = $2 AND action = $3 AND deleted_at IS NULL", firewall, route, action)
+	rows, err := c.Connection.Query("SELECT * FROM ips WHERE firewall_id = $1 AND (route_id = $2 OR route_id IS NULL) AND action = $3 AND deleted_at IS NULL", firewall, route, action)
 	if err != nil {
 		return nil, err
 	}
@@ -191,7 +641,7 @@ func (c *Connection) GetIPs(firewall string, route string, action string) ([]IP,
 }
 
 func (c *Connection) GetUserAgents(firewall string, route string, action string) ([]UserAgent, error) {
-	rows, err := c.Connection.Query("SELECT * FROM useragents WHERE firewall_id = $1 AND route_id = $2 AND action = $3 AND deleted_at IS NULL", firewall, route, action)
+	rows, err := c.Connection.Query("SELECT * FROM useragents WHERE firewall_id = $1 AND (route_id = $2 OR route_id IS NULL) AND action = $3 AND deleted_at IS NULL", firewall, route, action)
 	if err != nil {
 		return nil, err
 	}
@@ -200,7 +650,7 @@ func (c *Connection) GetUserAgents(firewall string, route string, action string)
 	userAgents := []UserAgent{}
 	for rows.Next() {
 		userAgent := UserAgent{}
-		err := rows.Scan(&userAgent.FirewallID, &userAgent.RouteID, &userAgent.UserAgent, &userAgent.Action, &userAgent.CreatedAt, &userAgent.UpdatedAt, &userAgent.DeletedAt)
+		err := rows.Scan(&userAgent.FirewallID, &userAgent.RouteID, &userAgent.UserAgent, &userAgent.Action, &userAgent.MatchType, &userAgent.CreatedAt, &userAgent.UpdatedAt, &userAgent.DeletedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -211,6 +661,573 @@ func (c *Connection) GetUserAgents(firewall string, route string, action string)
 	return userAgents, nil
 }
 
+func (c *Connection) GetCountries(firewall string, route string, action string) ([]Country, error) {
+	rows, err := c.Connection.Query("SELECT * FROM countries WHERE firewall_id = $1 AND (route_id = $2 OR route_id IS NULL) AND action = $3 AND deleted_at IS NULL", firewall, route, action)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	countries := []Country{}
+	for rows.Next() {
+		country := Country{}
+		err := rows.Scan(&country.FirewallID, &country.RouteID, &country.Country, &country.Action, &country.CreatedAt, &country.UpdatedAt, &country.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		countries = append(countries, country)
+	}
+
+	return countries, nil
+}
+
+func (c *Connection) GetASNs(firewall string, route string, action string) ([]ASN, error) {
+	rows, err := c.Connection.Query("SELECT * FROM asns WHERE firewall_id = $1 AND (route_id = $2 OR route_id IS NULL) AND action = $3 AND deleted_at IS NULL", firewall, route, action)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	asns := []ASN{}
+	for rows.Next() {
+		asn := ASN{}
+		err := rows.Scan(&asn.FirewallID, &asn.RouteID, &asn.ASN, &asn.Action, &asn.CreatedAt, &asn.UpdatedAt, &asn.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		asns = append(asns, asn)
+	}
+
+	return asns, nil
+}
+
+func (c *Connection) GetPaths(firewall string, route string) ([]Path, error) {
+	rows, err := c.Connection.Query("SELECT * FROM paths WHERE firewall_id = $1 AND (route_id = $2 OR route_id IS NULL) AND deleted_at IS NULL ORDER BY route_id NULLS LAST", firewall, route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := []Path{}
+	for rows.Next() {
+		path := Path{}
+		err := rows.Scan(&path.ID, &path.FirewallID, &path.RouteID, &path.Pattern, &path.MatchType, &path.Action, pq.Array(&path.Methods), pq.Array(&path.IPs), &path.RequireAuth, &path.CreatedAt, &path.UpdatedAt, &path.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+func (c *Connection) GetWAF(route string) (WAF, error) {
+	rows, err := c.Connection.Query("SELECT * FROM wafs WHERE route_id = $1 AND deleted_at IS NULL", route)
+	if err != nil {
+		return WAF{}, err
+	}
+	defer rows.Close()
+
+	waf := WAF{RouteID: route, Mode: WAF_MODE_OFF}
+	for rows.Next() {
+		err := rows.Scan(&waf.RouteID, &waf.Mode, &waf.Threshold, &waf.MaxBodySize, &waf.CreatedAt, &waf.UpdatedAt, &waf.DeletedAt)
+		if err != nil {
+			return WAF{}, err
+		}
+	}
+
+	return waf, nil
+}
+
+func (c *Connection) GetWAFRules(route string) ([]WAFRule, error) {
+	rows, err := c.Connection.Query("SELECT * FROM waf_rules WHERE route_id = $1 AND deleted_at IS NULL ORDER BY position", route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []WAFRule{}
+	for rows.Next() {
+		rule := WAFRule{}
+		err := rows.Scan(&rule.ID, &rule.RouteID, &rule.Name, &rule.File, &rule.Rules, &rule.Position, &rule.CreatedAt, &rule.UpdatedAt, &rule.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (c *Connection) GetCertificates(server string) ([]Certificate, error) {
+	rows, err := c.Connection.Query("SELECT * FROM certificates WHERE (server_id = $1 OR server_id IS NULL) AND deleted_at IS NULL ORDER BY created_at", server)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	certificates := []Certificate{}
+	for rows.Next() {
+		certificate := Certificate{}
+		err := rows.Scan(&certificate.ID, &certificate.ServerID, &certificate.Name, &certificate.CertFile, &certificate.KeyFile, &certificate.Certificate, &certificate.PrivateKey, &certificate.ACMEDomain, &certificate.CreatedAt, &certificate.UpdatedAt, &certificate.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.decryptNullSecret(&certificate.PrivateKey, "certificates", "private_key", certificate.ID); err != nil {
+			return nil, err
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	return certificates, nil
+}
+
+// GetACMEAccount returns the account of the directory. The key is only stored
+// if no account exists yet, so all instances use the key stored first.
+func (c *Connection) GetACMEAccount(directoryURL string, email string, privateKey string) (ACMEAccount, error) {
+	id := uuid.NewString()
+	privateKey, err := c.encryptSecret(privateKey, "acme_accounts", "private_key", id)
+	if err != nil {
+		return ACMEAccount{}, err
+	}
+	_, err = c.Connection.Exec("INSERT INTO acme_accounts (id, directory_url, email, private_key) VALUES ($1, $2, $3, $4) ON CONFLICT (directory_url) DO NOTHING", id, directoryURL, email, privateKey)
+	if err != nil {
+		return ACMEAccount{}, err
+	}
+
+	account := ACMEAccount{}
+	err = c.Connection.QueryRow("SELECT * FROM acme_accounts WHERE directory_url = $1", directoryURL).Scan(&account.ID, &account.DirectoryURL, &account.Email, &account.PrivateKey, &account.CreatedAt, &account.UpdatedAt, &account.DeletedAt)
+	if err != nil {
+		return ACMEAccount{}, err
+	}
+	account.PrivateKey, err = c.decryptSecret(account.PrivateKey, "acme_accounts", "private_key", account.ID)
+	return account, err
+}
+
+func (c *Connection) GetACMEDomains(server string) ([]string, error) {
+	rows, err := c.Connection.Query("SELECT domain FROM acme_domains WHERE (server_id = $1 OR server_id IS NULL) AND deleted_at IS NULL ORDER BY domain", server)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []string{}
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+
+	return domains, nil
+}
+
+// GetACMECertificate returns the newest certificate issued for the domain
+func (c *Connection) GetACMECertificate(domain string) (Certificate, bool, error) {
+	rows, err := c.Connection.Query("SELECT * FROM certificates WHERE acme_domain = $1 AND deleted_at IS NULL ORDER BY created_at DESC LIMIT 1", domain)
+	if err != nil {
+		return Certificate{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return Certificate{}, false, rows.Err()
+	}
+	certificate := Certificate{}
+	err = rows.Scan(&certificate.ID, &certificate.ServerID, &certificate.Name, &certificate.CertFile, &certificate.KeyFile, &certificate.Certificate, &certificate.PrivateKey, &certificate.ACMEDomain, &certificate.CreatedAt, &certificate.UpdatedAt, &certificate.DeletedAt)
+	if err != nil {
+		return Certificate{}, false, err
+	}
+	err = c.decryptNullSecret(&certificate.PrivateKey, "certificates", "private_key", certificate.ID)
+	return certificate, err == nil, err
+}
+
+// SaveACMECertificate replaces the certificate of the domain
+func (c *Connection) SaveACMECertificate(domain string, certificate string, privateKey string) error {
+	tx, err := c.Connection.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE certificates SET deleted_at = now(), updated_at = now() WHERE acme_domain = $1 AND deleted_at IS NULL", domain)
+	if err != nil {
+		return err
+	}
+	id := uuid.NewString()
+	privateKey, err = c.encryptSecret(privateKey, "certificates", "private_key", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO certificates (id, name, certificate, private_key, acme_domain) VALUES ($1, $2, $3, $4, $5)", id, "acme:"+domain, certificate, privateKey, domain)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (c *Connection) CreateACMEChallenge(token string, domain string, challengeType string, expiresAt time.Time) error {
+	_, err := c.Connection.Exec("INSERT INTO acme_challenges (token, domain, type, expires_at) VALUES ($1, $2, $3, $4) ON CONFLICT (token) DO UPDATE SET domain = $2, type = $3, expires_at = $4", token, domain, challengeType, expiresAt)
+	return err
+}
+
+func (c *Connection) DeleteACMEChallenge(token string) error {
+	_, err := c.Connection.Exec("DELETE FROM acme_challenges WHERE token = $1 OR expires_at < now()", token)
+	return err
+}
+
+// GetACMEChallenge returns a pending challenge by token or, for TLS-ALPN-01,
+// by domain
+func (c *Connection) GetACMEChallenge(token string, domain string, challengeType string) (ACMEChallenge, bool, error) {
+	challenge := ACMEChallenge{}
+	err := c.Connection.QueryRow("SELECT * FROM acme_challenges WHERE ($1 = '' OR token = $1) AND ($2 = '' OR domain = $2) AND type = $3 AND expires_at > now() ORDER BY created_at DESC LIMIT 1", token, domain, challengeType).Scan(&challenge.Token, &challenge.Domain, &challenge.Type, &challenge.ExpiresAt, &challenge.CreatedAt)
+	if err == sql.ErrNoRows {
+		return ACMEChallenge{}, false, nil
+	}
+	return challenge, err == nil, err
+}
+
+// TryLock acquires a session level advisory lock on a dedicated connection.
+// The lock is held until unlock is called.
+func (c *Connection) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	conn, err := c.Connection.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&locked)
+	if err != nil || !locked {
+		conn.Close()
+		return nil, false, err
+	}
+
+	unlock := func() {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", name)
+		conn.Close()
+	}
+	return unlock, true, nil
+}
+
+// GetMTLS returns the client certificate settings of the route, ok is false
+// if the route does not use client certificates
+func (c *Connection) GetMTLS(route string) (MTLS, bool, error) {
+	rows, err := c.Connection.Query("SELECT * FROM route_mtls WHERE route_id = $1 AND deleted_at IS NULL LIMIT 1", route)
+	if err != nil {
+		return MTLS{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return MTLS{}, false, rows.Err()
+	}
+	mtls := MTLS{}
+	err = rows.Scan(&mtls.ID, &mtls.RouteID, &mtls.CAFile, &mtls.CABundle, pq.Array(&mtls.CRLFiles), &mtls.ForwardHeaders, &mtls.CreatedAt, &mtls.UpdatedAt, &mtls.DeletedAt)
+	return mtls, err == nil, err
+}
+
+func (c *Connection) GetMTLSPrincipals(route string) ([]MTLSPrincipal, error) {
+	rows, err := c.Connection.Query("SELECT * FROM route_mtls_principals WHERE route_id = $1 AND deleted_at IS NULL ORDER BY created_at", route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	principals := []MTLSPrincipal{}
+	for rows.Next() {
+		principal := MTLSPrincipal{}
+		err := rows.Scan(&principal.ID, &principal.RouteID, &principal.MatchType, &principal.Value, &principal.Principal, &principal.CreatedAt, &principal.UpdatedAt, &principal.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		principals = append(principals, principal)
+	}
+
+	return principals, nil
+}
+
+// GetUpstreamTLS returns the TLS settings toward the target of the route, ok
+// is false if the route uses the defaults
+func (c *Connection) GetUpstreamTLS(route string) (UpstreamTLS, bool, error) {
+	rows, err := c.Connection.Query("SELECT * FROM route_upstream_tls WHERE route_id = $1 AND deleted_at IS NULL LIMIT 1", route)
+	if err != nil {
+		return UpstreamTLS{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return UpstreamTLS{}, false, rows.Err()
+	}
+	upstream := UpstreamTLS{}
+	err = rows.Scan(&upstream.ID, &upstream.RouteID, &upstream.CAFile, &upstream.CABundle, &upstream.CertFile, &upstream.KeyFile, &upstream.Certificate, &upstream.PrivateKey, &upstream.ServerName, &upstream.InsecureSkipVerify, &upstream.MinVersion, pq.Array(&upstream.Pins), &upstream.CreatedAt, &upstream.UpdatedAt, &upstream.DeletedAt)
+	if err != nil {
+		return UpstreamTLS{}, false, err
+	}
+	err = c.decryptNullSecret(&upstream.PrivateKey, "route_upstream_tls", "private_key", upstream.ID)
+	return upstream, err == nil, err
+}
+
+// GetCredentials returns the decrypted credentials of the gateway at the
+// target of the route
+func (c *Connection) GetCredentials(route string) ([]Credential, error) {
+	rows, err := c.Connection.Query("SELECT * FROM route_credentials WHERE route_id = $1 AND deleted_at IS NULL ORDER BY created_at", route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []Credential{}
+	for rows.Next() {
+		credential := Credential{}
+		err := rows.Scan(&credential.ID, &credential.RouteID, &credential.Type, &credential.Header, &credential.Username, &credential.Secret, &credential.TokenURL, &credential.ClientID, pq.Array(&credential.Scopes), &credential.CreatedAt, &credential.UpdatedAt, &credential.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+		credential.Secret, err = c.decryptSecret(credential.Secret, "route_credentials", "secret", credential.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, nil
+}
+
+// GetHeaderRules returns the header rules of the route in order
+func (c *Connection) GetHeaderRules(route string) ([]HeaderRule, error) {
+	rows, err := c.Connection.Query("SELECT * FROM header_rules WHERE route_id = $1 AND deleted_at IS NULL ORDER BY position, created_at", route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []HeaderRule{}
+	for rows.Next() {
+		rule := HeaderRule{}
+		err := rows.Scan(&rule.ID, &rule.RouteID, &rule.Direction, &rule.Action, &rule.Header, &rule.Value, &rule.Position, &rule.CreatedAt, &rule.UpdatedAt, &rule.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// GetSecurityHeaders returns the security headers of the route, ok is false
+// if the route has no policy
+func (c *Connection) GetSecurityHeaders(route string) (SecurityHeaders, bool, error) {
+	rows, err := c.Connection.Query("SELECT * FROM route_security_headers WHERE route_id = $1 AND deleted_at IS NULL LIMIT 1", route)
+	if err != nil {
+		return SecurityHeaders{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return SecurityHeaders{}, false, rows.Err()
+	}
+	headers := SecurityHeaders{}
+	err = rows.Scan(&headers.ID, &headers.RouteID, &headers.Profile, &headers.Override, &headers.HSTS, &headers.ContentSecurityPolicy, &headers.CSPReportOnly, &headers.FrameOptions, &headers.ContentTypeOptions, &headers.ReferrerPolicy, &headers.PermissionsPolicy, &headers.CreatedAt, &headers.UpdatedAt, &headers.DeletedAt)
+	return headers, err == nil, err
+}
+
+// GetJWT returns the JWT settings of the route, ok is false if the route does
+// not use JWT authentication
+func (c *Connection) GetJWT(route string) (JWT, bool, error) {
+	rows, err := c.Connection.Query("SELECT * FROM route_jwt WHERE route_id = $1 AND deleted_at IS NULL LIMIT 1", route)
+	if err != nil {
+		return JWT{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return JWT{}, false, rows.Err()
+	}
+	jwt := JWT{}
+	err = rows.Scan(&jwt.ID, &jwt.RouteID, &jwt.Issuer, pq.Array(&jwt.Audiences), pq.Array(&jwt.Algorithms), &jwt.JWKSURL, &jwt.JWKSFile, &jwt.Secret, &jwt.JWKSRefreshSeconds, &jwt.ClockSkewSeconds, &jwt.PrincipalClaim, &jwt.CreatedAt, &jwt.UpdatedAt, &jwt.DeletedAt)
+	if err != nil {
+		return JWT{}, false, err
+	}
+	err = c.decryptNullSecret(&jwt.Secret, "route_jwt", "secret", jwt.ID)
+	return jwt, err == nil, err
+}
+
+func (c *Connection) GetJWTClaims(route string) ([]JWTClaim, error) {
+	rows, err := c.Connection.Query("SELECT * FROM route_jwt_claims WHERE route_id = $1 AND deleted_at IS NULL ORDER BY created_at", route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	claims := []JWTClaim{}
+	for rows.Next() {
+		claim := JWTClaim{}
+		err := rows.Scan(&claim.ID, &claim.RouteID, &claim.Claim, &claim.Operator, &claim.Value, &claim.CreatedAt, &claim.UpdatedAt, &claim.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		claims = append(claims, claim)
+	}
+
+	return claims, nil
+}
+
+// GetOIDC returns the OpenID Connect login of the route, ok is false if the
+// route does not use it
+func (c *Connection) GetOIDC(route string) (OIDC, bool, error) {
+	rows, err := c.Connection.Query("SELECT * FROM route_oidc WHERE route_id = $1 AND deleted_at IS NULL LIMIT 1", route)
+	if err != nil {
+		return OIDC{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return OIDC{}, false, rows.Err()
+	}
+	oidc := OIDC{}
+	err = rows.Scan(&oidc.ID, &oidc.RouteID, &oidc.Issuer, &oidc.ClientID, &oidc.ClientSecret, &oidc.RedirectURL, &oidc.PostLogoutRedirectURL, pq.Array(&oidc.Scopes), &oidc.CookieName, &oidc.CookieSecret, &oidc.SessionLifetimeSeconds, &oidc.PassAccessToken, &oidc.CreatedAt, &oidc.UpdatedAt, &oidc.DeletedAt)
+	if err != nil {
+		return OIDC{}, false, err
+	}
+	oidc.ClientSecret, err = c.decryptSecret(oidc.ClientSecret, "route_oidc", "client_secret", oidc.ID)
+	if err != nil {
+		return OIDC{}, false, err
+	}
+	oidc.CookieSecret, err = c.decryptSecret(oidc.CookieSecret, "route_oidc", "cookie_secret", oidc.ID)
+	return oidc, err == nil, err
+}
+
+// GetIntrospection returns the token introspection settings of the firewall,
+// ok is false if the firewall does not use token introspection
+func (c *Connection) GetIntrospection(firewall string) (Introspection, bool, error) {
+	rows, err := c.Connection.Query("SELECT * FROM firewall_introspection WHERE firewall_id = $1 AND deleted_at IS NULL LIMIT 1", firewall)
+	if err != nil {
+		return Introspection{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return Introspection{}, false, rows.Err()
+	}
+	introspection := Introspection{}
+	err = rows.Scan(&introspection.ID, &introspection.FirewallID, &introspection.Endpoint, &introspection.ClientID, &introspection.ClientSecret, &introspection.TimeoutMs, &introspection.CacheSeconds, &introspection.NegativeCacheSeconds, &introspection.FailureThreshold, &introspection.CooldownSeconds, &introspection.CreatedAt, &introspection.UpdatedAt, &introspection.DeletedAt)
+	if err != nil {
+		return Introspection{}, false, err
+	}
+	err = c.decryptNullSecret(&introspection.ClientSecret, "firewall_introspection", "client_secret", introspection.ID)
+	return introspection, err == nil, err
+}
+
+func (c *Connection) GetScopes(firewall string, route string) ([]Scope, error) {
+	rows, err := c.Connection.Query("SELECT * FROM scopes WHERE firewall_id = $1 AND (route_id = $2 OR route_id IS NULL) AND deleted_at IS NULL", firewall, route)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scopes := []Scope{}
+	for rows.Next() {
+		scope := Scope{}
+		err := rows.Scan(&scope.FirewallID, &scope.RouteID, &scope.Scope, &scope.CreatedAt, &scope.UpdatedAt, &scope.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, nil
+}
+
+func (c *Connection) CreateBan(ip string, reason string, expiresAt time.Time) error {
+	_, err := c.Connection.Exec("INSERT INTO dynamic_bans (ip, reason, expires_at) VALUES ($1, $2, $3)", ip, reason, expiresAt)
+	return err
+}
+
+func (c *Connection) LiftBan(ip string) error {
+	_, err := c.Connection.Exec("UPDATE dynamic_bans SET deleted_at = now(), updated_at = now() WHERE ip = $1 AND deleted_at IS NULL", ip)
+	return err
+}
+
+func (c *Connection) GetActiveBans() ([]Ban, error) {
+	rows, err := c.Connection.Query("SELECT * FROM dynamic_bans WHERE expires_at > now() AND deleted_at IS NULL ORDER BY expires_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []Ban{}
+	for rows.Next() {
+		ban := Ban{}
+		err := rows.Scan(&ban.ID, &ban.IP, &ban.Reason, &ban.ExpiresAt, &ban.CreatedAt, &ban.UpdatedAt, &ban.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		bans = append(bans, ban)
+	}
+
+	return bans, nil
+}
+
+// CreateAuditEvents inserts the events in a single transaction
+func (c *Connection) CreateAuditEvents(events []AuditEvent) error {
+	tx, err := c.Connection.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO audit_events (type, actor, actor_ip, target, request_id, before, after, details, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, event := range events {
+		_, err := stmt.Exec(event.Type, event.Actor, event.ActorIP, event.Target, event.RequestID, event.Before, event.After, event.Details, event.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAuditEvents returns the newest events in the time range. Empty actor
+// and type filters match all events.
+func (c *Connection) GetAuditEvents(from time.Time, to time.Time, actor string, eventType string, limit int) ([]AuditEvent, error) {
+	rows, err := c.Connection.Query("SELECT * FROM audit_events WHERE created_at >= $1 AND created_at < $2 AND ($3 = '' OR actor = $3) AND ($4 = '' OR type = $4) ORDER BY created_at DESC LIMIT $5", from, to, actor, eventType, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		event := AuditEvent{}
+		err := rows.Scan(&event.ID, &event.Type, &event.Actor, &event.ActorIP, &event.Target, &event.RequestID, &event.Before, &event.After, &event.Details, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
 func (c *Connection) GetServerConfiguration(name string) (Server, error) {
 	rows, err := c.Connection.Query("SELECT * FROM servers WHERE name = $1 AND deleted_at IS NULL LIMIT 1", name)
 	if err != nil {
@@ -220,7 +1237,7 @@ func (c *Connection) GetServerConfiguration(name string) (Server, error) {
 
 	server := Server{}
 	for rows.Next() {
-		err := rows.Scan(&server.ID, &server.Name, &server.Address, &server.Port, &server.BasePath, &server.CreatedAt, &server.UpdatedAt, &server.DeletedAt)
+		err := rows.Scan(&server.ID, &server.Name, &server.Address, &server.Port, &server.BasePath, &server.TLSEnabled, &server.TLSPort, &server.TLSMinVersion, pq.Array(&server.TLSCipherSuites), &server.TLSCertFile, &server.TLSKeyFile, &server.TLSRedirect, &server.TLSClientAuth, &server.CreatedAt, &server.UpdatedAt, &server.DeletedAt)
 		if err != nil {
 			return Server{}, err
 		}
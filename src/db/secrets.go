@@ -0,0 +1,125 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/secnex/secnex-api-gateway/secrets"
+)
+
+// EncryptedColumn is a column with secrets, identified by the key column
+type EncryptedColumn struct {
+	Table  string
+	Column string
+	Key    string
+}
+
+// EncryptedColumns are all columns encrypted with the master key
+var EncryptedColumns = []EncryptedColumn{
+	{Table: "certificates", Column: "private_key", Key: "id"},
+	{Table: "acme_accounts", Column: "private_key", Key: "id"},
+	{Table: "hmac_secrets", Column: "secret", Key: "auth_id"},
+	{Table: "route_upstream_tls", Column: "private_key", Key: "id"},
+	{Table: "route_credentials", Column: "secret", Key: "id"},
+	{Table: "route_jwt", Column: "secret", Key: "id"},
+	{Table: "route_oidc", Column: "client_secret", Key: "id"},
+	{Table: "route_oidc", Column: "cookie_secret", Key: "id"},
+	{Table: "firewall_introspection", Column: "client_secret", Key: "id"},
+}
+
+// secretContext binds an encrypted value to its column and record
+func secretContext(table string, column string, id string) string {
+	return table + "." + column + ":" + id
+}
+
+// decryptSecret returns the plaintext of an encrypted column. With a master
+// key, values in plaintext are rejected until they are encrypted by
+// ReencryptSecrets. Without master key they are returned as they are.
+func (c *Connection) decryptSecret(value string, table string, column string, id string) (string, error) {
+	if secrets.IsEncrypted(value) {
+		return c.Secrets.Decrypt(value, secretContext(table, column, id))
+	}
+	if c.Secrets != nil {
+		return "", fmt.Errorf("%s is not encrypted, run reencrypt-secrets", secretContext(table, column, id))
+	}
+	return value, nil
+}
+
+func (c *Connection) decryptNullSecret(value *sql.NullString, table string, column string, id string) error {
+	if !value.Valid {
+		return nil
+	}
+	plaintext, err := c.decryptSecret(value.String, table, column, id)
+	value.String = plaintext
+	return err
+}
+
+// encryptSecret encrypts a value for the column. Secrets are never written
+// in plaintext, without master key ErrNoMasterKey is returned.
+func (c *Connection) encryptSecret(value string, table string, column string, id string) (string, error) {
+	return c.Secrets.Encrypt(value, secretContext(table, column, id))
+}
+
+// reencryptSecret encrypts a value in plaintext or encrypted with an older
+// master key with the current one
+func (c *Connection) reencryptSecret(value string, table string, column string, id string) (string, error) {
+	plaintext := value
+	if secrets.IsEncrypted(value) {
+		var err error
+		plaintext, err = c.Secrets.Decrypt(value, secretContext(table, column, id))
+		if err != nil {
+			return "", err
+		}
+	}
+	return c.encryptSecret(plaintext, table, column, id)
+}
+
+// ReencryptSecrets encrypts all values of the encrypted columns which are
+// in plaintext or encrypted with an older master key with the current one.
+// Rows changed in the meantime are skipped, so the gateways can keep
+// running. It returns the number of updated values.
+func (c *Connection) ReencryptSecrets() (int, error) {
+	if c.Secrets == nil {
+		return 0, secrets.ErrNoMasterKey
+	}
+
+	updated := 0
+	for _, column := range EncryptedColumns {
+		query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s IS NOT NULL", column.Key, column.Column, column.Table, column.Column)
+		rows, err := c.Connection.Query(query)
+		if err != nil {
+			return updated, err
+		}
+		values := map[string]string{}
+		for rows.Next() {
+			var id, value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return updated, err
+			}
+			if c.Secrets.NeedsRotation(value) {
+				values[id] = value
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return updated, err
+		}
+
+		update := fmt.Sprintf("UPDATE %s SET %s = $1, updated_at = now() WHERE %s = $2 AND %s = $3", column.Table, column.Column, column.Key, column.Column)
+		for id, value := range values {
+			encrypted, err := c.reencryptSecret(value, column.Table, column.Column, id)
+			if err != nil {
+				return updated, err
+			}
+			result, err := c.Connection.Exec(update, encrypted, id, value)
+			if err != nil {
+				return updated, err
+			}
+			if count, err := result.RowsAffected(); err == nil {
+				updated += int(count)
+			}
+		}
+	}
+	return updated, nil
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/secnex/secnex-api-gateway/secrets"
+)
+
+func newTestKeyring(t *testing.T, versions ...int) *secrets.Keyring {
+	t.Helper()
+	keys := map[int][]byte{}
+	for _, version := range versions {
+		keys[version] = bytes.Repeat([]byte{byte(version)}, secrets.KEY_SIZE)
+	}
+	keyring, err := secrets.NewKeyring(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestDecryptSecret(t *testing.T) {
+	cnx := &Connection{Secrets: newTestKeyring(t, 1)}
+	encrypted, err := cnx.encryptSecret("secret", "route_jwt", "secret", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := cnx.decryptSecret(encrypted, "route_jwt", "secret", "1"); err != nil || plaintext != "secret" {
+		t.Fatalf("decryptSecret() = %q, %v", plaintext, err)
+	}
+
+	// The value is bound to its record
+	if _, err := cnx.decryptSecret(encrypted, "route_jwt", "secret", "2"); err == nil {
+		t.Error("value of another record decrypted")
+	}
+	if _, err := cnx.decryptSecret(encrypted, "route_credentials", "secret", "1"); err == nil {
+		t.Error("value of another column decrypted")
+	}
+
+	// With a master key plaintext is rejected
+	_, err = cnx.decryptSecret("secret", "route_jwt", "secret", "1")
+	if err == nil || err.Error() != "route_jwt.secret:1 is not encrypted, run reencrypt-secrets" {
+		t.Errorf("decryptSecret() of plaintext = %v", err)
+	}
+	value := sql.NullString{String: "secret", Valid: true}
+	if err := cnx.decryptNullSecret(&value, "route_jwt", "secret", "1"); err == nil {
+		t.Error("decryptNullSecret() of plaintext accepted")
+	}
+	value = sql.NullString{}
+	if err := cnx.decryptNullSecret(&value, "route_jwt", "secret", "1"); err != nil || value.Valid {
+		t.Errorf("decryptNullSecret() of NULL = %v", err)
+	}
+}
+
+func TestSecretsWithoutMasterKey(t *testing.T) {
+	cnx := &Connection{}
+
+	// Plaintext is read, e.g. before the first master key is set, but never
+	// written
+	if plaintext, err := cnx.decryptSecret("secret", "route_jwt", "secret", "1"); err != nil || plaintext != "secret" {
+		t.Errorf("decryptSecret() without master key = %q, %v", plaintext, err)
+	}
+	if _, err := cnx.decryptSecret("enc:v1:1:a:b", "route_jwt", "secret", "1"); !errors.Is(err, secrets.ErrNoMasterKey) {
+		t.Errorf("decryptSecret() of encrypted value without master key = %v, want %v", err, secrets.ErrNoMasterKey)
+	}
+	if _, err := cnx.encryptSecret("secret", "route_jwt", "secret", "1"); !errors.Is(err, secrets.ErrNoMasterKey) {
+		t.Errorf("encryptSecret() without master key = %v, want %v", err, secrets.ErrNoMasterKey)
+	}
+	if _, err := cnx.ReencryptSecrets(); !errors.Is(err, secrets.ErrNoMasterKey) {
+		t.Errorf("ReencryptSecrets() without master key = %v, want %v", err, secrets.ErrNoMasterKey)
+	}
+}
+
+func TestReencryptSecret(t *testing.T) {
+	old := &Connection{Secrets: newTestKeyring(t, 1)}
+	encrypted, err := old.encryptSecret("secret", "route_oidc", "client_secret", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cnx := &Connection{Secrets: newTestKeyring(t, 1, 2)}
+	for _, value := range []string{encrypted, "secret"} {
+		reencrypted, err := cnx.reencryptSecret(value, "route_oidc", "client_secret", "1")
+		if err != nil || !strings.HasPrefix(reencrypted, "enc:v1:2:") {
+			t.Fatalf("reencryptSecret() = %q, %v", reencrypted, err)
+		}
+		if plaintext, err := cnx.decryptSecret(reencrypted, "route_oidc", "client_secret", "1"); err != nil || plaintext != "secret" {
+			t.Errorf("decryptSecret() after reencryptSecret() = %q, %v", plaintext, err)
+		}
+	}
+
+	// A value of another record is not encrypted again for this one
+	if _, err := cnx.reencryptSecret(encrypted, "route_oidc", "client_secret", "2"); err == nil {
+		t.Error("reencryptSecret() of the value of another record accepted")
+	}
+	// Values of removed master keys cannot be encrypted again
+	current := &Connection{Secrets: newTestKeyring(t, 2)}
+	if _, err := current.reencryptSecret(encrypted, "route_oidc", "client_secret", "1"); err == nil {
+		t.Error("reencryptSecret() of the value of a removed master key accepted")
+	}
+}
@@ -0,0 +1,200 @@
+package geoip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Location is the resolved origin of a client address
+type Location struct {
+	Country      string
+	ASN          uint64
+	Organization string
+}
+
+// Resolver looks up client addresses in country and ASN databases. The
+// files are reloaded when they change on disk.
+type Resolver struct {
+	CountryPath    string
+	ASNPath        string
+	ForwardHeaders bool
+	country        *database
+	asn            *database
+}
+
+type database struct {
+	path     string
+	reader   *Reader
+	modified time.Time
+	mu       sync.RWMutex
+}
+
+const HEADER_COUNTRY = "X-Geo-Country"
+const HEADER_ASN = "X-Geo-ASN"
+
+// NewResolverEnv creates a resolver from the GEOIP_* environment variables.
+// The result is nil if no database is configured.
+func NewResolverEnv() (*Resolver, error) {
+	countryPath := os.Getenv("GEOIP_COUNTRY_DB")
+	asnPath := os.Getenv("GEOIP_ASN_DB")
+	if countryPath == "" && asnPath == "" {
+		return nil, nil
+	}
+	forwardHeaders, _ := strconv.ParseBool(os.Getenv("GEOIP_FORWARD_HEADERS"))
+
+	return NewResolver(countryPath, asnPath, forwardHeaders)
+}
+
+func NewResolver(countryPath string, asnPath string, forwardHeaders bool) (*Resolver, error) {
+	r := &Resolver{
+		CountryPath:    countryPath,
+		ASNPath:        asnPath,
+		ForwardHeaders: forwardHeaders,
+	}
+
+	var err error
+	if countryPath != "" {
+		r.country, err = openDatabase(countryPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		r.asn, err = openDatabase(asnPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func openDatabase(path string) (*database, error) {
+	db := &database{path: path}
+	if _, err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Lookup resolves the country and autonomous system of the address
+func (r *Resolver) Lookup(address string) Location {
+	location := Location{}
+	ip := net.ParseIP(address)
+	if r == nil || ip == nil {
+		return location
+	}
+
+	countryRecord := r.country.lookup(ip)
+	if countryRecord != nil {
+		location.Country = strings.ToUpper(lookupString(countryRecord, "country", "iso_code"))
+		if location.Country == "" {
+			location.Country = strings.ToUpper(lookupString(countryRecord, "registered_country", "iso_code"))
+		}
+	}
+
+	// The ASN may be stored in a separate database or in the same one
+	asnRecord := countryRecord
+	if r.asn != nil {
+		asnRecord = r.asn.lookup(ip)
+	}
+	if record, ok := asnRecord.(map[string]interface{}); ok {
+		location.ASN = toUint(record["autonomous_system_number"])
+		location.Organization, _ = record["autonomous_system_organization"].(string)
+	}
+
+	return location
+}
+
+// ASNString returns the autonomous system number as used in rules and headers
+func (l Location) ASNString() string {
+	if l.ASN == 0 {
+		return ""
+	}
+	return strconv.FormatUint(l.ASN, 10)
+}
+
+// StartReloader checks the database files for changes in the given interval
+func (r *Resolver) StartReloader(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, db := range []*database{r.country, r.asn} {
+			if db == nil {
+				continue
+			}
+			reloaded, err := db.reload()
+			if err != nil {
+				log.Printf("Error reloading GeoIP database %s: %s\n", db.path, err)
+				continue
+			}
+			if reloaded {
+				log.Printf("GeoIP database %s reloaded.\n", db.path)
+			}
+		}
+	}
+}
+
+// reload reads the file again if its modification time changed
+func (db *database) reload() (bool, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+
+	db.mu.RLock()
+	unchanged := db.reader != nil && info.ModTime().Equal(db.modified)
+	db.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	reader, err := Open(db.path)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", db.path, err)
+	}
+
+	db.mu.Lock()
+	db.reader = reader
+	db.modified = info.ModTime()
+	db.mu.Unlock()
+
+	return true, nil
+}
+
+func (db *database) lookup(ip net.IP) interface{} {
+	if db == nil {
+		return nil
+	}
+
+	db.mu.RLock()
+	reader := db.reader
+	db.mu.RUnlock()
+
+	record, err := reader.Lookup(ip)
+	if err != nil {
+		log.Printf("Error looking up %s in %s: %s\n", ip, db.path, err)
+		return nil
+	}
+	return record
+}
+
+// lookupString follows the keys through nested maps
+func lookupString(record interface{}, keys ...string) string {
+	for _, key := range keys {
+		fields, ok := record.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		record = fields[key]
+	}
+	value, _ := record.(string)
+	return value
+}
@@ -0,0 +1,320 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata section at the end of the file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Reader reads MaxMind DB (MMDB) files
+type Reader struct {
+	buffer       []byte
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint
+	DatabaseType string
+}
+
+// Open reads a MaxMind DB file into memory
+func Open(path string) (*Reader, error) {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(buffer)
+}
+
+// NewReader parses the metadata and the search tree layout of a MaxMind DB
+func NewReader(buffer []byte) (*Reader, error) {
+	start := bytes.LastIndex(buffer, metadataMarker)
+	if start == -1 {
+		return nil, errors.New("geoip: invalid database, metadata not found")
+	}
+
+	metadata, _, err := decoder{buffer: buffer[start+len(metadataMarker):]}.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: invalid metadata: %w", err)
+	}
+	fields, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("geoip: invalid metadata")
+	}
+
+	r := &Reader{buffer: buffer}
+	r.nodeCount = uint(toUint(fields["node_count"]))
+	r.recordSize = uint(toUint(fields["record_size"]))
+	r.ipVersion = uint(toUint(fields["ip_version"]))
+	r.DatabaseType, _ = fields["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("geoip: unsupported record size %d", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(start) {
+		return nil, errors.New("geoip: invalid database, search tree exceeds file")
+	}
+	r.data = buffer[treeSize+16 : start]
+
+	// IPv4 addresses are stored below ::/96 in IPv6 databases
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Lookup decodes the record of the address. The result is nil if the
+// address is not in the database.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := 128
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+		bits = 32
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		node = r.readNode(node, uint(bit))
+	}
+
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errors.New("geoip: invalid search tree")
+	}
+
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return nil, errors.New("geoip: invalid data pointer")
+	}
+	value, _, err := decoder{buffer: r.data}.decode(offset)
+	return value, err
+}
+
+func (r *Reader) readNode(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		b := r.buffer[offset : offset+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		offset := node * 7
+		b := r.buffer[offset : offset+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buffer[offset : offset+4]))
+	}
+}
+
+// decoder decodes values of the MaxMind DB data section format
+type decoder struct {
+	buffer []byte
+}
+
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBoolean
+	typeFloat
+)
+
+func (d decoder) decode(offset uint) (interface{}, uint, error) {
+	kind, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if kind == typePointer {
+		pointer, next, err := d.decodePointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer)
+		return value, next, err
+	}
+
+	if kind == typeMap {
+		result := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			result[name], offset, err = d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return result, offset, nil
+	}
+
+	if kind == typeArray {
+		result := make([]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			result[i], offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return result, offset, nil
+	}
+
+	if kind == typeBoolean {
+		return size != 0, offset, nil
+	}
+
+	end := offset + size
+	if end > uint(len(d.buffer)) {
+		return nil, 0, errors.New("value exceeds data section")
+	}
+	b := d.buffer[offset:end]
+
+	switch kind {
+	case typeString:
+		return string(b), end, nil
+	case typeBytes:
+		return append([]byte{}, b...), end, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), end, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), end, nil
+	case typeUint16, typeUint32, typeUint64, typeUint128:
+		value := uint64(0)
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		return value, end, nil
+	case typeInt32:
+		value := uint32(0)
+		for _, c := range b {
+			value = value<<8 | uint32(c)
+		}
+		return int64(int32(value)), end, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+	}
+}
+
+func (d decoder) decodeControl(offset uint) (uint, uint, uint, error) {
+	if offset >= uint(len(d.buffer)) {
+		return 0, 0, 0, errors.New("unexpected end of data")
+	}
+	control := d.buffer[offset]
+	offset++
+
+	kind := uint(control >> 5)
+	if kind == typeExtended {
+		if offset >= uint(len(d.buffer)) {
+			return 0, 0, 0, errors.New("unexpected end of data")
+		}
+		kind = 7 + uint(d.buffer[offset])
+		offset++
+	}
+
+	size := uint(control & 0x1f)
+	if kind == typePointer {
+		return kind, size, offset, nil
+	}
+
+	extra := uint(0)
+	switch size {
+	case 29:
+		extra = 1
+	case 30:
+		extra = 2
+	case 31:
+		extra = 3
+	}
+	if offset+extra > uint(len(d.buffer)) {
+		return 0, 0, 0, errors.New("unexpected end of data")
+	}
+	switch size {
+	case 29:
+		size = 29 + uint(d.buffer[offset])
+	case 30:
+		size = 285 + (uint(d.buffer[offset])<<8 | uint(d.buffer[offset+1]))
+	case 31:
+		size = 65821 + (uint(d.buffer[offset])<<16 | uint(d.buffer[offset+1])<<8 | uint(d.buffer[offset+2]))
+	}
+
+	return kind, size, offset + extra, nil
+}
+
+func (d decoder) decodePointer(size uint, offset uint) (uint, uint, error) {
+	length := ((size >> 3) & 0x3) + 1
+	if offset+length > uint(len(d.buffer)) {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	b := d.buffer[offset : offset+length]
+
+	pointer := uint(0)
+	if length != 4 {
+		pointer = size & 0x7
+	}
+	for _, c := range b {
+		pointer = pointer<<8 | uint(c)
+	}
+
+	switch length {
+	case 2:
+		pointer += 2048
+	case 3:
+		pointer += 526336
+	}
+	return pointer, offset + length, nil
+}
+
+func toUint(value interface{}) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case int64:
+		return uint64(v)
+	default:
+		return 0
+	}
+}
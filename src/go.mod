@@ -3,8 +3,9 @@ module github.com/secnex/secnex-api-gateway
 go 1.22.5
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	golang.org/x/crypto v0.25.0 // indirect
-	golang.org/x/sys v0.22.0 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.25.0
 )
+
+require golang.org/x/sys v0.22.0 // indirect
@@ -0,0 +1,283 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const DEFAULT_JWKS_REFRESH = time.Hour
+
+// Unknown key ids trigger a refetch at most once in this interval, so
+// tokens with random key ids cannot flood the identity provider
+const MIN_JWKS_REFRESH = 30 * time.Second
+
+// Maximum size of a JWKS document
+const MAX_JWKS_SIZE = 1 << 20
+
+// JWK is a key of a JSON Web Key Set (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	K         string `json:"k"`
+	key       crypto.PublicKey
+}
+
+// KeySet holds the keys of a JWKS from a URL or a file. Keys from a URL are
+// refetched in the refresh interval and when a token references an unknown
+// key id, so rotated keys are picked up. The previous keys are kept if a
+// fetch fails.
+type KeySet struct {
+	URL       string
+	File      string
+	Refresh   time.Duration
+	Client    *http.Client
+	keys      []JWK
+	fetchedAt time.Time
+	mu        sync.RWMutex
+	fetchMu   sync.Mutex
+}
+
+// Key sets of URLs are shared by all routes and survive route refreshes
+var remoteKeySets = map[string]*KeySet{}
+var remoteKeySetsMu sync.Mutex
+
+// NewRemoteKeySet returns the key set of the URL, the keys are fetched on
+// first use
+func NewRemoteKeySet(url string, refresh time.Duration) *KeySet {
+	if refresh <= 0 {
+		refresh = DEFAULT_JWKS_REFRESH
+	}
+	remoteKeySetsMu.Lock()
+	defer remoteKeySetsMu.Unlock()
+	if keySet, ok := remoteKeySets[url]; ok {
+		keySet.mu.Lock()
+		keySet.Refresh = refresh
+		keySet.mu.Unlock()
+		return keySet
+	}
+	keySet := &KeySet{
+		URL:     url,
+		Refresh: refresh,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	remoteKeySets[url] = keySet
+	return keySet
+}
+
+// NewFileKeySet loads a key set from a JWKS file
+func NewFileKeySet(file string) (*KeySet, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseKeySet(data)
+	if err != nil {
+		return nil, fmt.Errorf("jwks %s: %w", file, err)
+	}
+	return &KeySet{File: file, keys: keys, fetchedAt: time.Now()}, nil
+}
+
+// Key returns the key for the key id and algorithm of a token. Tokens
+// without key id are checked against the first key of a matching type.
+func (k *KeySet) Key(keyID string, algorithm string) (crypto.PublicKey, error) {
+	if k.URL != "" && k.expired(k.Refresh) {
+		k.fetch(k.Refresh)
+	}
+	if key, ok := k.find(keyID, algorithm); ok {
+		return key, nil
+	}
+	// The provider may have rotated its keys
+	if k.URL != "" && k.fetch(MIN_JWKS_REFRESH) {
+		if key, ok := k.find(keyID, algorithm); ok {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+func (k *KeySet) find(keyID string, algorithm string) (crypto.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if keyID != "" && key.KeyID != keyID {
+			continue
+		}
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if key.Algorithm != "" && key.Algorithm != algorithm {
+			continue
+		}
+		if key.fits(algorithm) {
+			return key.key, true
+		}
+	}
+	return nil, false
+}
+
+func (k *KeySet) expired(maxAge time.Duration) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return time.Since(k.fetchedAt) >= maxAge
+}
+
+// fetch loads the keys from the URL if they are older than maxAge. It
+// returns true if the keys were fetched.
+func (k *KeySet) fetch(maxAge time.Duration) bool {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+	// Another request may have fetched the keys in the meantime
+	if !k.expired(maxAge) {
+		return false
+	}
+
+	keys, err := k.download()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// Failed fetches are retried after MIN_JWKS_REFRESH at the earliest
+	k.fetchedAt = time.Now()
+	if err != nil {
+		log.Printf("Error fetching JWKS %s: %s\n", k.URL, err)
+		if len(k.keys) > 0 {
+			k.fetchedAt = k.fetchedAt.Add(MIN_JWKS_REFRESH - k.Refresh)
+		}
+		return false
+	}
+	k.keys = keys
+	return true
+}
+
+func (k *KeySet) download() ([]JWK, error) {
+	response, err := k.Client.Get(k.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, MAX_JWKS_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	return parseKeySet(data)
+}
+
+func parseKeySet(data []byte) ([]JWK, error) {
+	var document struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	keys := []JWK{}
+	for _, key := range document.Keys {
+		// Keys of unknown types are skipped, the set may contain keys for
+		// encryption or other algorithms
+		if err := key.parse(); err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no supported keys")
+	}
+	return keys, nil
+}
+
+func (j *JWK) parse() error {
+	switch j.KeyType {
+	case "RSA":
+		n, err := decodeInt(j.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeInt(j.E)
+		if err != nil {
+			return err
+		}
+		j.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		if j.Curve != "P-256" {
+			return fmt.Errorf("unsupported curve %q", j.Curve)
+		}
+		x, err := decodeInt(j.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeInt(j.Y)
+		if err != nil {
+			return err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return fmt.Errorf("point not on curve")
+		}
+		j.key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return err
+		}
+		if j.Curve != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return fmt.Errorf("unsupported curve %q", j.Curve)
+		}
+		j.key = ed25519.PublicKey(x)
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil {
+			return err
+		}
+		j.key = k
+	default:
+		return fmt.Errorf("unsupported key type %q", j.KeyType)
+	}
+	return nil
+}
+
+// fits returns true if the key type can verify the algorithm
+func (j *JWK) fits(algorithm string) bool {
+	switch algorithm {
+	case ALG_RS256:
+		return j.KeyType == "RSA"
+	case ALG_ES256:
+		return j.KeyType == "EC"
+	case ALG_EDDSA:
+		return j.KeyType == "OKP"
+	case ALG_HS256:
+		return j.KeyType == "oct"
+	default:
+		return false
+	}
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,168 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Supported signature algorithms
+const ALG_RS256 = "RS256"
+const ALG_ES256 = "ES256"
+const ALG_EDDSA = "EdDSA"
+const ALG_HS256 = "HS256"
+
+const DEFAULT_CLOCK_SKEW = time.Minute
+
+var ErrUnknownKey = errors.New("unknown signing key")
+var ErrAlgorithmNotAllowed = errors.New("algorithm not allowed")
+
+// Token is a JWT with a verified signature
+type Token struct {
+	Header    Header
+	Claims    Claims
+	signed    string
+	signature []byte
+}
+
+type Header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ"`
+}
+
+// Claims of a token, numbers are decoded as float64
+type Claims map[string]interface{}
+
+// Parse decodes a compact JWT without verifying it
+func Parse(token string) (*Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	t := &Token{signed: parts[0] + "." + parts[1]}
+	if err := decodeSegment(parts[0], &t.Header); err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	if err := decodeSegment(parts[1], &t.Claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	t.signature = signature
+	return t, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Verify checks the signature of the token with the key
+func (t *Token) Verify(key crypto.PublicKey) error {
+	sum := sha256.Sum256([]byte(t.signed))
+
+	switch t.Header.Algorithm {
+	case ALG_RS256:
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match algorithm %s", t.Header.Algorithm)
+		}
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, sum[:], t.signature)
+	case ALG_ES256:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || publicKey.Curve.Params().BitSize != 256 || len(t.signature) != 64 {
+			return fmt.Errorf("key does not match algorithm %s", t.Header.Algorithm)
+		}
+		r := new(big.Int).SetBytes(t.signature[:32])
+		s := new(big.Int).SetBytes(t.signature[32:])
+		if !ecdsa.Verify(publicKey, sum[:], r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case ALG_EDDSA:
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match algorithm %s", t.Header.Algorithm)
+		}
+		if !ed25519.Verify(publicKey, []byte(t.signed), t.signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case ALG_HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return fmt.Errorf("key does not match algorithm %s", t.Header.Algorithm)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(t.signed))
+		if !hmac.Equal(mac.Sum(nil), t.signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", t.Header.Algorithm)
+	}
+}
+
+// String returns the claim if it is a string
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// Time returns a NumericDate claim, ok is false if it is missing
+func (c Claims) Time(name string) (time.Time, bool, error) {
+	value, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("invalid %s claim", name)
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+}
+
+// Values returns a claim as list. Strings are split at spaces, e.g. the
+// scope claim of OAuth2.
+func (c Claims) Values(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			values = append(values, fmt.Sprint(v))
+		}
+		return values
+	case nil:
+		return nil
+	default:
+		return []string{fmt.Sprint(value)}
+	}
+}
+
+// Audiences returns the aud claim, which is a string or a list
+func (c Claims) Audiences() []string {
+	if audience, ok := c["aud"].(string); ok {
+		return []string{audience}
+	}
+	return c.Values("aud")
+}
@@ -0,0 +1,144 @@
+package jwt
+
+import (
+	"crypto"
+	"fmt"
+	"time"
+)
+
+// Operators of claim rules
+const CLAIM_EQUALS = "EQUALS"
+const CLAIM_CONTAINS = "CONTAINS"
+const CLAIM_EXISTS = "EXISTS"
+
+// Validator verifies tokens of a route. Keys are taken from the key set,
+// HS256 tokens are verified with the secret.
+type Validator struct {
+	Issuer         string
+	Audiences      []string
+	Algorithms     []string
+	Keys           *KeySet
+	Secret         []byte
+	ClockSkew      time.Duration
+	PrincipalClaim string
+	Rules          []ClaimRule
+}
+
+// ClaimRule requires a claim, e.g. scope CONTAINS orders:read
+type ClaimRule struct {
+	Claim    string
+	Operator string
+	Value    string
+}
+
+// Validate verifies the signature and the claims of the token
+func (v *Validator) Validate(token string) (*Token, error) {
+	t, err := Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	// The header is set by the client, its values are not echoed in errors
+	if !contains(v.Algorithms, t.Header.Algorithm) {
+		return nil, ErrAlgorithmNotAllowed
+	}
+
+	var key crypto.PublicKey
+	if t.Header.Algorithm == ALG_HS256 && len(v.Secret) > 0 {
+		key = v.Secret
+	} else if v.Keys != nil {
+		key, err = v.Keys.Key(t.Header.KeyID, t.Header.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, ErrUnknownKey
+	}
+	if err := t.Verify(key); err != nil {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	if err := v.checkClaims(t.Claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (v *Validator) checkClaims(claims Claims, now time.Time) error {
+	expiresAt, ok, err := claims.Time("exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("token without expiry")
+	}
+	if now.After(expiresAt.Add(v.ClockSkew)) {
+		return fmt.Errorf("token expired")
+	}
+	notBefore, ok, err := claims.Time("nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(v.ClockSkew).Before(notBefore) {
+		return fmt.Errorf("token not yet valid")
+	}
+	issuedAt, ok, err := claims.Time("iat")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(v.ClockSkew).Before(issuedAt) {
+		return fmt.Errorf("token issued in the future")
+	}
+
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return fmt.Errorf("invalid issuer")
+	}
+	if len(v.Audiences) > 0 && !containsAny(claims.Audiences(), v.Audiences) {
+		return fmt.Errorf("invalid audience")
+	}
+
+	for _, rule := range v.Rules {
+		if !rule.Match(claims) {
+			return fmt.Errorf("claim %s does not match", rule.Claim)
+		}
+	}
+	return nil
+}
+
+// Principal returns the claim identifying the caller, by default sub
+func (v *Validator) Principal(t *Token) string {
+	if v.PrincipalClaim == "" {
+		return t.Claims.String("sub")
+	}
+	return fmt.Sprint(t.Claims[v.PrincipalClaim])
+}
+
+// Match returns true if the claims satisfy the rule
+func (r ClaimRule) Match(claims Claims) bool {
+	value, ok := claims[r.Claim]
+	switch r.Operator {
+	case CLAIM_EXISTS:
+		return ok
+	case CLAIM_CONTAINS:
+		return contains(claims.Values(r.Claim), r.Value)
+	default:
+		return ok && fmt.Sprint(value) == r.Value
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(values []string, candidates []string) bool {
+	for _, candidate := range candidates {
+		if contains(values, candidate) {
+			return true
+		}
+	}
+	return false
+}
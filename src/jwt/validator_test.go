@@ -0,0 +1,210 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(t *testing.T, header map[string]interface{}, claims Claims, secret []byte) string {
+	t.Helper()
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signES256(t *testing.T, keyID string, claims Claims, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	signed := encodeSegment(t, map[string]interface{}{"alg": ALG_ES256, "kid": keyID}) + "." + encodeSegment(t, claims)
+	sum := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func hs256Header() map[string]interface{} {
+	return map[string]interface{}{"alg": ALG_HS256, "typ": "JWT"}
+}
+
+func validClaims(now time.Time) Claims {
+	return Claims{
+		"iss":   "https://issuer.example",
+		"aud":   "orders",
+		"sub":   "user-1",
+		"email": "user@example.com",
+		"scope": "orders:read orders:write",
+		"exp":   float64(now.Add(time.Hour).Unix()),
+		"iat":   float64(now.Unix()),
+	}
+}
+
+func with(claims Claims, name string, value interface{}) Claims {
+	copied := Claims{}
+	for k, v := range claims {
+		copied[k] = v
+	}
+	if value == nil {
+		delete(copied, name)
+	} else {
+		copied[name] = value
+	}
+	return copied
+}
+
+func newTestValidator() *Validator {
+	return &Validator{
+		Issuer:     "https://issuer.example",
+		Audiences:  []string{"orders"},
+		Algorithms: []string{ALG_HS256},
+		Secret:     testSecret,
+		ClockSkew:  DEFAULT_CLOCK_SKEW,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Now()
+	claims := validClaims(now)
+
+	tests := []struct {
+		name    string
+		token   string
+		rules   []ClaimRule
+		wantErr string
+	}{
+		{name: "valid token", token: signHS256(t, hs256Header(), claims, testSecret)},
+		{name: "malformed token", token: "a.b", wantErr: "malformed token"},
+		{name: "wrong secret", token: signHS256(t, hs256Header(), claims, []byte("other")), wantErr: "invalid signature"},
+		{name: "algorithm none", token: encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, claims) + ".", wantErr: "algorithm not allowed"},
+		{name: "algorithm not allowed", token: signHS256(t, map[string]interface{}{"alg": ALG_RS256}, claims, testSecret), wantErr: "algorithm not allowed"},
+		{name: "expired", token: signHS256(t, hs256Header(), with(claims, "exp", float64(now.Add(-2*time.Minute).Unix())), testSecret), wantErr: "token expired"},
+		{name: "expired within clock skew", token: signHS256(t, hs256Header(), with(claims, "exp", float64(now.Add(-30*time.Second).Unix())), testSecret)},
+		{name: "without expiry", token: signHS256(t, hs256Header(), with(claims, "exp", nil), testSecret), wantErr: "token without expiry"},
+		{name: "invalid expiry", token: signHS256(t, hs256Header(), with(claims, "exp", "tomorrow"), testSecret), wantErr: "invalid exp claim"},
+		{name: "not yet valid", token: signHS256(t, hs256Header(), with(claims, "nbf", float64(now.Add(5*time.Minute).Unix())), testSecret), wantErr: "token not yet valid"},
+		{name: "issued in the future", token: signHS256(t, hs256Header(), with(claims, "iat", float64(now.Add(5*time.Minute).Unix())), testSecret), wantErr: "token issued in the future"},
+		{name: "invalid issuer", token: signHS256(t, hs256Header(), with(claims, "iss", "https://other.example"), testSecret), wantErr: "invalid issuer"},
+		{name: "invalid audience", token: signHS256(t, hs256Header(), with(claims, "aud", "billing"), testSecret), wantErr: "invalid audience"},
+		{name: "audience list", token: signHS256(t, hs256Header(), with(claims, "aud", []string{"billing", "orders"}), testSecret)},
+		{
+			name:  "matching claim rules",
+			token: signHS256(t, hs256Header(), claims, testSecret),
+			rules: []ClaimRule{
+				{Claim: "scope", Operator: CLAIM_CONTAINS, Value: "orders:read"},
+				{Claim: "email", Operator: CLAIM_EQUALS, Value: "user@example.com"},
+				{Claim: "sub", Operator: CLAIM_EXISTS},
+			},
+		},
+		{name: "scope missing", token: signHS256(t, hs256Header(), claims, testSecret), rules: []ClaimRule{{Claim: "scope", Operator: CLAIM_CONTAINS, Value: "orders:delete"}}, wantErr: "claim scope does not match"},
+		{name: "claim missing", token: signHS256(t, hs256Header(), claims, testSecret), rules: []ClaimRule{{Claim: "tenant", Operator: CLAIM_EXISTS}}, wantErr: "claim tenant does not match"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validator := newTestValidator()
+			validator.Rules = test.rules
+			_, err := validator.Validate(test.token)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("Validate() = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDoesNotEchoAlgorithm(t *testing.T) {
+	alg := `x","injected":"<script>`
+	token := signHS256(t, map[string]interface{}{"alg": alg}, validClaims(time.Now()), testSecret)
+	_, err := newTestValidator().Validate(token)
+	if !errors.Is(err, ErrAlgorithmNotAllowed) {
+		t.Fatalf("Validate() = %v, want %v", err, ErrAlgorithmNotAllowed)
+	}
+	if strings.Contains(err.Error(), "injected") {
+		t.Fatalf("error %q contains the algorithm of the token", err)
+	}
+}
+
+func TestValidateKeySet(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := validClaims(time.Now())
+	validator := &Validator{
+		Algorithms: []string{ALG_ES256, ALG_HS256},
+		Keys:       &KeySet{keys: []JWK{{KeyType: "EC", KeyID: "key-1", Curve: "P-256", key: &key.PublicKey}}},
+		ClockSkew:  DEFAULT_CLOCK_SKEW,
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "key id of the set", token: signES256(t, "key-1", claims, key)},
+		{name: "token without key id", token: signES256(t, "", claims, key)},
+		{name: "unknown key id", token: signES256(t, "key-2", claims, key), wantErr: ErrUnknownKey.Error()},
+		{name: "signed with another key", token: signES256(t, "key-1", claims, other), wantErr: "invalid signature"},
+		// Without secret HS256 tokens need an oct key, the public EC key
+		// cannot be used as HMAC secret
+		{name: "HS256 without secret", token: signHS256(t, hs256Header(), claims, testSecret), wantErr: ErrUnknownKey.Error()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := validator.Validate(test.token)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("Validate() = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	token := &Token{Claims: Claims{"sub": "user-1", "client_id": "service-1"}}
+	if principal := (&Validator{}).Principal(token); principal != "user-1" {
+		t.Errorf("Principal() = %q, want user-1", principal)
+	}
+	if principal := (&Validator{PrincipalClaim: "client_id"}).Principal(token); principal != "service-1" {
+		t.Errorf("Principal() = %q, want service-1", principal)
+	}
+}
@@ -2,9 +2,18 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/secnex/secnex-api-gateway/api"
+	"github.com/secnex/secnex-api-gateway/audit"
+	"github.com/secnex/secnex-api-gateway/ban"
+	"github.com/secnex/secnex-api-gateway/certs"
 	"github.com/secnex/secnex-api-gateway/db"
+	"github.com/secnex/secnex-api-gateway/geoip"
+	"github.com/secnex/secnex-api-gateway/metrics"
+	"github.com/secnex/secnex-api-gateway/middleware"
+	"github.com/secnex/secnex-api-gateway/secrets"
+	"github.com/secnex/secnex-api-gateway/tracing"
 )
 
 const SERVER = "SGW01"
@@ -17,6 +26,20 @@ func main() {
 		log.Fatalf("Error connecting to database: %s", err)
 	}
 	defer cnx.Connection.Close()
+	cnx.Secrets, err = secrets.NewKeyringEnv()
+	if err != nil {
+		log.Fatalf("Error loading master key: %s", err)
+	}
+	if cnx.Secrets == nil {
+		log.Println("WARNING: no master key configured, secrets in the database are read in plaintext and new secrets cannot be stored")
+	}
+	if len(os.Args) > 1 {
+		if err := runCommand(cnx, os.Args[1:]); err != nil {
+			log.Fatalf("Error running %s: %s", os.Args[1], err)
+		}
+		return
+	}
+
 	serverConfig, err := cnx.GetServerConfiguration(SERVER)
 	if err != nil {
 		log.Fatalf("Error getting server configuration: %s", err)
@@ -27,7 +50,74 @@ func main() {
 		log.Fatalf("Error getting routes: %s", err)
 	}
 
+	geo, err := geoip.NewResolverEnv()
+	if err != nil {
+		log.Fatalf("Error loading GeoIP databases: %s", err)
+	}
+
+	auditLog, err := audit.NewLoggerEnv(cnx)
+	if err != nil {
+		log.Fatalf("Error configuring audit log: %s", err)
+	}
+
+	bans, err := ban.NewManagerEnv(cnx)
+	if err != nil {
+		log.Fatalf("Error configuring automatic bans: %s", err)
+	}
+	if bans != nil {
+		bans.Audit = auditLog
+		if err := bans.Sync(); err != nil {
+			log.Fatalf("Error loading bans: %s", err)
+		}
+	}
+
+	accessLog, err := middleware.NewAccessLogEnv()
+	if err != nil {
+		log.Fatalf("Error configuring access log: %s", err)
+	}
+
+	tracer, err := tracing.NewTracerEnv()
+	if err != nil {
+		log.Fatalf("Error configuring tracing: %s", err)
+	}
+
 	server := api.NewServer(serverConfig, cnx)
+	server.AccessLog = accessLog
+	server.Tracer = tracer
+	server.Audit = auditLog
+	// An empty ADMIN_ADDRESS disables the admin listener
+	adminAddress, ok := os.LookupEnv("ADMIN_ADDRESS")
+	if !ok {
+		adminAddress = ":9090"
+	}
+	server.AdminAddress = adminAddress
+	server.AdminAuth, err = api.NewAdminAuthEnv(cnx)
+	if err != nil {
+		log.Fatalf("Error configuring admin API: %s", err)
+	}
+	metrics.RegisterDBStats(cnx.Connection)
+	server.GeoIP = geo
+	server.BanManager = bans
+	if serverConfig.TLSEnabled {
+		store := certs.NewStore(cnx, serverConfig.ID, serverConfig.TLSCertFile.String, serverConfig.TLSKeyFile.String)
+		acmeManager, err := certs.NewACMEManagerEnv(cnx, store, serverConfig.ID)
+		if err != nil {
+			log.Fatalf("Error configuring ACME: %s", err)
+		}
+		// With ACME the certificates may not be issued yet
+		if _, err := store.Reload(); err != nil && acmeManager == nil {
+			log.Fatalf("Error loading certificates: %s", err)
+		}
+		server.TLSConfig, err = store.NewTLSConfig(serverConfig.TLSMinVersion, serverConfig.TLSCipherSuites, serverConfig.TLSClientAuth)
+		if err != nil {
+			log.Fatalf("Error configuring TLS: %s", err)
+		}
+		if acmeManager != nil {
+			acmeManager.ConfigureTLS(server.TLSConfig)
+		}
+		server.Certificates = store
+		server.ACME = acmeManager
+	}
 	server.SetRoutes(routes)
 	server.RunServer()
 }
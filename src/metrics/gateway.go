@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+var RequestsTotal = NewCounter("gateway_requests_total", "Requests handled by the gateway.", "route", "method", "status_class")
+var RequestDuration = NewHistogram("gateway_request_duration_seconds", "Total latency of requests handled by the gateway.", DefaultBuckets, "route", "method", "status_class")
+var UpstreamDuration = NewHistogram("gateway_upstream_duration_seconds", "Latency of the upstream targets.", DefaultBuckets, "route")
+var RequestsInFlight = NewGauge("gateway_requests_in_flight", "Requests currently handled by the gateway.")
+var FirewallRejections = NewCounter("gateway_firewall_rejections_total", "Requests rejected by the request checks.", "reason")
+var AuthFailures = NewCounter("gateway_auth_failures_total", "Requests rejected because of missing or invalid credentials.", "route")
+var RouteRefreshDuration = NewHistogram("gateway_route_refresh_duration_seconds", "Duration of route refreshes from the database.", DefaultBuckets)
+var RouteRefreshErrors = NewCounter("gateway_route_refresh_errors_total", "Failed route refreshes.")
+var CSPReports = NewCounter("gateway_csp_reports_total", "Content Security Policy violation reports.", "route")
+
+// Methods which are used as label values, other methods are counted as
+// OTHER so clients cannot create new series
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// StatusClass returns the class of a status code, e.g. 2xx
+func StatusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// Method returns the label value of a request method
+func Method(method string) string {
+	if standardMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// RegisterDBStats exposes the connection pool statistics of the database
+func RegisterDBStats(db *sql.DB) {
+	DefaultRegistry.Register(CollectorFunc(func(w io.Writer) {
+		stats := db.Stats()
+		WriteSample(w, "gateway_db_max_open_connections", "Maximum number of open database connections.", "gauge", float64(stats.MaxOpenConnections))
+		WriteSample(w, "gateway_db_open_connections", "Established database connections.", "gauge", float64(stats.OpenConnections))
+		WriteSample(w, "gateway_db_in_use_connections", "Database connections currently in use.", "gauge", float64(stats.InUse))
+		WriteSample(w, "gateway_db_idle_connections", "Idle database connections.", "gauge", float64(stats.Idle))
+		WriteSample(w, "gateway_db_wait_count_total", "Database connections waited for.", "counter", float64(stats.WaitCount))
+		WriteSample(w, "gateway_db_wait_duration_seconds_total", "Time spent waiting for database connections.", "counter", stats.WaitDuration.Seconds())
+		WriteSample(w, "gateway_db_max_idle_closed_total", "Database connections closed due to the idle limit.", "counter", float64(stats.MaxIdleClosed))
+		WriteSample(w, "gateway_db_max_lifetime_closed_total", "Database connections closed due to the lifetime limit.", "counter", float64(stats.MaxLifetimeClosed))
+	}))
+}
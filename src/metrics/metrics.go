@@ -0,0 +1,238 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector writes its samples in the Prometheus text exposition format
+type Collector interface {
+	Write(w io.Writer)
+}
+
+// Registry holds the collectors exposed on the metrics endpoint
+type Registry struct {
+	collectors []Collector
+	mu         sync.Mutex
+}
+
+var DefaultRegistry = &Registry{}
+
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func (r *Registry) Register(collector Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collector)
+}
+
+// Handler serves the samples of all collectors
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.mu.Lock()
+		collectors := append([]Collector{}, r.collectors...)
+		r.mu.Unlock()
+		for _, collector := range collectors {
+			collector.Write(w)
+		}
+	})
+}
+
+// CollectorFunc adapts a function to the Collector interface
+type CollectorFunc func(w io.Writer)
+
+func (f CollectorFunc) Write(w io.Writer) {
+	f(w)
+}
+
+// series stores the label values of a sample
+type series struct {
+	labels []string
+	value  float64
+}
+
+// Counter is a monotonically increasing value per label combination
+type Counter struct {
+	Name   string
+	Help   string
+	Labels []string
+	kind   string
+	series map[string]*series
+	mu     sync.Mutex
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{Name: name, Help: help, Labels: labels, kind: "counter", series: map[string]*series{}}
+	DefaultRegistry.Register(c)
+	return c
+}
+
+// Gauge is a value which can go up and down
+type Gauge struct {
+	Counter
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{Counter{Name: name, Help: help, Labels: labels, kind: "gauge", series: map[string]*series{}}}
+	DefaultRegistry.Register(g)
+	return g
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) Add(value float64, labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(labels).value += value
+}
+
+func (g *Gauge) Dec(labels ...string) {
+	g.Add(-1, labels...)
+}
+
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labels).value = value
+}
+
+func (c *Counter) get(labels []string) *series {
+	key := strings.Join(labels, "\xff")
+	s, ok := c.series[key]
+	if !ok {
+		s = &series{labels: append([]string{}, labels...)}
+		c.series[key] = s
+	}
+	return s
+}
+
+func (c *Counter) Write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.Name, c.Help, c.kind)
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.Name, formatLabels(c.Labels, s.labels, "", ""), formatValue(s.value))
+	}
+}
+
+// Histogram counts observations in cumulative buckets per label combination
+type Histogram struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+	series  map[string]*histogramSeries
+	mu      sync.Mutex
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{Name: name, Help: help, Labels: labels, Buckets: buckets, series: map[string]*histogramSeries{}}
+	DefaultRegistry.Register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labels, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: append([]string{}, labels...), counts: make([]uint64, len(h.Buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.Buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.Name, h.Help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, s.labels, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, formatLabels(h.Labels, s.labels, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, formatLabels(h.Labels, s.labels, "", ""), s.count)
+	}
+}
+
+// WriteSample writes a single sample for collectors computed at scrape time
+func WriteSample(w io.Writer, name string, help string, kind string, value float64) {
+	writeHeader(w, name, help, kind)
+	fmt.Fprintf(w, "%s %s\n", name, formatValue(value))
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	pairs := []string{}
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+`="`+escapeLabel(value)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
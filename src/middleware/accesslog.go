@@ -0,0 +1,203 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+const LOG_FORMAT_LOGFMT = "logfmt"
+
+// Fields of the structured access log
+var AccessLogFields = []string{
+	"client_ip",
+	"method",
+	"path",
+	"protocol",
+	"user_agent",
+	"status",
+	"request_id",
+	"trace_id",
+	"route",
+	"target_url",
+	"key_id",
+	"country",
+	"asn",
+	"waf",
+	"upstream_status",
+	"upstream_latency_ms",
+	"latency_ms",
+	"bytes_in",
+	"bytes_out",
+}
+
+// AccessLog writes one structured record per request
+type AccessLog struct {
+	Format string
+	Fields []string
+	Logger *slog.Logger
+}
+
+// NewAccessLogEnv creates the access log from the LOG_* environment variables:
+//
+//	LOG_FORMAT=text|json|logfmt      record format, default text
+//	LOG_FIELDS=route,status,...      selected fields, default all
+//	LOG_OUTPUT=stdout|file:<path>|syslog[://host:port]
+//	LOG_MAX_SIZE=100                 file size in MB before rotation
+//	LOG_MAX_BACKUPS=5                number of rotated files to keep
+func NewAccessLogEnv() (*AccessLog, error) {
+	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
+	if format == "" {
+		format = LOG_FORMAT_TEXT
+	}
+
+	fields := AccessLogFields
+	if value := os.Getenv("LOG_FIELDS"); value != "" {
+		fields = []string{}
+		for _, field := range strings.Split(value, ",") {
+			fields = append(fields, strings.TrimSpace(field))
+		}
+	}
+
+	output, err := openOutput(os.Getenv("LOG_OUTPUT"))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAccessLog(format, fields, output)
+}
+
+func NewAccessLog(format string, fields []string, output io.Writer) (*AccessLog, error) {
+	a := &AccessLog{
+		Format: format,
+		Fields: fields,
+	}
+
+	switch format {
+	case LOG_FORMAT_TEXT:
+	case LOG_FORMAT_JSON:
+		a.Logger = slog.New(slog.NewJSONHandler(output, nil))
+	case LOG_FORMAT_LOGFMT:
+		a.Logger = slog.New(slog.NewTextHandler(output, nil))
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+
+	return a, nil
+}
+
+// openOutput opens the destination of the structured access log
+func openOutput(output string) (io.Writer, error) {
+	switch {
+	case output == "" || output == "stdout":
+		return os.Stdout, nil
+	case output == "stderr":
+		return os.Stderr, nil
+	case strings.HasPrefix(output, "file:"):
+		maxSize, err := envInt("LOG_MAX_SIZE", 100)
+		if err != nil {
+			return nil, err
+		}
+		maxBackups, err := envInt("LOG_MAX_BACKUPS", 5)
+		if err != nil {
+			return nil, err
+		}
+		return NewRotatingFile(strings.TrimPrefix(output, "file:"), int64(maxSize)*1024*1024, maxBackups)
+	case output == "syslog":
+		return openSyslog("")
+	case strings.HasPrefix(output, "syslog://"):
+		return openSyslog(strings.TrimPrefix(output, "syslog://"))
+	default:
+		return nil, fmt.Errorf("unknown log output %q", output)
+	}
+}
+
+func envInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return number, nil
+}
+
+// Middleware logs every request handled by next
+func (a *AccessLog) Middleware(next http.Handler) http.Handler {
+	if a.Logger == nil {
+		return LoggingMiddleware(next)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := WithRequestInfo(w, r)
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+		latency := time.Since(start)
+
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		values := map[string]slog.Attr{
+			"client_ip":           slog.String("client_ip", clientIP),
+			"method":              slog.String("method", r.Method),
+			"path":                slog.String("path", r.URL.Path),
+			"protocol":            slog.String("protocol", r.Proto),
+			"user_agent":          slog.String("user_agent", r.UserAgent()),
+			"status":              slog.Int("status", rw.statusCode),
+			"request_id":          slog.String("request_id", info.RequestID),
+			"trace_id":            slog.String("trace_id", info.TraceID),
+			"route":               slog.String("route", info.RouteName),
+			"target_url":          slog.String("target_url", info.TargetURL),
+			"key_id":              slog.String("key_id", info.KeyID),
+			"country":             slog.String("country", info.Country),
+			"asn":                 slog.String("asn", info.ASN),
+			"waf":                 slog.String("waf", info.WAF),
+			"upstream_status":     slog.Int("upstream_status", info.UpstreamStatus),
+			"upstream_latency_ms": slog.Float64("upstream_latency_ms", milliseconds(info.UpstreamLatency)),
+			"latency_ms":          slog.Float64("latency_ms", milliseconds(latency)),
+			"bytes_in":            slog.Int64("bytes_in", body.size),
+			"bytes_out":           slog.Int("bytes_out", rw.size),
+		}
+
+		attrs := make([]slog.Attr, 0, len(a.Fields))
+		for _, field := range a.Fields {
+			if attr, ok := values[field]; ok {
+				attrs = append(attrs, attr)
+			}
+		}
+		a.Logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// countingReader counts the bytes read from the request body
+type countingReader struct {
+	io.ReadCloser
+	size int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type contextKey string
+
+const requestInfoKey contextKey = "request-info"
+
+const HEADER_REQUEST_ID = "X-Request-ID"
+
+// Maximum length of a request id accepted from the client
+const MAX_REQUEST_ID_LENGTH = 128
+
+// RequestInfo collects details of the request during its processing which
+// are written to the access log
+type RequestInfo struct {
+	RequestID       string
+	TraceID         string
+	RouteName       string
+	TargetURL       string
+	KeyID           string
+	Principal       *Principal
+	Country         string
+	ASN             string
+	WAF             string
+	UpstreamStatus  int
+	UpstreamLatency time.Duration
+}
+
+// Principal is the authenticated caller of a request, e.g. the id of an API
+// key or the subject of a token
+type Principal struct {
+	ID string
+	// Authentication methods which succeeded, e.g. mtls or jwt
+	Methods []string
+	// Identity headers forwarded to the target
+	Headers map[string]string
+}
+
+// WithRequestInfo attaches a new RequestInfo to the request. The request id
+// of the client is kept if it is valid, otherwise a new one is generated. It
+// is set on the request to be forwarded to the target and on the response.
+func WithRequestInfo(w http.ResponseWriter, r *http.Request) (*http.Request, *RequestInfo) {
+	info := &RequestInfo{RequestID: r.Header.Get(HEADER_REQUEST_ID)}
+	if !validRequestID(info.RequestID) {
+		info.RequestID = uuid.New().String()
+	}
+	r.Header.Set(HEADER_REQUEST_ID, info.RequestID)
+	w.Header().Set(HEADER_REQUEST_ID, info.RequestID)
+
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)), info
+}
+
+// validRequestID accepts ids of letters, digits and the characters - _ . :
+// which are safe to write to logs and response bodies
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// GetRequestInfo returns the RequestInfo of the request. Requests outside of
+// the logging middleware get a detached instance.
+func GetRequestInfo(r *http.Request) *RequestInfo {
+	if info, ok := r.Context().Value(requestInfoKey).(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"time"
@@ -16,10 +17,19 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 		httpVersion := r.Proto
 		userAgent := r.UserAgent()
 
+		r, info := WithRequestInfo(w, r)
 		rw := NewResponseWriter(w)
 		next.ServeHTTP(rw, r)
 		duration := time.Since(start).Milliseconds()
-		log.Printf("%s - \"%s %s %s - %s\" %d bytes -> %s %d in %dms\n",
+		geo := ""
+		if info.Country != "" || info.ASN != "" {
+			geo = fmt.Sprintf(" [%s AS%s]", info.Country, info.ASN)
+		}
+		trace := ""
+		if info.TraceID != "" {
+			trace = " trace=" + info.TraceID
+		}
+		log.Printf("%s - \"%s %s %s - %s\" %d bytes -> %s %d in %dms request_id=%s%s%s\n",
 			clientIP,
 			method,
 			urlPath,
@@ -29,6 +39,9 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 			http.StatusText(rw.statusCode),
 			rw.statusCode,
 			duration,
+			info.RequestID,
+			geo,
+			trace,
 		)
 	})
 }
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/metrics"
+)
+
+// MetricsMiddleware records request counts and latencies. It expects the
+// RequestInfo of the logging middleware to label requests by route.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		metrics.RequestsInFlight.Inc()
+		defer metrics.RequestsInFlight.Dec()
+
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		info := GetRequestInfo(r)
+		method := metrics.Method(r.Method)
+		statusClass := metrics.StatusClass(rw.statusCode)
+		metrics.RequestsTotal.Inc(info.RouteName, method, statusClass)
+		metrics.RequestDuration.Observe(time.Since(start).Seconds(), info.RouteName, method, statusClass)
+		if info.UpstreamStatus != 0 {
+			metrics.UpstreamDuration.Observe(info.UpstreamLatency.Seconds(), info.RouteName)
+		}
+	})
+}
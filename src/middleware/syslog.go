@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+
+package middleware
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to the local syslog daemon or, with an address, to a
+// remote one over UDP
+func openSyslog(address string) (io.Writer, error) {
+	if address == "" {
+		return syslog.New(syslog.LOG_INFO|syslog.LOG_LOCAL0, "secnex-gateway")
+	}
+	return syslog.Dial("udp", address, syslog.LOG_INFO|syslog.LOG_LOCAL0, "secnex-gateway")
+}
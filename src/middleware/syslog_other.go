@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package middleware
+
+import (
+	"fmt"
+	"io"
+)
+
+// openSyslog fails, log/syslog is not available on this platform
+func openSyslog(address string) (io.Writer, error) {
+	return nil, fmt.Errorf("log output syslog is not supported on this platform")
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/secnex/secnex-api-gateway/tracing"
+)
+
+// TracingMiddleware starts the server span of every request and continues
+// the trace of a valid traceparent header. It expects the RequestInfo of the
+// logging middleware to add the trace id to the access log.
+func TracingMiddleware(tracer *tracing.Tracer, next http.Handler) http.Handler {
+	if tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var remote *tracing.SpanContext
+		if parent, ok := tracing.ParseTraceparent(r.Header.Get(tracing.HEADER_TRACEPARENT)); ok {
+			parent.TraceState = r.Header.Get(tracing.HEADER_TRACESTATE)
+			remote = &parent
+		}
+
+		ctx, span := tracer.StartRoot(r.Context(), r.Method, remote)
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		info := GetRequestInfo(r)
+		info.TraceID = span.TraceID()
+
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		if info.RouteName != "" {
+			span.SetName(r.Method + " " + info.RouteName)
+			span.SetAttribute("gateway.route", info.RouteName)
+		}
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("client.address", r.RemoteAddr)
+		span.SetAttribute("user_agent.original", r.UserAgent())
+		span.SetAttribute("http.response.status_code", rw.statusCode)
+		if rw.statusCode >= http.StatusInternalServerError {
+			span.SetError(http.StatusText(rw.statusCode))
+		}
+	})
+}
@@ -0,0 +1,423 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/jwt"
+)
+
+// Paths below the route handled by the gateway
+const CALLBACK_PATH = "oauth2/callback"
+const LOGOUT_PATH = "oauth2/sign_out"
+
+// Identity headers forwarded to the target. They are removed from every
+// incoming request of a route with OIDC login.
+const HEADER_USER = "X-Auth-Request-User"
+const HEADER_EMAIL = "X-Auth-Request-Email"
+const HEADER_PREFERRED_USERNAME = "X-Auth-Request-Preferred-Username"
+const HEADER_GROUPS = "X-Auth-Request-Groups"
+
+const DEFAULT_COOKIE_NAME = "_gateway_session"
+const DEFAULT_SESSION_LIFETIME = 8 * time.Hour
+
+// Time a login may take from the redirect to the callback
+const LOGIN_TIMEOUT = 10 * time.Minute
+
+// Results of a refresh are shared by the parallel requests of a session, so
+// rotating refresh tokens are only used once
+const REFRESH_REUSE = 30 * time.Second
+
+var ErrLoginRequired = errors.New("login required")
+
+// ErrLoginFailed is the error of failed callbacks returned to clients. The
+// causes contain values of the client and the provider and are only logged.
+var ErrLoginFailed = errors.New("login failed")
+
+var IdentityHeaders = []string{HEADER_USER, HEADER_EMAIL, HEADER_PREFERRED_USERNAME, HEADER_GROUPS}
+
+// Config of the login of a route
+type Config struct {
+	Issuer                string
+	ClientID              string
+	ClientSecret          string
+	RedirectURL           string
+	PostLogoutRedirectURL string
+	Scopes                []string
+	CookieName            string
+	CookieSecret          string
+	SessionLifetime       time.Duration
+	ClockSkew             time.Duration
+	PassAccessToken       bool
+}
+
+// Client protects a route with the authorization code flow with PKCE.
+// Sessions are stored encrypted in cookies scoped to the path of the route,
+// expired access tokens are refreshed with the refresh token.
+type Client struct {
+	Config    Config
+	codec     *cookieCodec
+	refreshed map[string]refreshResult
+	mu        sync.Mutex
+}
+
+type refreshResult struct {
+	session *Session
+	err     error
+	at      time.Time
+}
+
+func NewClient(config Config) (*Client, error) {
+	if config.Issuer == "" || config.ClientID == "" {
+		return nil, fmt.Errorf("issuer and client id required")
+	}
+	if config.CookieName == "" {
+		config.CookieName = DEFAULT_COOKIE_NAME
+	}
+	if config.SessionLifetime <= 0 {
+		config.SessionLifetime = DEFAULT_SESSION_LIFETIME
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	codec, err := newCookieCodec(config.CookieSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Config: config, codec: codec, refreshed: map[string]refreshResult{}}, nil
+}
+
+// Session returns the session of the request. Expired access tokens are
+// refreshed and the cookie is updated. The error is ErrLoginRequired if the
+// user has to log in.
+func (c *Client) Session(w http.ResponseWriter, r *http.Request, prefix string) (*Session, error) {
+	value := readCookie(r, c.Config.CookieName)
+	if value == "" {
+		return nil, ErrLoginRequired
+	}
+	session := &Session{}
+	if err := c.codec.open(c.Config.CookieName, value, session); err != nil {
+		return nil, ErrLoginRequired
+	}
+	now := time.Now()
+	if now.Unix() >= session.SessionExpiresAt {
+		return nil, ErrLoginRequired
+	}
+	if !session.Expired(now) {
+		return session, nil
+	}
+	if session.RefreshToken == "" {
+		return nil, ErrLoginRequired
+	}
+
+	refreshed, err := c.refresh(session)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrLoginRequired, err)
+	}
+	if err := c.writeSession(w, r, prefix, refreshed); err != nil {
+		return nil, err
+	}
+	return refreshed, nil
+}
+
+// Login redirects the browser to the provider. The requested URL is
+// restored after the callback.
+func (c *Client) Login(w http.ResponseWriter, r *http.Request, prefix string) error {
+	provider, err := Discover(c.Config.Issuer)
+	if err != nil {
+		return err
+	}
+
+	state := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString(),
+		ReturnTo: r.URL.RequestURI(),
+	}
+	sealed, err := c.codec.seal(c.stateCookie(), state)
+	if err != nil {
+		return err
+	}
+	cookie := c.cookie(r, prefix, c.stateCookie())
+	cookie.MaxAge = int(LOGIN_TIMEOUT.Seconds())
+	writeCookie(w, r, cookie, sealed)
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.Config.ClientID},
+		"redirect_uri":          {c.redirectURL(r, prefix)},
+		"scope":                 {strings.Join(c.Config.Scopes, " ")},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, withQuery(provider.AuthorizationEndpoint, query), http.StatusFound)
+	return nil
+}
+
+// Callback completes the login, creates the session and redirects the
+// browser to the URL requested before the login
+func (c *Client) Callback(w http.ResponseWriter, r *http.Request, prefix string) error {
+	value := readCookie(r, c.stateCookie())
+	// The state is used once
+	writeCookie(w, r, c.cookie(r, prefix, c.stateCookie()), "")
+	if value == "" {
+		return fmt.Errorf("login state missing")
+	}
+	state := loginState{}
+	if err := c.codec.open(c.stateCookie(), value, &state); err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	if query.Get("state") != state.State {
+		return fmt.Errorf("login state mismatch")
+	}
+	if message := query.Get("error"); message != "" {
+		return fmt.Errorf("%w: provider error %q %q", ErrLoginFailed, message, query.Get("error_description"))
+	}
+
+	provider, err := Discover(c.Config.Issuer)
+	if err != nil {
+		return err
+	}
+	token, err := provider.Token(c.Config.ClientID, c.Config.ClientSecret, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {c.redirectURL(r, prefix)},
+		"code_verifier": {state.Verifier},
+	})
+	if err != nil {
+		return err
+	}
+	session, err := c.newSession(provider, token, nil)
+	if err != nil {
+		return err
+	}
+	claims, _ := jwt.Parse(token.IDToken)
+	if claims == nil || claims.Claims.String("nonce") != state.Nonce {
+		return fmt.Errorf("nonce mismatch")
+	}
+
+	if err := c.writeSession(w, r, prefix, session); err != nil {
+		return err
+	}
+	returnTo := state.ReturnTo
+	if !strings.HasPrefix(returnTo, prefix) || strings.HasPrefix(returnTo, prefix+"/"+CALLBACK_PATH) {
+		returnTo = prefix + "/"
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+	return nil
+}
+
+// Logout removes the session and ends it at the provider if supported
+func (c *Client) Logout(w http.ResponseWriter, r *http.Request, prefix string) {
+	idToken := ""
+	session := &Session{}
+	if value := readCookie(r, c.Config.CookieName); value != "" && c.codec.open(c.Config.CookieName, value, session) == nil {
+		idToken = session.IDToken
+	}
+	writeCookie(w, r, c.cookie(r, prefix, c.Config.CookieName), "")
+
+	target := c.Config.PostLogoutRedirectURL
+	if provider, err := Discover(c.Config.Issuer); err == nil && provider.EndSessionEndpoint != "" {
+		query := url.Values{"client_id": {c.Config.ClientID}}
+		if idToken != "" {
+			query.Set("id_token_hint", idToken)
+		}
+		if target != "" {
+			query.Set("post_logout_redirect_uri", target)
+		}
+		target = withQuery(provider.EndSessionEndpoint, query)
+	}
+	if target == "" {
+		target = prefix + "/"
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// ForwardIdentity sets the identity headers of the session for the target
+func (c *Client) ForwardIdentity(r *http.Request, session *Session) {
+	r.Header.Set(HEADER_USER, session.Subject)
+	if session.Email != "" {
+		r.Header.Set(HEADER_EMAIL, session.Email)
+	}
+	if session.PreferredUsername != "" {
+		r.Header.Set(HEADER_PREFERRED_USERNAME, session.PreferredUsername)
+	}
+	if len(session.Groups) > 0 {
+		r.Header.Set(HEADER_GROUPS, strings.Join(session.Groups, ","))
+	}
+	if c.Config.PassAccessToken && session.AccessToken != "" {
+		r.Header.Set("Authorization", "Bearer "+session.AccessToken)
+	}
+}
+
+// RemoveCookies removes the cookies of the gateway from the request, the
+// target never sees the session
+func (c *Client) RemoveCookies(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if isCookie(cookie.Name, c.Config.CookieName) || isCookie(cookie.Name, c.stateCookie()) {
+			continue
+		}
+		r.AddCookie(cookie)
+	}
+}
+
+// IsBrowser returns true for requests of a browser navigating to a page,
+// which are redirected to the login instead of being rejected
+func IsBrowser(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func (c *Client) newSession(provider *Provider, token TokenResponse, previous *Session) (*Session, error) {
+	now := time.Now()
+	session := &Session{
+		IDToken:          token.IDToken,
+		AccessToken:      token.AccessToken,
+		RefreshToken:     token.RefreshToken,
+		SessionExpiresAt: now.Add(c.Config.SessionLifetime).Unix(),
+	}
+	if token.ExpiresIn > 0 {
+		session.ExpiresAt = now.Unix() + token.ExpiresIn
+	}
+	if previous != nil {
+		// Refresh responses may omit the ID token and the refresh token
+		session.SessionExpiresAt = previous.SessionExpiresAt
+		if session.RefreshToken == "" {
+			session.RefreshToken = previous.RefreshToken
+		}
+		if session.IDToken == "" {
+			session.IDToken = previous.IDToken
+			session.Subject = previous.Subject
+			session.Email = previous.Email
+			session.Name = previous.Name
+			session.PreferredUsername = previous.PreferredUsername
+			session.Groups = previous.Groups
+			return session, nil
+		}
+	}
+	if session.IDToken == "" {
+		return nil, fmt.Errorf("id token missing")
+	}
+
+	validator := &jwt.Validator{
+		Issuer:     provider.Issuer,
+		Audiences:  []string{c.Config.ClientID},
+		Algorithms: []string{jwt.ALG_RS256, jwt.ALG_ES256, jwt.ALG_EDDSA, jwt.ALG_HS256},
+		Keys:       provider.Keys,
+		Secret:     []byte(c.Config.ClientSecret),
+		ClockSkew:  c.Config.ClockSkew,
+	}
+	idToken, err := validator.Validate(session.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("id token: %w", err)
+	}
+	if previous != nil && idToken.Claims.String("sub") != previous.Subject {
+		return nil, fmt.Errorf("id token of another subject")
+	}
+	session.Subject = idToken.Claims.String("sub")
+	session.Email = idToken.Claims.String("email")
+	session.Name = idToken.Claims.String("name")
+	session.PreferredUsername = idToken.Claims.String("preferred_username")
+	session.Groups = idToken.Claims.Values("groups")
+	return session, nil
+}
+
+// refresh obtains a new access token. Parallel requests with the same
+// refresh token share the result.
+func (c *Client) refresh(session *Session) (*Session, error) {
+	sum := sha256.Sum256([]byte(session.RefreshToken))
+	key := string(sum[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, result := range c.refreshed {
+		if time.Since(result.at) > REFRESH_REUSE {
+			delete(c.refreshed, k)
+		}
+	}
+	if result, ok := c.refreshed[key]; ok {
+		return result.session, result.err
+	}
+
+	provider, err := Discover(c.Config.Issuer)
+	var refreshed *Session
+	if err == nil {
+		var token TokenResponse
+		token, err = provider.Token(c.Config.ClientID, c.Config.ClientSecret, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {session.RefreshToken},
+		})
+		if err == nil {
+			refreshed, err = c.newSession(provider, token, session)
+		}
+	}
+	c.refreshed[key] = refreshResult{session: refreshed, err: err, at: time.Now()}
+	return refreshed, err
+}
+
+func (c *Client) writeSession(w http.ResponseWriter, r *http.Request, prefix string, session *Session) error {
+	sealed, err := c.codec.seal(c.Config.CookieName, session)
+	if err != nil {
+		return err
+	}
+	cookie := c.cookie(r, prefix, c.Config.CookieName)
+	cookie.Expires = time.Unix(session.SessionExpiresAt, 0)
+	writeCookie(w, r, cookie, sealed)
+	return nil
+}
+
+func (c *Client) cookie(r *http.Request, prefix string, name string) http.Cookie {
+	return http.Cookie{
+		Name:     name,
+		Path:     prefix,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (c *Client) stateCookie() string {
+	return c.Config.CookieName + "_state"
+}
+
+// redirectURL returns the configured callback URL or the callback below
+// the route on the host of the request
+func (c *Client) redirectURL(r *http.Request, prefix string) string {
+	if c.Config.RedirectURL != "" {
+		return c.Config.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s/%s", scheme, r.Host, prefix, CALLBACK_PATH)
+}
+
+func withQuery(endpoint string, query url.Values) string {
+	separator := "?"
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+	return endpoint + separator + query.Encode()
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
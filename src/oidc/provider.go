@@ -0,0 +1,155 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/secnex/secnex-api-gateway/jwt"
+)
+
+// Discovery documents are fetched again after this time
+const DISCOVERY_TTL = 24 * time.Hour
+
+// Failed discoveries are retried after this time at the earliest
+const DISCOVERY_RETRY = 10 * time.Second
+
+// Maximum size of discovery documents and token responses
+const MAX_RESPONSE_SIZE = 1 << 20
+
+// Provider is the discovered configuration of an OpenID provider
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	Keys                  *jwt.KeySet
+	fetchedAt             time.Time
+}
+
+// TokenResponse is the response of the token endpoint
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+type discovery struct {
+	provider  *Provider
+	failedAt  time.Time
+	lastError error
+}
+
+// Providers are shared by all routes with the same issuer
+var providers = map[string]*discovery{}
+var providersMu sync.Mutex
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Discover returns the configuration of the issuer from its
+// .well-known/openid-configuration document
+func Discover(issuer string) (*Provider, error) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	current, ok := providers[issuer]
+	if !ok {
+		current = &discovery{}
+		providers[issuer] = current
+	}
+	if current.provider != nil && time.Since(current.provider.fetchedAt) < DISCOVERY_TTL {
+		return current.provider, nil
+	}
+	if current.lastError != nil && time.Since(current.failedAt) < DISCOVERY_RETRY {
+		if current.provider != nil {
+			return current.provider, nil
+		}
+		return nil, current.lastError
+	}
+
+	provider, err := fetchProvider(issuer)
+	if err != nil {
+		current.failedAt = time.Now()
+		current.lastError = fmt.Errorf("discovery of %s: %w", issuer, err)
+		// An outdated configuration is better than none
+		if current.provider != nil {
+			return current.provider, nil
+		}
+		return nil, current.lastError
+	}
+	current.provider = provider
+	current.lastError = nil
+	return provider, nil
+}
+
+func fetchProvider(issuer string) (*Provider, error) {
+	response, err := httpClient.Get(strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	provider := &Provider{}
+	data, err := io.ReadAll(io.LimitReader(response.Body, MAX_RESPONSE_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != issuer {
+		return nil, fmt.Errorf("issuer mismatch %q", provider.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete configuration")
+	}
+	provider.Keys = jwt.NewRemoteKeySet(provider.JWKSURI, 0)
+	provider.fetchedAt = time.Now()
+	return provider, nil
+}
+
+// Token calls the token endpoint with the client credentials
+func (p *Provider) Token(clientId string, clientSecret string, form url.Values) (TokenResponse, error) {
+	request, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(clientId), url.QueryEscape(clientSecret))
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	defer response.Body.Close()
+
+	token := TokenResponse{}
+	data, err := io.ReadAll(io.LimitReader(response.Body, MAX_RESPONSE_SIZE))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return TokenResponse{}, fmt.Errorf("token endpoint status %d: %w", response.StatusCode, err)
+	}
+	if token.Error != "" {
+		return TokenResponse{}, fmt.Errorf("token endpoint: %q %q", token.Error, token.Description)
+	}
+	if response.StatusCode != http.StatusOK {
+		return TokenResponse{}, fmt.Errorf("token endpoint status %d", response.StatusCode)
+	}
+	return token, nil
+}
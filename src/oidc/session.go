@@ -0,0 +1,183 @@
+package oidc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Browsers limit cookies to about 4 KB, larger values are split
+const MAX_COOKIE_SIZE = 3800
+
+// Session is the login of a user, stored encrypted in a cookie
+type Session struct {
+	Subject           string   `json:"sub"`
+	Email             string   `json:"email,omitempty"`
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	IDToken           string   `json:"id_token,omitempty"`
+	AccessToken       string   `json:"access_token,omitempty"`
+	RefreshToken      string   `json:"refresh_token,omitempty"`
+	// Expiry of the access token and of the session, Unix seconds
+	ExpiresAt        int64 `json:"exp,omitempty"`
+	SessionExpiresAt int64 `json:"session_exp"`
+}
+
+// loginState is kept in a cookie between the redirect to the provider and
+// the callback
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+}
+
+// Expired returns true if the access token expired
+func (s *Session) Expired(now time.Time) bool {
+	return s.ExpiresAt > 0 && now.Unix() >= s.ExpiresAt
+}
+
+// Principal returns the preferred name of the user for logs
+func (s *Session) Principal() string {
+	for _, principal := range []string{s.Email, s.PreferredUsername, s.Subject} {
+		if principal != "" {
+			return principal
+		}
+	}
+	return "unknown"
+}
+
+// cookieCodec encrypts cookie values with AES-GCM. The cookie name is
+// authenticated, so values cannot be moved between cookies.
+type cookieCodec struct {
+	aead cipher.AEAD
+}
+
+func newCookieCodec(secret string) (*cookieCodec, error) {
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("cookie secret must have at least 16 characters")
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cookieCodec{aead: aead}, nil
+}
+
+func (c *cookieCodec) seal(name string, value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, data, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (c *cookieCodec) open(name string, encoded string, value interface{}) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return fmt.Errorf("invalid cookie")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	data, err := c.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return fmt.Errorf("invalid cookie")
+	}
+	return json.Unmarshal(data, value)
+}
+
+// readCookie returns the value of a cookie, joining the chunks of large
+// values
+func readCookie(r *http.Request, name string) string {
+	if cookie, err := r.Cookie(name); err == nil {
+		return cookie.Value
+	}
+	var value strings.Builder
+	for i := 0; ; i++ {
+		cookie, err := r.Cookie(name + "_" + strconv.Itoa(i))
+		if err != nil {
+			break
+		}
+		value.WriteString(cookie.Value)
+	}
+	return value.String()
+}
+
+// writeCookie sets the cookie, split into chunks if the value is too large.
+// Chunks of the previous value which are no longer needed are removed. An
+// empty value removes the cookie.
+func writeCookie(w http.ResponseWriter, r *http.Request, template http.Cookie, value string) {
+	chunks := []string{}
+	for len(value) > MAX_COOKIE_SIZE {
+		chunks = append(chunks, value[:MAX_COOKIE_SIZE])
+		value = value[MAX_COOKIE_SIZE:]
+	}
+	if value != "" {
+		chunks = append(chunks, value)
+	}
+
+	names := map[string]string{}
+	if len(chunks) == 1 {
+		names[template.Name] = chunks[0]
+	} else {
+		for i, chunk := range chunks {
+			names[template.Name+"_"+strconv.Itoa(i)] = chunk
+		}
+	}
+	for _, cookie := range r.Cookies() {
+		if _, ok := names[cookie.Name]; !ok && isCookie(cookie.Name, template.Name) {
+			names[cookie.Name] = ""
+		}
+	}
+
+	keys := make([]string, 0, len(names))
+	for name := range names {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	for _, name := range keys {
+		cookie := template
+		cookie.Name = name
+		cookie.Value = names[name]
+		if cookie.Value == "" {
+			cookie.MaxAge = -1
+		}
+		http.SetCookie(w, &cookie)
+	}
+}
+
+// isCookie returns true if the cookie is the named cookie or one of its
+// chunks
+func isCookie(cookie string, name string) bool {
+	if cookie == name {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(cookie, name+"_")
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(suffix)
+	return err == nil
+}
@@ -0,0 +1,253 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prefix of encrypted values, followed by the format version
+const PREFIX = "enc:"
+const FORMAT = "v1"
+
+// Length of master and data keys, AES-256
+const KEY_SIZE = 32
+
+// ErrNoMasterKey is returned if secrets are used without a master key
+var ErrNoMasterKey = errors.New("no master key configured")
+
+// Keyring encrypts secrets stored in the database with envelope encryption.
+// Each value is encrypted with its own data key, which is encrypted with the
+// current master key and stored next to the value:
+//
+//	enc:v1:<master key version>:<encrypted data key>:<encrypted value>
+//
+// Older master keys are kept for decryption until all values are encrypted
+// again with the current one. The context binds a value to its record, e.g.
+// the column and the id, so encrypted values cannot be copied to other
+// records.
+type Keyring struct {
+	keys    map[int]cipher.AEAD
+	current int
+}
+
+// NewKeyring creates a keyring of the master keys by version, the highest
+// version is used for new values
+func NewKeyring(keys map[int][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoMasterKey
+	}
+	keyring := &Keyring{keys: map[int]cipher.AEAD{}}
+	for version, key := range keys {
+		if version < 1 {
+			return nil, fmt.Errorf("invalid master key version %d", version)
+		}
+		if len(key) != KEY_SIZE {
+			return nil, fmt.Errorf("master key %d must have %d bytes", version, KEY_SIZE)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[version] = aead
+		if version > keyring.current {
+			keyring.current = version
+		}
+	}
+	return keyring, nil
+}
+
+// NewKeyringEnv reads the master keys from the file in
+// SECRETS_MASTER_KEY_FILE or from SECRETS_MASTER_KEY, see ParseMasterKeys.
+// Without master keys nil is returned.
+func NewKeyringEnv() (*Keyring, error) {
+	value := os.Getenv("SECRETS_MASTER_KEY")
+	if path := os.Getenv("SECRETS_MASTER_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value = string(data)
+	}
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	keys, err := ParseMasterKeys(value)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(keys)
+}
+
+// ParseMasterKeys parses base64 encoded master keys separated by commas or
+// new lines, each prefixed with its version, e.g. "1:<key>,2:<key>". A single
+// key without version is version 1.
+func ParseMasterKeys(value string) (map[int][]byte, error) {
+	keys := map[int][]byte{}
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		version := 1
+		if prefix, encoded, ok := strings.Cut(entry, ":"); ok {
+			number, err := strconv.Atoi(prefix)
+			if err != nil {
+				return nil, fmt.Errorf("invalid master key version %q", prefix)
+			}
+			version, entry = number, encoded
+		}
+		if _, ok := keys[version]; ok {
+			return nil, fmt.Errorf("duplicate master key version %d", version)
+		}
+		key, err := base64.StdEncoding.DecodeString(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %d: %w", version, err)
+		}
+		keys[version] = key
+	}
+	return keys, nil
+}
+
+// Version returns the version of the current master key
+func (k *Keyring) Version() int {
+	if k == nil {
+		return 0
+	}
+	return k.current
+}
+
+// Versions returns the versions of all master keys
+func (k *Keyring) Versions() []int {
+	versions := []int{}
+	if k == nil {
+		return versions
+	}
+	for version := range k.keys {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Encrypt encrypts the secret with a new data key
+func (k *Keyring) Encrypt(plaintext string, context string) (string, error) {
+	if k == nil {
+		return "", ErrNoMasterKey
+	}
+	dataKey := make([]byte, KEY_SIZE)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.current], dataKey, wrapContext(k.current, context))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(aead, []byte(plaintext), []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return PREFIX + FORMAT + ":" + strconv.Itoa(k.current) + ":" + wrapped + ":" + sealed, nil
+}
+
+// Decrypt decrypts a value of Encrypt with the same context
+func (k *Keyring) Decrypt(value string, context string) (string, error) {
+	if k == nil {
+		return "", ErrNoMasterKey
+	}
+	version, wrapped, sealed, err := parse(value)
+	if err != nil {
+		return "", fmt.Errorf("%s of %s", err, context)
+	}
+	master, ok := k.keys[version]
+	if !ok {
+		return "", fmt.Errorf("master key %d of %s not configured", version, context)
+	}
+
+	dataKey, err := open(master, wrapped, wrapContext(version, context))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt data key of %s", context)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, sealed, []byte(context))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt secret of %s", context)
+	}
+	return string(plaintext), nil
+}
+
+// NeedsRotation returns true if the value is not encrypted or not with the
+// current master key
+func (k *Keyring) NeedsRotation(value string) bool {
+	version, _, _, err := parse(value)
+	return err != nil || version != k.Version()
+}
+
+// IsEncrypted returns true if the value has the prefix of encrypted values
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, PREFIX)
+}
+
+// parse splits an encrypted value into the master key version, the
+// encrypted data key and the encrypted value
+func parse(value string) (int, string, string, error) {
+	encoded, ok := strings.CutPrefix(value, PREFIX)
+	if !ok {
+		return 0, "", "", fmt.Errorf("secret is not encrypted")
+	}
+	parts := strings.Split(encoded, ":")
+	if len(parts) != 4 || parts[0] != FORMAT {
+		return 0, "", "", fmt.Errorf("unknown secret format")
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, "", "", fmt.Errorf("invalid master key version")
+	}
+	return version, parts[2], parts[3], nil
+}
+
+// wrapContext authenticates the data key with the master key version and
+// the context of the value
+func wrapContext(version int, context string) []byte {
+	return []byte(strconv.Itoa(version) + ":" + context)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, additionalData)
+	return base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func open(aead cipher.AEAD, encoded string, additionalData []byte) ([]byte, error) {
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid secret")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
@@ -0,0 +1,199 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_QUEUE_SIZE = 2048
+const DEFAULT_BATCH_SIZE = 512
+
+// Exporter sends finished spans in batches to an OTLP/HTTP collector using
+// the JSON encoding
+type Exporter struct {
+	Endpoint    string
+	Headers     map[string]string
+	ServiceName string
+	BatchSize   int
+	Client      *http.Client
+	queue       chan *Span
+	dropped     atomic.Int64
+}
+
+func NewExporter(endpoint string, headers map[string]string, serviceName string) *Exporter {
+	return &Exporter{
+		Endpoint:    endpoint,
+		Headers:     headers,
+		ServiceName: serviceName,
+		BatchSize:   DEFAULT_BATCH_SIZE,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, DEFAULT_QUEUE_SIZE),
+	}
+}
+
+// Enqueue queues the span for export. Spans are dropped if the queue is
+// full, the request is never blocked by the collector.
+func (e *Exporter) Enqueue(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// StartExporter sends the queued spans when a batch is full or the interval
+// elapsed
+func (e *Exporter) StartExporter(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, e.BatchSize)
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) < e.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if dropped := e.dropped.Swap(0); dropped > 0 {
+				log.Printf("Tracing queue full, %d spans dropped.\n", dropped)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := e.Export(batch); err != nil {
+			log.Printf("Error exporting %d spans: %s\n", len(batch), err)
+		}
+		batch = make([]*Span, 0, e.BatchSize)
+	}
+}
+
+// Export sends the spans to the collector
+func (e *Exporter) Export(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of an ExportTraceServiceRequest. Trace and span ids are
+// hex strings, 64 bit integers are decimal strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (e *Exporter) request(spans []*Span) otlpRequest {
+	__spans := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.mu.Lock()
+		__span := otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			TraceState:        span.Context.TraceState,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Status:            otlpStatus{Code: span.Status, Message: span.StatusMessage},
+		}
+		if span.Parent != (SpanID{}) {
+			__span.ParentSpanID = span.Parent.String()
+		}
+		for key, value := range span.Attributes {
+			__span.Attributes = append(__span.Attributes, attribute(key, value))
+		}
+		span.mu.Unlock()
+		__spans = append(__spans, __span)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: []otlpAttribute{attribute("service.name", e.ServiceName)}},
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: DEFAULT_SERVICE_NAME}, Spans: __spans}},
+		}},
+	}
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	switch v := value.(type) {
+	case bool:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"boolValue": v}}
+	case int:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}}
+	case float64:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"doubleValue": v}}
+	default:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"stringValue": fmt.Sprint(v)}}
+	}
+}
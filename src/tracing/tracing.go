@@ -0,0 +1,345 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const HEADER_TRACEPARENT = "traceparent"
+const HEADER_TRACESTATE = "tracestate"
+
+// Span kinds as defined by OTLP
+const KIND_INTERNAL = 1
+const KIND_SERVER = 2
+const KIND_CLIENT = 3
+
+// Span status codes as defined by OTLP
+const STATUS_UNSET = 0
+const STATUS_OK = 1
+const STATUS_ERROR = 2
+
+const SAMPLER_ALWAYS_ON = "always_on"
+const SAMPLER_ALWAYS_OFF = "always_off"
+const SAMPLER_RATIO = "traceidratio"
+const SAMPLER_PARENT_ALWAYS_ON = "parentbased_always_on"
+const SAMPLER_PARENT_ALWAYS_OFF = "parentbased_always_off"
+const SAMPLER_PARENT_RATIO = "parentbased_traceidratio"
+
+const DEFAULT_SERVICE_NAME = "secnex-api-gateway"
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext identifies a span across process boundaries
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+// ParseTraceparent parses a W3C traceparent header
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	// Version 00 has exactly four fields, later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+
+	sc := SpanContext{}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || sc.TraceID == (TraceID{}) {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || sc.SpanID == (SpanID{}) {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+
+	return sc, true
+}
+
+// Traceparent formats the span context as W3C traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Sampler decides whether a new trace is recorded
+type Sampler struct {
+	Name  string
+	Ratio float64
+}
+
+// NewSampler creates a sampler with the OpenTelemetry sampler names
+func NewSampler(name string, arg string) (Sampler, error) {
+	sampler := Sampler{Name: name, Ratio: 1}
+	switch name {
+	case SAMPLER_ALWAYS_ON, SAMPLER_ALWAYS_OFF, SAMPLER_PARENT_ALWAYS_ON, SAMPLER_PARENT_ALWAYS_OFF:
+	case SAMPLER_RATIO, SAMPLER_PARENT_RATIO:
+		if arg != "" {
+			ratio, err := strconv.ParseFloat(arg, 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				return Sampler{}, fmt.Errorf("invalid sampler ratio %q", arg)
+			}
+			sampler.Ratio = ratio
+		}
+	default:
+		return Sampler{}, fmt.Errorf("unknown sampler %q", name)
+	}
+	return sampler, nil
+}
+
+// Sample decides for a trace. Parent based samplers follow the decision of
+// a remote parent if there is one.
+func (s Sampler) Sample(traceID TraceID, parent *SpanContext) bool {
+	parentBased := strings.HasPrefix(s.Name, "parentbased_")
+	if parentBased && parent != nil {
+		return parent.Sampled
+	}
+
+	switch s.Name {
+	case SAMPLER_ALWAYS_OFF, SAMPLER_PARENT_ALWAYS_OFF:
+		return false
+	case SAMPLER_RATIO, SAMPLER_PARENT_RATIO:
+		// Same decision as other OpenTelemetry SDKs for the same trace id
+		bound := uint64(s.Ratio * math.MaxInt64)
+		return binary.BigEndian.Uint64(traceID[8:16])>>1 < bound
+	default:
+		return true
+	}
+}
+
+// Tracer creates spans and hands the sampled ones to the exporter
+type Tracer struct {
+	ServiceName string
+	Sampler     Sampler
+	Exporter    *Exporter
+}
+
+// NewTracerEnv creates a tracer from the OpenTelemetry environment variables.
+// The result is nil if no collector endpoint is configured.
+//
+//	OTEL_EXPORTER_OTLP_TRACES_ENDPOINT  full URL of the OTLP/HTTP traces endpoint
+//	OTEL_EXPORTER_OTLP_ENDPOINT         base URL, /v1/traces is appended
+//	OTEL_EXPORTER_OTLP_HEADERS          key=value pairs sent with every export
+//	OTEL_SERVICE_NAME                   service name, default secnex-api-gateway
+//	OTEL_TRACES_SAMPLER                 sampler, default parentbased_always_on
+//	OTEL_TRACES_SAMPLER_ARG             ratio of the traceidratio samplers
+func NewTracerEnv() (*Tracer, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	headers := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if ok {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = DEFAULT_SERVICE_NAME
+	}
+
+	samplerName := os.Getenv("OTEL_TRACES_SAMPLER")
+	if samplerName == "" {
+		samplerName = SAMPLER_PARENT_ALWAYS_ON
+	}
+	sampler, err := NewSampler(samplerName, os.Getenv("OTEL_TRACES_SAMPLER_ARG"))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTracer(serviceName, sampler, NewExporter(endpoint, headers, serviceName)), nil
+}
+
+func NewTracer(serviceName string, sampler Sampler, exporter *Exporter) *Tracer {
+	return &Tracer{
+		ServiceName: serviceName,
+		Sampler:     sampler,
+		Exporter:    exporter,
+	}
+}
+
+// Span is a timed operation of a trace. All methods are safe to call on a
+// nil span, which is used when tracing is disabled.
+type Span struct {
+	Name          string
+	Kind          int
+	Context       SpanContext
+	Parent        SpanID
+	StartTime     time.Time
+	EndTime       time.Time
+	Attributes    map[string]interface{}
+	Status        int
+	StatusMessage string
+	tracer        *Tracer
+	ended         bool
+	mu            sync.Mutex
+}
+
+type spanKey struct{}
+
+// StartRoot starts the server span of a request. A remote parent, if not
+// nil, continues its trace.
+func (t *Tracer) StartRoot(ctx context.Context, name string, remote *SpanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{Name: name, Kind: KIND_SERVER, StartTime: time.Now(), Attributes: map[string]interface{}{}, tracer: t}
+	span.Context.SpanID = newSpanID()
+	if remote != nil {
+		span.Context.TraceID = remote.TraceID
+		span.Context.TraceState = remote.TraceState
+		span.Parent = remote.SpanID
+		span.Context.Sampled = t.Sampler.Sample(remote.TraceID, remote)
+	} else {
+		span.Context.TraceID = newTraceID()
+		span.Context.Sampled = t.Sampler.Sample(span.Context.TraceID, nil)
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Start starts a child of the span in the context. The result is nil if the
+// context has no span.
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := &Span{Name: name, Kind: kind, StartTime: time.Now(), Attributes: map[string]interface{}{}, tracer: parent.tracer}
+	span.Context = parent.Context
+	span.Context.SpanID = newSpanID()
+	span.Parent = parent.Context.SpanID
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the active span of the context or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Name = name
+	s.mu.Unlock()
+}
+
+// SetAttribute sets a string, integer, float or boolean attribute
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Status = STATUS_ERROR
+	s.StatusMessage = message
+	s.mu.Unlock()
+}
+
+// End ends the span and queues it for export if the trace is sampled.
+// Calls after the first one have no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	if s.Context.Sampled && s.tracer.Exporter != nil {
+		s.tracer.Exporter.Enqueue(s)
+	}
+}
+
+// TraceID returns the trace id of the span or an empty string
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.Context.TraceID.String()
+}
+
+// Traceparent returns the header value propagating the span
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return s.Context.Traceparent()
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
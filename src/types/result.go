@@ -1,6 +1,9 @@
 package types
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 type Result struct {
 	Code    int    `json:"code"`
@@ -20,23 +23,40 @@ type ResultHealth struct {
 }
 
 type ResultError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-	Error   string `json:"error"`
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	Error     string `json:"error"`
+	Reason    string `json:"reason,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
 func (r Result) String() string {
-	return fmt.Sprintf(`{"code":%d,"message":"%s"}`, r.Code, r.Message)
+	return fmt.Sprintf(`{"code":%d,"message":%s}`, r.Code, quote(r.Message))
 }
 
 func (rd ResultData) String() string {
-	return fmt.Sprintf(`{"code":%d,"message":"%s","data":%s}`, rd.Code, rd.Message, rd.Data)
+	return fmt.Sprintf(`{"code":%d,"message":%s,"data":%s}`, rd.Code, quote(rd.Message), rd.Data)
 }
 
 func (rh ResultHealth) String() string {
-	return fmt.Sprintf(`{"code":%d,"message":"%s","status":"%s"}`, rh.Code, rh.Message, rh.Status)
+	return fmt.Sprintf(`{"code":%d,"message":%s,"status":%s}`, rh.Code, quote(rh.Message), quote(rh.Status))
 }
 
+// Errors may contain values of the request, e.g. of a token, so all strings
+// are escaped
 func (re ResultError) String() string {
-	return fmt.Sprintf(`{"code":%d,"message":"%s","error":"%s"}`, re.Code, re.Message, re.Error)
+	result := fmt.Sprintf(`{"code":%d,"message":%s,"error":%s`, re.Code, quote(re.Message), quote(re.Error))
+	if re.Reason != "" {
+		result += fmt.Sprintf(`,"reason":%s`, quote(re.Reason))
+	}
+	if re.RequestID != "" {
+		result += fmt.Sprintf(`,"request_id":%s`, quote(re.RequestID))
+	}
+	return result + "}"
+}
+
+// quote returns the string as JSON string
+func quote(value string) string {
+	data, _ := json.Marshal(value)
+	return string(data)
 }
@@ -0,0 +1,23 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestResultErrorString(t *testing.T) {
+	result := ResultError{
+		Code:      401,
+		Message:   "Unauthorized",
+		Error:     `algorithm "x","injected":"y" not allowed`,
+		Reason:    "line\nbreak",
+		RequestID: "abc-123",
+	}
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(result.String()), &decoded); err != nil {
+		t.Fatalf("invalid JSON %s: %v", result.String(), err)
+	}
+	if decoded["error"] != result.Error || decoded["reason"] != result.Reason || len(decoded) != 5 {
+		t.Errorf("decoded %v, want the fields of %+v", decoded, result)
+	}
+}
@@ -0,0 +1,83 @@
+package useragent
+
+type Category string
+
+const CATEGORY_SEARCH_ENGINES Category = "SEARCH_ENGINES"
+const CATEGORY_SCANNERS Category = "SCANNERS"
+const CATEGORY_HTTP_CLIENTS Category = "HTTP_CLIENTS"
+const CATEGORY_AI_CRAWLERS Category = "AI_CRAWLERS"
+
+// Categories are bundled lists of known bots. Entries are lowercase
+// substrings of the user agent.
+var Categories = map[Category][]string{
+	CATEGORY_SEARCH_ENGINES: {
+		"googlebot",
+		"bingbot",
+		"slurp",
+		"duckduckbot",
+		"baiduspider",
+		"yandexbot",
+		"sogou",
+		"exabot",
+		"applebot",
+		"petalbot",
+		"seznambot",
+		"qwantify",
+	},
+	CATEGORY_SCANNERS: {
+		"sqlmap",
+		"nikto",
+		"nmap",
+		"masscan",
+		"zgrab",
+		"nuclei",
+		"wpscan",
+		"dirbuster",
+		"gobuster",
+		"ffuf",
+		"wfuzz",
+		"acunetix",
+		"nessus",
+		"openvas",
+		"burpcollaborator",
+		"zmeu",
+		"jorgee",
+		"censysinspect",
+		"netsparker",
+		"w3af",
+		"whatweb",
+		"arachni",
+		"havij",
+		"skipfish",
+		"fimap",
+	},
+	CATEGORY_HTTP_CLIENTS: {
+		"curl/",
+		"wget/",
+		"python-requests",
+		"python-urllib",
+		"aiohttp",
+		"go-http-client",
+		"java/",
+		"okhttp",
+		"libwww-perl",
+		"httpie",
+		"postmanruntime",
+		"axios",
+		"node-fetch",
+		"guzzlehttp",
+	},
+	CATEGORY_AI_CRAWLERS: {
+		"gptbot",
+		"chatgpt-user",
+		"ccbot",
+		"claudebot",
+		"anthropic-ai",
+		"google-extended",
+		"bytespider",
+		"perplexitybot",
+		"amazonbot",
+		"omgilibot",
+		"diffbot",
+	},
+}
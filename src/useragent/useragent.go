@@ -0,0 +1,141 @@
+package useragent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/secnex/secnex-api-gateway/utils"
+)
+
+type MatchType string
+
+const MATCH_EXACT MatchType = "EXACT"
+const MATCH_PREFIX MatchType = "PREFIX"
+const MATCH_CONTAINS MatchType = "CONTAINS"
+const MATCH_REGEX MatchType = "REGEX"
+const MATCH_GLOB MatchType = "GLOB"
+const MATCH_CATEGORY MatchType = "CATEGORY"
+
+// Pattern is a single user agent rule
+type Pattern struct {
+	Value     string
+	MatchType MatchType
+}
+
+// Matcher is a precompiled set of user agent patterns. Exact and regex
+// patterns are case sensitive, all other match types ignore the case.
+type Matcher struct {
+	patterns []Pattern
+	exact    map[string]bool
+	prefixes []string
+	contains *utils.AhoCorasick
+	regexps  []*regexp.Regexp
+}
+
+func NewPattern(value string, matchType string) Pattern {
+	return Pattern{
+		Value:     value,
+		MatchType: MatchType(strings.ToUpper(matchType)),
+	}
+}
+
+// Compile builds a matcher from the given patterns
+func Compile(patterns []Pattern) (*Matcher, error) {
+	m := &Matcher{
+		patterns: patterns,
+		exact:    map[string]bool{},
+	}
+
+	substrings := []string{}
+	for _, pattern := range patterns {
+		switch pattern.MatchType {
+		case MATCH_EXACT, "":
+			m.exact[pattern.Value] = true
+		case MATCH_PREFIX:
+			m.prefixes = append(m.prefixes, strings.ToLower(pattern.Value))
+		case MATCH_CONTAINS:
+			substrings = append(substrings, strings.ToLower(pattern.Value))
+		case MATCH_REGEX:
+			re, err := regexp.Compile(pattern.Value)
+			if err != nil {
+				return nil, fmt.Errorf("user agent pattern %q: %w", pattern.Value, err)
+			}
+			m.regexps = append(m.regexps, re)
+		case MATCH_GLOB:
+			m.regexps = append(m.regexps, globToRegexp(pattern.Value))
+		case MATCH_CATEGORY:
+			list, ok := Categories[Category(strings.ToUpper(pattern.Value))]
+			if !ok {
+				return nil, fmt.Errorf("unknown user agent category %q", pattern.Value)
+			}
+			substrings = append(substrings, list...)
+		default:
+			return nil, fmt.Errorf("unknown user agent match type %q", pattern.MatchType)
+		}
+	}
+	if len(substrings) > 0 {
+		m.contains = utils.NewAhoCorasick(substrings)
+	}
+
+	return m, nil
+}
+
+// Empty returns true if the matcher has no patterns
+func (m *Matcher) Empty() bool {
+	return m == nil || len(m.patterns) == 0
+}
+
+// Patterns returns the source patterns of the matcher
+func (m *Matcher) Patterns() []Pattern {
+	if m == nil {
+		return nil
+	}
+	return m.patterns
+}
+
+// Match returns true if the user agent matches any pattern
+func (m *Matcher) Match(userAgent string) bool {
+	if m.Empty() {
+		return false
+	}
+	if m.exact[userAgent] {
+		return true
+	}
+
+	lower := strings.ToLower(userAgent)
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	if m.contains != nil && m.contains.Contains(lower) {
+		return true
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(userAgent) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// globToRegexp converts a glob with * and ? wildcards to an anchored,
+// case insensitive regular expression
+func globToRegexp(glob string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("(?i)^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.MustCompile(pattern.String())
+}
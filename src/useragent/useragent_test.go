@@ -0,0 +1,86 @@
+package useragent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		name      string
+		patterns  []Pattern
+		userAgent string
+		matched   bool
+	}{
+		{name: "exact", patterns: []Pattern{NewPattern("HealthCheck/1.0", "exact")}, userAgent: "HealthCheck/1.0", matched: true},
+		{name: "exact is case sensitive", patterns: []Pattern{NewPattern("HealthCheck/1.0", "exact")}, userAgent: "healthcheck/1.0"},
+		{name: "exact is the default", patterns: []Pattern{NewPattern("HealthCheck/1.0", "")}, userAgent: "HealthCheck/1.0 extra"},
+		{name: "prefix ignores case", patterns: []Pattern{NewPattern("Mozilla/", "prefix")}, userAgent: "mozilla/5.0 (X11)", matched: true},
+		{name: "prefix only at the start", patterns: []Pattern{NewPattern("curl", "prefix")}, userAgent: "libcurl/8.0"},
+		{name: "contains ignores case", patterns: []Pattern{NewPattern("Scanner", "contains")}, userAgent: "Mozilla/5.0 SCANNER/2", matched: true},
+		{name: "contains of several patterns", patterns: []Pattern{NewPattern("alpha", "contains"), NewPattern("beta", "contains")}, userAgent: "client-beta/1", matched: true},
+		{name: "regex is case sensitive", patterns: []Pattern{NewPattern(`^Go-http-client/\d`, "regex")}, userAgent: "go-http-client/1.1"},
+		{name: "regex", patterns: []Pattern{NewPattern(`^Go-http-client/\d`, "regex")}, userAgent: "Go-http-client/2.0", matched: true},
+		{name: "case insensitive regex", patterns: []Pattern{NewPattern(`(?i)^go-http-client/`, "regex")}, userAgent: "Go-http-client/2.0", matched: true},
+		{name: "glob", patterns: []Pattern{NewPattern("Mozilla/* (compatible; *bot*)", "glob")}, userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)", matched: true},
+		{name: "glob ignores case", patterns: []Pattern{NewPattern("python-*", "glob")}, userAgent: "Python-urllib/3.11", matched: true},
+		{name: "glob is anchored", patterns: []Pattern{NewPattern("python-*", "glob")}, userAgent: "my-python-client"},
+		{name: "glob single character", patterns: []Pattern{NewPattern("agent/?.0", "glob")}, userAgent: "agent/2.0", matched: true},
+		{name: "glob quotes meta characters", patterns: []Pattern{NewPattern("agent (v1.0)", "glob")}, userAgent: "agent (v1x0)"},
+		{name: "category", patterns: []Pattern{NewPattern("scanners", "category")}, userAgent: "sqlmap/1.7.2#stable (https://sqlmap.org)", matched: true},
+		{name: "category ignores case", patterns: []Pattern{NewPattern("SCANNERS", "CATEGORY")}, userAgent: "Mozilla/5.00 (Nikto/2.1.6)", matched: true},
+		{name: "category of http clients", patterns: []Pattern{NewPattern("http_clients", "category")}, userAgent: "curl/8.4.0", matched: true},
+		{name: "browser is no bot", patterns: []Pattern{NewPattern("scanners", "category"), NewPattern("search_engines", "category")}, userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"},
+		{name: "without patterns", patterns: nil, userAgent: "curl/8.4.0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := Compile(test.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matched := m.Match(test.userAgent); matched != test.matched {
+				t.Errorf("Match(%q) = %v, want %v", test.userAgent, matched, test.matched)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern Pattern
+		wantErr string
+	}{
+		{name: "invalid regex", pattern: NewPattern("(", "regex"), wantErr: `user agent pattern "("`},
+		{name: "unknown category", pattern: NewPattern("robots", "category"), wantErr: `unknown user agent category "robots"`},
+		{name: "unknown match type", pattern: NewPattern("curl", "suffix"), wantErr: `unknown user agent match type "SUFFIX"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Compile([]Pattern{test.pattern})
+			if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+				t.Errorf("Compile() = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCategoriesAreLowercase(t *testing.T) {
+	for category, list := range Categories {
+		for _, entry := range list {
+			if entry != strings.ToLower(entry) {
+				t.Errorf("entry %q of category %s is not lowercase and never matches", entry, category)
+			}
+		}
+	}
+}
+
+func TestEmptyMatcher(t *testing.T) {
+	var m *Matcher
+	if !m.Empty() || m.Match("curl/8.4.0") || m.Patterns() != nil {
+		t.Error("nil matcher is not empty")
+	}
+}
@@ -0,0 +1,88 @@
+package utils
+
+// AhoCorasick matches many substrings in a single pass over the input
+type AhoCorasick struct {
+	nodes []acNode
+}
+
+type acNode struct {
+	next   map[byte]int
+	fail   int
+	output []int
+}
+
+// NewAhoCorasick builds the automaton for the given patterns. Empty
+// patterns are ignored.
+func NewAhoCorasick(patterns []string) *AhoCorasick {
+	ac := &AhoCorasick{nodes: []acNode{{next: map[byte]int{}}}}
+	for index, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		state := 0
+		for i := 0; i < len(pattern); i++ {
+			next, ok := ac.nodes[state].next[pattern[i]]
+			if !ok {
+				ac.nodes = append(ac.nodes, acNode{next: map[byte]int{}})
+				next = len(ac.nodes) - 1
+				ac.nodes[state].next[pattern[i]] = next
+			}
+			state = next
+		}
+		ac.nodes[state].output = append(ac.nodes[state].output, index)
+	}
+
+	// Breadth-first computation of the failure links
+	queue := []int{}
+	for _, next := range ac.nodes[0].next {
+		queue = append(queue, next)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, next := range ac.nodes[state].next {
+			queue = append(queue, next)
+			fail := ac.nodes[state].fail
+			for {
+				if target, ok := ac.nodes[fail].next[c]; ok && target != next {
+					ac.nodes[next].fail = target
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+			ac.nodes[next].output = append(ac.nodes[next].output, ac.nodes[ac.nodes[next].fail].output...)
+		}
+	}
+
+	return ac
+}
+
+// Match returns the index of the first pattern found in the input
+func (ac *AhoCorasick) Match(input string) (int, bool) {
+	state := 0
+	for i := 0; i < len(input); i++ {
+		for {
+			if next, ok := ac.nodes[state].next[input[i]]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = ac.nodes[state].fail
+		}
+		if len(ac.nodes[state].output) > 0 {
+			return ac.nodes[state].output[0], true
+		}
+	}
+	return -1, false
+}
+
+// Contains returns true if any pattern is found in the input
+func (ac *AhoCorasick) Contains(input string) bool {
+	_, ok := ac.Match(input)
+	return ok
+}
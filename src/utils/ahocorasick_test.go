@@ -0,0 +1,47 @@
+package utils
+
+import "testing"
+
+func TestAhoCorasick(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		input    string
+		index    int
+		found    bool
+	}{
+		{name: "single pattern", patterns: []string{"bot"}, input: "googlebot/2.1", index: 0, found: true},
+		{name: "no match", patterns: []string{"bot", "spider"}, input: "mozilla/5.0", index: -1},
+		{name: "empty input", patterns: []string{"bot"}, input: "", index: -1},
+		{name: "without patterns", patterns: nil, input: "bot", index: -1},
+		{name: "empty patterns are ignored", patterns: []string{"", "bot"}, input: "robot", index: 1, found: true},
+		{name: "pattern at the end", patterns: []string{"curl/"}, input: "my-curl/", index: 0, found: true},
+		// "she" and "he" end at the same position, the longer pattern of
+		// the state comes first
+		{name: "overlapping patterns", patterns: []string{"he", "she", "his", "hers"}, input: "ushers", index: 1, found: true},
+		{name: "first match in the input", patterns: []string{"hers", "his"}, input: "his hers", index: 1, found: true},
+		// After "abc" the next byte does not continue "abcd", the failure
+		// link leads to "bc" of the second pattern
+		{name: "failure link", patterns: []string{"abcd", "bce"}, input: "abce", index: 1, found: true},
+		{name: "failure link chain", patterns: []string{"abcde", "bcdf", "cdg"}, input: "abcdcdg", index: 2, found: true},
+		// "bc" is never entered directly, it is the output of "abc" through
+		// the failure link
+		{name: "output of failure link", patterns: []string{"abcx", "bc"}, input: "abcy", index: 1, found: true},
+		{name: "repeated prefix", patterns: []string{"aab"}, input: "aaab", index: 0, found: true},
+		{name: "prefix of another pattern", patterns: []string{"nmap", "nm"}, input: "xnmy", index: 1, found: true},
+		{name: "case sensitive", patterns: []string{"sqlmap"}, input: "SQLMap/1.7", index: -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ac := NewAhoCorasick(test.patterns)
+			index, found := ac.Match(test.input)
+			if index != test.index || found != test.found {
+				t.Errorf("Match(%q) = %d, %v, want %d, %v", test.input, index, found, test.index, test.found)
+			}
+			if ac.Contains(test.input) != test.found {
+				t.Errorf("Contains(%q) = %v, want %v", test.input, !test.found, test.found)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package waf
+
+import (
+	"regexp"
+	"sync"
+)
+
+type Category string
+
+const CATEGORY_SQLI Category = "SQLI"
+const CATEGORY_XSS Category = "XSS"
+const CATEGORY_PATH_TRAVERSAL Category = "PATH_TRAVERSAL"
+const CATEGORY_COMMAND_INJECTION Category = "COMMAND_INJECTION"
+
+const SCORE_CRITICAL = 5
+const SCORE_WARNING = 3
+
+// Rule is a single detection pattern
+type Rule struct {
+	ID       int
+	Category Category
+	Pattern  *regexp.Regexp
+	Score    int
+}
+
+// Engine evaluates a rule set against request values
+type Engine struct {
+	Rules []Rule
+}
+
+var defaultEngine *Engine
+var defaultEngineOnce sync.Once
+
+func NewRule(id int, category Category, pattern string, score int) Rule {
+	return Rule{
+		ID:       id,
+		Category: category,
+		Pattern:  regexp.MustCompile(pattern),
+		Score:    score,
+	}
+}
+
+func NewEngine(rules []Rule) *Engine {
+	return &Engine{
+		Rules: rules,
+	}
+}
+
+// DefaultEngine returns the engine with the built-in rule set
+func DefaultEngine() *Engine {
+	defaultEngineOnce.Do(func() {
+		defaultEngine = NewEngine(DefaultRules())
+	})
+	return defaultEngine
+}
+
+// DefaultRules returns the built-in detection rules. Patterns are matched
+// against normalized (URL decoded and lowercased) values.
+func DefaultRules() []Rule {
+	return []Rule{
+		// SQL injection
+		NewRule(1001, CATEGORY_SQLI, `\bunion\b[\s(/*]+(all\s+|distinct\s+)?select\b`, SCORE_CRITICAL),
+		NewRule(1002, CATEGORY_SQLI, `['"\x60]\s*\)?\s*(or|and|xor)\s+['"\x60]?[\w-]+['"\x60]?\s*(=|<|>|like\b|is\b)`, SCORE_CRITICAL),
+		NewRule(1003, CATEGORY_SQLI, `['"\x60]\s*\)?\s*(--|#|/\*)`, SCORE_WARNING),
+		NewRule(1004, CATEGORY_SQLI, `;\s*(drop|delete|insert|update|alter|create|truncate|exec)\s`, SCORE_CRITICAL),
+		NewRule(1005, CATEGORY_SQLI, `\b(sleep|benchmark|pg_sleep|extractvalue|updatexml)\s*\(|\bwaitfor\s+delay\b`, SCORE_CRITICAL),
+		NewRule(1006, CATEGORY_SQLI, `\b(information_schema|pg_catalog|sysobjects|sqlite_master)\b`, SCORE_WARNING),
+		NewRule(1007, CATEGORY_SQLI, `\bor\s+\d+\s*=\s*\d+|\band\s+\d+\s*=\s*\d+`, SCORE_WARNING),
+
+		// Cross-site scripting
+		NewRule(2001, CATEGORY_XSS, `<\s*script[\s/>]`, SCORE_CRITICAL),
+		// Event handlers are attributes of a tag, so they follow a space, a
+		// quote or a slash. Parameters named like events, e.g. "?onload=1",
+		// are separated by & and pass.
+		NewRule(2002, CATEGORY_XSS, `[\s"'/]on(error|load|click|mouseover|focus|blur|submit|change|toggle|animationstart)\s*=`, SCORE_CRITICAL),
+		NewRule(2003, CATEGORY_XSS, `(javascript|vbscript)\s*:`, SCORE_CRITICAL),
+		NewRule(2004, CATEGORY_XSS, `<\s*(iframe|object|embed|svg|img|body|link|meta)[\s/>]`, SCORE_WARNING),
+		NewRule(2005, CATEGORY_XSS, `\b(document\.cookie|document\.domain|window\.location)\b|\b(alert|prompt|confirm|eval)\s*\(`, SCORE_WARNING),
+
+		// Path traversal
+		NewRule(3001, CATEGORY_PATH_TRAVERSAL, `(^|[\\/])\.\.([\\/]|$)`, SCORE_CRITICAL),
+		NewRule(3002, CATEGORY_PATH_TRAVERSAL, `/etc/(passwd|shadow|hosts|group)\b|c:\\windows\\|\bboot\.ini\b|/proc/self/`, SCORE_CRITICAL),
+
+		// Command injection. A single & separates query parameters and ;
+		// cookies, so a command must follow ;, &&, | or a backtick and end with
+		// a space or an operator, which skips e.g. "?page=2&id=5" or "a; id=5".
+		NewRule(4001, CATEGORY_COMMAND_INJECTION, "(;|&&|\\||\x60)\\s*(cat|ls|id|whoami|uname|wget|curl|nc|ncat|bash|sh|zsh|python|perl|powershell|cmd)(\\s|$|[;&|<>\x60])", SCORE_CRITICAL),
+		NewRule(4002, CATEGORY_COMMAND_INJECTION, `\$\([^)]*\)|\x60[^\x60]+\x60`, SCORE_WARNING),
+		NewRule(4003, CATEGORY_COMMAND_INJECTION, `\$\{ifs\}|\$ifs\b`, SCORE_CRITICAL),
+	}
+}
+
+// Evaluate matches all targets against the rules and sums up the anomaly
+// score. Every rule counts at most once per request.
+func (e *Engine) Evaluate(targets []Target) Decision {
+	decision := Decision{}
+	values := make([]string, len(targets))
+	for i, target := range targets {
+		values[i] = normalize(target.Value)
+	}
+
+	topScore := 0
+	for _, rule := range e.Rules {
+		for i, target := range targets {
+			if !rule.Pattern.MatchString(values[i]) {
+				continue
+			}
+			decision.Matches = append(decision.Matches, Match{
+				RuleID:   rule.ID,
+				Category: rule.Category,
+				Target:   target.Name,
+				Score:    rule.Score,
+			})
+			decision.Score += rule.Score
+			if rule.Score > topScore {
+				topScore = rule.Score
+				decision.Reason = "WAF_" + string(rule.Category)
+			}
+			break
+		}
+	}
+	return decision
+}
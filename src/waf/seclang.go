@@ -0,0 +1,412 @@
+package waf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/secnex/secnex-api-gateway/utils"
+)
+
+// SecRule is a compiled ModSecurity rule
+type SecRule struct {
+	ID              int
+	Phase           int
+	Message         string
+	Variables       []Variable
+	Operator        Operator
+	Transformations []Transformation
+	Action          string
+	Status          int
+	Log             bool
+}
+
+// Variable selects values of a collection, e.g. REQUEST_HEADERS:User-Agent
+type Variable struct {
+	Collection string
+	Key        string
+	KeyPattern *regexp.Regexp
+	Exclude    bool
+}
+
+// Operator is the compiled @operator of a rule
+type Operator struct {
+	Name    string
+	Negated bool
+	Match   func(value string) bool
+}
+
+type Transformation func(value string) string
+
+const SEC_ACTION_DENY = "deny"
+const SEC_ACTION_PASS = "pass"
+
+var secCollections = map[string]bool{
+	"ARGS":                  true,
+	"ARGS_GET":              true,
+	"ARGS_POST":             true,
+	"ARGS_NAMES":            true,
+	"ARGS_GET_NAMES":        true,
+	"ARGS_POST_NAMES":       true,
+	"QUERY_STRING":          true,
+	"REQUEST_URI":           true,
+	"REQUEST_URI_RAW":       true,
+	"REQUEST_FILENAME":      true,
+	"REQUEST_BASENAME":      true,
+	"REQUEST_LINE":          true,
+	"REQUEST_METHOD":        true,
+	"REQUEST_PROTOCOL":      true,
+	"REQUEST_HEADERS":       true,
+	"REQUEST_HEADERS_NAMES": true,
+	"REQUEST_COOKIES":       true,
+	"REQUEST_COOKIES_NAMES": true,
+	"REQUEST_BODY":          true,
+	"REMOTE_ADDR":           true,
+}
+
+var secTransformations = map[string]Transformation{
+	"lowercase":          strings.ToLower,
+	"uppercase":          strings.ToUpper,
+	"urlDecode":          urlDecode,
+	"urlDecodeUni":       urlDecode,
+	"htmlEntityDecode":   htmlEntityDecode,
+	"removeNulls":        func(value string) string { return strings.ReplaceAll(value, "\x00", "") },
+	"removeWhitespace":   func(value string) string { return strings.Join(strings.Fields(value), "") },
+	"compressWhitespace": func(value string) string { return strings.Join(strings.Fields(value), " ") },
+	"trim":               strings.TrimSpace,
+	"normalizePath":      normalizePath,
+	"normalisePath":      normalizePath,
+}
+
+// Actions without influence on the evaluation
+var secMetadataActions = map[string]bool{
+	"tag":        true,
+	"ver":        true,
+	"rev":        true,
+	"severity":   true,
+	"maturity":   true,
+	"accuracy":   true,
+	"logdata":    true,
+	"capture":    true,
+	"auditlog":   true,
+	"noauditlog": true,
+}
+
+// ParseRuleFile reads SecLang rules from a file
+func ParseRuleFile(path string) ([]SecRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules, err := ParseRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// ParseRules reads SecLang rules. Directives and rules using unsupported
+// features are returned as errors like syntax errors, a rule set is never
+// loaded with rules which are not enforced.
+func ParseRules(reader io.Reader) ([]SecRule, error) {
+	rules := []SecRule{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	statement := ""
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(line, "\\") {
+			statement += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		statement += line
+		if statement == "" || strings.HasPrefix(statement, "#") {
+			statement = ""
+			continue
+		}
+
+		args, err := splitArguments(statement)
+		statement = ""
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		if args[0] != "SecRule" {
+			return nil, fmt.Errorf("line %d: unsupported directive %s", lineNumber, args[0])
+		}
+		if len(args) < 3 || len(args) > 4 {
+			return nil, fmt.Errorf("line %d: SecRule expects variables, operator and actions", lineNumber)
+		}
+		actions := ""
+		if len(args) == 4 {
+			actions = args[3]
+		}
+
+		rule, err := CompileRule(args[1], args[2], actions)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if statement != "" {
+		return nil, fmt.Errorf("line %d: unterminated line continuation", lineNumber)
+	}
+
+	return rules, nil
+}
+
+// CompileRule compiles the arguments of a SecRule directive
+func CompileRule(variables string, operator string, actions string) (SecRule, error) {
+	rule := SecRule{
+		Phase:  2,
+		Action: SEC_ACTION_DENY,
+		Status: 403,
+		Log:    true,
+	}
+
+	var err error
+	rule.Variables, err = compileVariables(variables)
+	if err != nil {
+		return SecRule{}, err
+	}
+
+	rule.Operator, err = compileOperator(operator)
+	if err != nil {
+		return SecRule{}, err
+	}
+
+	for _, action := range splitActions(actions) {
+		name, value, _ := strings.Cut(action, ":")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), "'")
+		switch name {
+		case "id":
+			rule.ID, err = strconv.Atoi(value)
+			if err != nil {
+				return SecRule{}, fmt.Errorf("invalid rule id %q", value)
+			}
+		case "msg":
+			rule.Message = value
+		case "phase":
+			switch value {
+			case "1", "request":
+				rule.Phase = 1
+			case "2":
+				rule.Phase = 2
+			default:
+				return SecRule{}, fmt.Errorf("unsupported phase %q", value)
+			}
+		case "deny", "block", "drop":
+			rule.Action = SEC_ACTION_DENY
+		case "pass":
+			rule.Action = SEC_ACTION_PASS
+		case "status":
+			rule.Status, err = strconv.Atoi(value)
+			if err != nil {
+				return SecRule{}, fmt.Errorf("invalid status %q", value)
+			}
+		case "log":
+			rule.Log = true
+		case "nolog":
+			rule.Log = false
+		case "t":
+			if value == "none" {
+				rule.Transformations = nil
+				continue
+			}
+			transformation, ok := secTransformations[value]
+			if !ok {
+				return SecRule{}, fmt.Errorf("unsupported transformation %q", value)
+			}
+			rule.Transformations = append(rule.Transformations, transformation)
+		default:
+			if !secMetadataActions[name] {
+				return SecRule{}, fmt.Errorf("unsupported action %q", name)
+			}
+		}
+	}
+
+	if rule.ID == 0 {
+		return SecRule{}, fmt.Errorf("rule without id")
+	}
+
+	return rule, nil
+}
+
+func compileVariables(variables string) ([]Variable, error) {
+	result := []Variable{}
+	for _, item := range strings.Split(variables, "|") {
+		variable := Variable{}
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, "!") {
+			variable.Exclude = true
+			item = item[1:]
+		}
+		if strings.HasPrefix(item, "&") {
+			return nil, fmt.Errorf("unsupported variable count %q", item)
+		}
+
+		collection, key, hasKey := strings.Cut(item, ":")
+		variable.Collection = strings.ToUpper(collection)
+		if !secCollections[variable.Collection] {
+			return nil, fmt.Errorf("unsupported variable %q", collection)
+		}
+		if hasKey {
+			key = strings.Trim(key, "'")
+			if len(key) > 1 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/") {
+				pattern, err := regexp.Compile("(?i)" + key[1:len(key)-1])
+				if err != nil {
+					return nil, err
+				}
+				variable.KeyPattern = pattern
+			} else {
+				variable.Key = strings.ToLower(key)
+			}
+		}
+		if variable.Exclude && !hasKey {
+			return nil, fmt.Errorf("exclusion without key %q", item)
+		}
+		result = append(result, variable)
+	}
+	return result, nil
+}
+
+func compileOperator(operator string) (Operator, error) {
+	result := Operator{}
+	if strings.HasPrefix(operator, "!") {
+		result.Negated = true
+		operator = operator[1:]
+	}
+
+	// Operators default to @rx
+	if !strings.HasPrefix(operator, "@") {
+		operator = "@rx " + operator
+	}
+	name, argument, _ := strings.Cut(operator, " ")
+	result.Name = name[1:]
+
+	switch result.Name {
+	case "rx":
+		pattern, err := regexp.Compile(argument)
+		if err != nil {
+			return Operator{}, err
+		}
+		result.Match = pattern.MatchString
+	case "pm":
+		phrases := utils.NewAhoCorasick(strings.Fields(strings.ToLower(argument)))
+		result.Match = func(value string) bool {
+			return phrases.Contains(strings.ToLower(value))
+		}
+	case "contains":
+		result.Match = func(value string) bool { return strings.Contains(value, argument) }
+	case "streq":
+		result.Match = func(value string) bool { return value == argument }
+	case "beginsWith":
+		result.Match = func(value string) bool { return strings.HasPrefix(value, argument) }
+	case "endsWith":
+		result.Match = func(value string) bool { return strings.HasSuffix(value, argument) }
+	case "ipMatch":
+		networks := []*net.IPNet{}
+		for _, item := range strings.Split(argument, ",") {
+			item = strings.TrimSpace(item)
+			if !strings.Contains(item, "/") {
+				if strings.Contains(item, ":") {
+					item += "/128"
+				} else {
+					item += "/32"
+				}
+			}
+			_, network, err := net.ParseCIDR(item)
+			if err != nil {
+				return Operator{}, err
+			}
+			networks = append(networks, network)
+		}
+		result.Match = func(value string) bool {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return false
+			}
+			for _, network := range networks {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+	default:
+		return Operator{}, fmt.Errorf("unsupported operator @%s", result.Name)
+	}
+
+	return result, nil
+}
+
+// splitArguments splits a directive into its arguments, honoring quotes
+func splitArguments(statement string) ([]string, error) {
+	args := []string{}
+	current := strings.Builder{}
+	inQuotes := false
+	hasArgument := false
+	for i := 0; i < len(statement); i++ {
+		c := statement[i]
+		switch {
+		case c == '\\' && i+1 < len(statement) && inQuotes && statement[i+1] == '"':
+			current.WriteByte('"')
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+			hasArgument = true
+		case (c == ' ' || c == '\t') && !inQuotes:
+			if hasArgument {
+				args = append(args, current.String())
+				current.Reset()
+				hasArgument = false
+			}
+		default:
+			current.WriteByte(c)
+			hasArgument = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if hasArgument {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// splitActions splits the action list at commas outside of single quotes
+func splitActions(actions string) []string {
+	result := []string{}
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(actions); i++ {
+		switch actions[i] {
+		case '\'':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				result = append(result, actions[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if strings.TrimSpace(actions[start:]) != "" {
+		result = append(result, actions[start:])
+	}
+	return result
+}
@@ -0,0 +1,301 @@
+package waf
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustParseRules(t *testing.T, rules string) *RuleSet {
+	t.Helper()
+	parsed, err := ParseRules(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRuleSet(parsed)
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		ids     []int
+		wantErr string
+	}{
+		{
+			name:  "single rule",
+			rules: `SecRule ARGS "@rx attack" "id:100,deny"`,
+			ids:   []int{100},
+		},
+		{
+			name: "comments and blank lines",
+			rules: `# Rules of the orders API
+
+SecRule ARGS "@rx a" "id:100"
+    # indented comment
+SecRule ARGS "@rx b" "id:101"`,
+			ids: []int{100, 101},
+		},
+		{
+			name: "line continuation",
+			rules: `SecRule REQUEST_HEADERS:User-Agent "@pm sqlmap nikto" \
+    "id:100,\
+    phase:1,deny,status:429"`,
+			ids: []int{100},
+		},
+		{
+			name:  "escaped quote",
+			rules: `SecRule ARGS "@contains \"quoted\"" "id:100"`,
+			ids:   []int{100},
+		},
+		{
+			name:  "action with quoted comma",
+			rules: `SecRule ARGS "@rx a" "id:100,msg:'first, second',tag:'a,b'"`,
+			ids:   []int{100},
+		},
+		{
+			name:  "operator defaults to rx",
+			rules: `SecRule ARGS "^admin$" "id:100"`,
+			ids:   []int{100},
+		},
+		{name: "unsupported directive", rules: `SecRuleEngine On`, wantErr: "line 1: unsupported directive SecRuleEngine"},
+		{name: "unsupported directive after rule", rules: "SecRule ARGS \"@rx a\" \"id:100\"\nSecAction \"id:101,pass\"", wantErr: "line 2: unsupported directive SecAction"},
+		{name: "chained rule", rules: `SecRule ARGS "@rx a" "id:100,chain"`, wantErr: `line 1: unsupported action "chain"`},
+		{name: "skip action", rules: `SecRule ARGS "@rx a" "id:100,skipAfter:END"`, wantErr: `line 1: unsupported action "skipAfter"`},
+		{name: "invalid regex", rules: `SecRule ARGS "@rx (" "id:100"`, wantErr: "line 1: error parsing regexp"},
+		{name: "unsupported operator", rules: `SecRule ARGS "@detectSQLi" "id:100"`, wantErr: "line 1: unsupported operator @detectSQLi"},
+		{name: "invalid ip", rules: `SecRule REMOTE_ADDR "@ipMatch 10.0.0.300" "id:100"`, wantErr: "line 1: invalid CIDR address"},
+		{name: "unsupported variable", rules: `SecRule RESPONSE_BODY "@rx a" "id:100"`, wantErr: `line 1: unsupported variable "RESPONSE_BODY"`},
+		{name: "variable count", rules: `SecRule &ARGS "@rx a" "id:100"`, wantErr: `line 1: unsupported variable count "&ARGS"`},
+		{name: "exclusion without key", rules: `SecRule ARGS|!ARGS "@rx a" "id:100"`, wantErr: `line 1: exclusion without key "ARGS"`},
+		{name: "unsupported transformation", rules: `SecRule ARGS "@rx a" "id:100,t:base64Decode"`, wantErr: `line 1: unsupported transformation "base64Decode"`},
+		{name: "unsupported phase", rules: `SecRule ARGS "@rx a" "id:100,phase:4"`, wantErr: `line 1: unsupported phase "4"`},
+		{name: "without id", rules: `SecRule ARGS "@rx a" "deny"`, wantErr: "line 1: rule without id"},
+		{name: "invalid id", rules: `SecRule ARGS "@rx a" "id:abc"`, wantErr: `line 1: invalid rule id "abc"`},
+		{name: "invalid status", rules: `SecRule ARGS "@rx a" "id:100,status:forbidden"`, wantErr: `line 1: invalid status "forbidden"`},
+		{name: "missing operator", rules: `SecRule ARGS`, wantErr: "line 1: SecRule expects variables, operator and actions"},
+		{name: "unterminated quote", rules: `SecRule ARGS "@rx a`, wantErr: "line 1: unterminated quote"},
+		{name: "unterminated continuation", rules: "SecRule ARGS \"@rx a\" \\", wantErr: "line 1: unterminated line continuation"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := ParseRules(strings.NewReader(test.rules))
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("ParseRules() = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRules() = %v, want no error", err)
+			}
+			ids := []int{}
+			for _, rule := range rules {
+				ids = append(ids, rule.ID)
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("ParseRules() ids = %v, want %v", ids, test.ids)
+			}
+		})
+	}
+}
+
+func TestCompileRule(t *testing.T) {
+	rule, err := CompileRule(`REQUEST_HEADERS:User-Agent|ARGS:/^user_/|!ARGS:user_id`, "!@streq ok", "id:7,phase:request,pass,nolog,msg:'bad agent',t:lowercase,t:trim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.ID != 7 || rule.Phase != 1 || rule.Action != SEC_ACTION_PASS || rule.Log || rule.Message != "bad agent" {
+		t.Errorf("CompileRule() = %+v", rule)
+	}
+	if rule.Operator.Name != "streq" || !rule.Operator.Negated {
+		t.Errorf("CompileRule() operator = %+v, want negated streq", rule.Operator)
+	}
+	if len(rule.Transformations) != 2 {
+		t.Errorf("CompileRule() has %d transformations, want 2", len(rule.Transformations))
+	}
+	variables := rule.Variables
+	if len(variables) != 3 || variables[0].Key != "user-agent" || variables[1].KeyPattern == nil || !variables[2].Exclude {
+		t.Errorf("CompileRule() variables = %+v", variables)
+	}
+
+	defaults, err := CompileRule("ARGS", "@rx a", "id:8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaults.Phase != 2 || defaults.Action != SEC_ACTION_DENY || defaults.Status != http.StatusForbidden || !defaults.Log {
+		t.Errorf("CompileRule() defaults = %+v", defaults)
+	}
+
+	reset, err := CompileRule("ARGS", "@rx a", "id:9,t:lowercase,t:none,t:trim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reset.Transformations) != 1 {
+		t.Errorf("t:none keeps %d transformations, want 1", len(reset.Transformations))
+	}
+}
+
+func TestSplitArguments(t *testing.T) {
+	tests := []struct {
+		statement string
+		args      []string
+	}{
+		{`SecRule ARGS "@rx a b" "id:1"`, []string{"SecRule", "ARGS", "@rx a b", "id:1"}},
+		{"SecRule\tARGS   \"@rx a\"", []string{"SecRule", "ARGS", "@rx a"}},
+		{`SecRule ARGS "@rx \"a\"" ""`, []string{"SecRule", "ARGS", `@rx "a"`, ""}},
+		{`SecRule ARGS @rx\d`, []string{"SecRule", "ARGS", `@rx\d`}},
+	}
+	for _, test := range tests {
+		args, err := splitArguments(test.statement)
+		if err != nil {
+			t.Fatalf("splitArguments(%q) = %v", test.statement, err)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitArguments(%q) = %q, want %q", test.statement, args, test.args)
+		}
+	}
+}
+
+func TestTransformations(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"lowercase", "SeLeCt", "select"},
+		{"uppercase", "select", "SELECT"},
+		{"urlDecode", "%3Cscript%3E+x", "<script> x"},
+		{"urlDecode", "100%", "100%"},
+		{"htmlEntityDecode", "&lt;script&gt;&#x27;", "<script>'"},
+		{"removeNulls", "scr\x00ipt", "script"},
+		{"removeWhitespace", " un ion\tsel\nect ", "unionselect"},
+		{"compressWhitespace", " union \t\n select ", "union select"},
+		{"trim", "  admin \t", "admin"},
+		{"normalizePath", "/a/./b/../../etc/passwd", "/etc/passwd"},
+		{"normalizePath", `\a\..\b\`, "/b/"},
+		{"normalizePath", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := secTransformations[test.name](test.value); got != test.want {
+				t.Errorf("%s(%q) = %q, want %q", test.name, test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestOperators(t *testing.T) {
+	tests := []struct {
+		operator string
+		value    string
+		matched  bool
+	}{
+		{"@rx ^/admin", "/admin/users", true},
+		{"@rx ^/admin", "/api/admin", false},
+		{"^/admin", "/admin", true},
+		{"!@rx ^/admin", "/api", true},
+		{"@pm sqlmap Nikto", "Mozilla/5.0 nikto/2.1", true},
+		{"@pm sqlmap nikto", "Mozilla/5.0", false},
+		{"@contains ../", "a/../b", true},
+		{"@streq GET", "GET", true},
+		{"@streq GET", "get", false},
+		{"@beginsWith /internal", "/internal/metrics", true},
+		{"@endsWith .php", "/index.php", true},
+		{"@endsWith .php", "/index.php5", false},
+		{"@ipMatch 10.0.0.0/8, 192.0.2.1", "10.1.2.3", true},
+		{"@ipMatch 10.0.0.0/8, 192.0.2.1", "192.0.2.1", true},
+		{"@ipMatch 10.0.0.0/8, 192.0.2.1", "192.0.2.2", false},
+		{"@ipMatch 2001:db8::1", "2001:db8::1", true},
+		{"@ipMatch 10.0.0.0/8", "not an ip", false},
+	}
+	for _, test := range tests {
+		operator, err := compileOperator(test.operator)
+		if err != nil {
+			t.Fatalf("compileOperator(%q) = %v", test.operator, err)
+		}
+		if matched := operator.Match(test.value) != operator.Negated; matched != test.matched {
+			t.Errorf("%s on %q = %v, want %v", test.operator, test.value, matched, test.matched)
+		}
+	}
+}
+
+func TestRuleSetEvaluate(t *testing.T) {
+	rules := mustParseRules(t, `
+SecRule ARGS:debug "@streq 1" "id:100,phase:2,pass,nolog"
+SecRule REQUEST_HEADERS:User-Agent "@pm sqlmap nikto" "id:101,phase:1,deny,status:429,nolog"
+SecRule ARGS|!ARGS:comment "@rx <script" "id:102,deny,nolog,t:urlDecode,t:lowercase"
+SecRule ARGS_NAMES "@rx ^(cmd|exec)$" "id:103,deny,nolog"
+SecRule REQUEST_FILENAME "@beginsWith /internal" "id:104,deny,status:404,nolog,t:normalizePath"
+SecRule REMOTE_ADDR "@ipMatch 198.51.100.0/24" "id:105,deny,nolog"
+SecRule ARGS_POST:/^pass/ "@rx ^.{0,3}$" "id:106,deny,status:400,nolog"
+`)
+
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		userAgent  string
+		remoteAddr string
+		blocked    bool
+		reason     string
+		status     int
+		matches    []int
+	}{
+		{name: "clean request", target: "/orders?page=1"},
+		{name: "pass rule matches without blocking", target: "/orders?debug=1", matches: []int{100}},
+		{name: "phase 1 before phase 2", target: "/orders?debug=1&q=<script>", userAgent: "sqlmap/1.7", blocked: true, reason: "WAF_RULE_101", status: http.StatusTooManyRequests, matches: []int{101}},
+		{name: "transformations", target: "/orders?q=%253CSCRIPT%253E", blocked: true, reason: "WAF_RULE_102", status: http.StatusForbidden, matches: []int{102}},
+		{name: "excluded argument", target: "/orders?comment=%3Cscript%3E"},
+		{name: "argument name", target: "/orders?cmd=ls", blocked: true, reason: "WAF_RULE_103", status: http.StatusForbidden, matches: []int{103}},
+		{name: "normalized path", target: "/public/../internal/metrics", blocked: true, reason: "WAF_RULE_104", status: http.StatusNotFound, matches: []int{104}},
+		{name: "remote address", target: "/orders", remoteAddr: "198.51.100.7:4711", blocked: true, reason: "WAF_RULE_105", status: http.StatusForbidden, matches: []int{105}},
+		{name: "key pattern of body argument", target: "/login", body: "user=a&password=abc", blocked: true, reason: "WAF_RULE_106", status: http.StatusBadRequest, matches: []int{106}},
+		{name: "key pattern does not match other arguments", target: "/login", body: "user=a&password=secret123"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRequest(t, http.MethodPost, test.target, test.body, "application/x-www-form-urlencoded")
+			if test.userAgent != "" {
+				r.Header.Set("User-Agent", test.userAgent)
+			}
+			if test.remoteAddr != "" {
+				r.RemoteAddr = test.remoteAddr
+			}
+			decision := rules.Evaluate(NewTransaction(r, ReadBody(r, DEFAULT_MAX_BODY_SIZE)))
+			if decision.Blocked != test.blocked || decision.Reason != test.reason || decision.Status != test.status {
+				t.Fatalf("Evaluate(%s) = %+v, want blocked %v by %q with %d", test.target, decision, test.blocked, test.reason, test.status)
+			}
+			matches := []int{}
+			for _, match := range decision.Matches {
+				matches = append(matches, match.RuleID)
+			}
+			if len(test.matches) == 0 {
+				test.matches = []int{}
+			}
+			if !reflect.DeepEqual(matches, test.matches) {
+				t.Errorf("Evaluate(%s) matched rules %v, want %v", test.target, matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestPolicyRulesBeforeEngine(t *testing.T) {
+	policy := NewPolicy(MODE_BLOCK, 0, 0)
+	policy.Rules = mustParseRules(t, `SecRule ARGS:q "@contains <script" "id:100,deny,status:406,nolog"`)
+
+	decision := policy.Inspect(newRequest(t, http.MethodGet, query("q", "<script>alert(1)</script>"), "", ""))
+	if !decision.Blocked || decision.Reason != "WAF_RULE_100" || decision.Status != http.StatusNotAcceptable {
+		t.Errorf("Inspect() = %+v, want blocked by rule 100", decision)
+	}
+
+	// Pass rules are reported together with the matches of the engine
+	policy.Rules = mustParseRules(t, `SecRule ARGS:q "@contains <script" "id:100,pass,nolog"`)
+	decision = policy.Inspect(newRequest(t, http.MethodGet, query("q", "<script>alert(1)</script>"), "", ""))
+	if !decision.Blocked || decision.Reason != "WAF_XSS" || decision.Matches[0].RuleID != 100 {
+		t.Errorf("Inspect() = %+v, want blocked by the engine after rule 100", decision)
+	}
+}
@@ -0,0 +1,202 @@
+package waf
+
+import (
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const CATEGORY_RULE Category = "RULE"
+
+// RuleSet is the compiled list of SecLang rules of a route
+type RuleSet struct {
+	Rules []SecRule
+}
+
+// Transaction holds the variable collections of a request
+type Transaction struct {
+	Collections map[string][]Target
+}
+
+func NewRuleSet(rules []SecRule) *RuleSet {
+	ordered := make([]SecRule, len(rules))
+	copy(ordered, rules)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Phase < ordered[j].Phase
+	})
+	return &RuleSet{
+		Rules: ordered,
+	}
+}
+
+// NewTransaction builds the variable collections of the request
+func NewTransaction(r *http.Request, body Body) *Transaction {
+	tx := &Transaction{Collections: map[string][]Target{}}
+
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+	tx.add("REMOTE_ADDR", "", remoteAddr)
+	tx.add("REQUEST_METHOD", "", r.Method)
+	tx.add("REQUEST_PROTOCOL", "", r.Proto)
+	tx.add("REQUEST_URI", "", r.URL.RequestURI())
+	tx.add("REQUEST_URI_RAW", "", r.RequestURI)
+	tx.add("REQUEST_FILENAME", "", r.URL.Path)
+	tx.add("REQUEST_BASENAME", "", path.Base(r.URL.Path))
+	tx.add("REQUEST_LINE", "", r.Method+" "+r.URL.RequestURI()+" "+r.Proto)
+	tx.add("QUERY_STRING", "", r.URL.RawQuery)
+
+	for name, values := range r.URL.Query() {
+		tx.add("ARGS_GET_NAMES", name, name)
+		tx.add("ARGS_NAMES", name, name)
+		for _, value := range values {
+			tx.add("ARGS_GET", name, value)
+			tx.add("ARGS", name, value)
+		}
+	}
+
+	for name, values := range r.Header {
+		tx.add("REQUEST_HEADERS_NAMES", name, name)
+		for _, value := range values {
+			tx.add("REQUEST_HEADERS", name, value)
+		}
+	}
+	for _, cookie := range r.Cookies() {
+		tx.add("REQUEST_COOKIES_NAMES", cookie.Name, cookie.Name)
+		tx.add("REQUEST_COOKIES", cookie.Name, cookie.Value)
+	}
+
+	if len(body.Data) > 0 {
+		tx.add("REQUEST_BODY", "", string(body.Data))
+		for _, target := range collectBodyTargets(body) {
+			switch {
+			case target.Name == "body_name":
+				tx.add("ARGS_POST_NAMES", target.Value, target.Value)
+				tx.add("ARGS_NAMES", target.Value, target.Value)
+			case target.Name != "body":
+				name := strings.TrimPrefix(strings.TrimPrefix(target.Name, "body:"), "body.")
+				tx.add("ARGS_POST", name, target.Value)
+				tx.add("ARGS", name, target.Value)
+			}
+		}
+	}
+
+	return tx
+}
+
+func (tx *Transaction) add(collection string, key string, value string) {
+	tx.Collections[collection] = append(tx.Collections[collection], Target{Name: key, Value: value})
+}
+
+// Values returns the values selected by the variables of a rule
+func (tx *Transaction) Values(variables []Variable) []Target {
+	values := []Target{}
+	for _, variable := range variables {
+		if variable.Exclude {
+			continue
+		}
+		for _, target := range tx.Collections[variable.Collection] {
+			if !variable.selects(target.Name) || excluded(variables, variable.Collection, target.Name) {
+				continue
+			}
+			name := variable.Collection
+			if target.Name != "" {
+				name += ":" + target.Name
+			}
+			values = append(values, Target{Name: name, Value: target.Value})
+		}
+	}
+	return values
+}
+
+func (v Variable) selects(key string) bool {
+	switch {
+	case v.KeyPattern != nil:
+		return v.KeyPattern.MatchString(key)
+	case v.Key != "":
+		return strings.ToLower(key) == v.Key
+	default:
+		return true
+	}
+}
+
+func excluded(variables []Variable, collection string, key string) bool {
+	for _, variable := range variables {
+		if variable.Exclude && variable.Collection == collection && variable.selects(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate runs the rules in phase order. The first matching deny rule
+// stops the evaluation and blocks the request.
+func (rs *RuleSet) Evaluate(tx *Transaction) Decision {
+	decision := Decision{}
+	for _, rule := range rs.Rules {
+		target, matched := rule.match(tx)
+		if !matched {
+			continue
+		}
+
+		if rule.Log {
+			log.Printf("WAF rule %d matched %s: %s\n", rule.ID, target, rule.Message)
+		}
+		decision.Matches = append(decision.Matches, Match{
+			RuleID:   rule.ID,
+			Category: CATEGORY_RULE,
+			Target:   target,
+		})
+		if rule.Action == SEC_ACTION_DENY {
+			decision.Reason = "WAF_RULE_" + strconv.Itoa(rule.ID)
+			decision.Status = rule.Status
+			decision.Blocked = true
+			return decision
+		}
+	}
+	return decision
+}
+
+func (rule SecRule) match(tx *Transaction) (string, bool) {
+	for _, target := range tx.Values(rule.Variables) {
+		value := target.Value
+		for _, transformation := range rule.Transformations {
+			value = transformation(value)
+		}
+		if rule.Operator.Match(value) != rule.Operator.Negated {
+			return target.Name, true
+		}
+	}
+	return "", false
+}
+
+func urlDecode(value string) string {
+	decoded, err := url.QueryUnescape(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func htmlEntityDecode(value string) string {
+	return html.UnescapeString(value)
+}
+
+func normalizePath(value string) string {
+	if value == "" {
+		return value
+	}
+	value = strings.ReplaceAll(value, "\\", "/")
+	normalized := path.Clean(value)
+	if strings.HasSuffix(value, "/") && normalized != "/" {
+		normalized += "/"
+	}
+	return normalized
+}
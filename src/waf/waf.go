@@ -0,0 +1,241 @@
+package waf
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type Mode string
+
+const MODE_OFF Mode = "OFF"
+const MODE_DETECT Mode = "DETECT"
+const MODE_BLOCK Mode = "BLOCK"
+
+const DEFAULT_THRESHOLD = 5
+const DEFAULT_MAX_BODY_SIZE = 64 * 1024
+
+// Headers which are inspected besides path, query and body
+var InspectedHeaders = []string{
+	"User-Agent",
+	"Referer",
+	"Cookie",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+}
+
+// Policy is the WAF configuration of a single route
+type Policy struct {
+	Mode        Mode
+	Threshold   int
+	MaxBodySize int64
+	Engine      *Engine
+	Rules       *RuleSet
+}
+
+// Match is a single rule hit
+type Match struct {
+	RuleID   int
+	Category Category
+	Target   string
+	Score    int
+}
+
+// Decision is the result of the inspection of a request
+type Decision struct {
+	Score   int
+	Reason  string
+	Status  int
+	Matches []Match
+	Blocked bool
+}
+
+// Body is the inspected part of the request body
+type Body struct {
+	MediaType string
+	Data      []byte
+	Truncated bool
+}
+
+// Target is a single value of the request which gets inspected
+type Target struct {
+	Name  string
+	Value string
+}
+
+func NewPolicy(mode Mode, threshold int, maxBodySize int64) Policy {
+	if threshold <= 0 {
+		threshold = DEFAULT_THRESHOLD
+	}
+	if maxBodySize <= 0 {
+		maxBodySize = DEFAULT_MAX_BODY_SIZE
+	}
+	return Policy{
+		Mode:        mode,
+		Threshold:   threshold,
+		MaxBodySize: maxBodySize,
+		Engine:      DefaultEngine(),
+	}
+}
+
+func ParseMode(mode string) Mode {
+	switch Mode(strings.ToUpper(mode)) {
+	case MODE_DETECT:
+		return MODE_DETECT
+	case MODE_BLOCK:
+		return MODE_BLOCK
+	default:
+		return MODE_OFF
+	}
+}
+
+// Enabled returns true if the policy inspects requests
+func (p Policy) Enabled() bool {
+	return p.Mode == MODE_DETECT || p.Mode == MODE_BLOCK
+}
+
+// Inspect scans the request against the rule set of the policy
+func (p Policy) Inspect(r *http.Request) Decision {
+	if !p.Enabled() || (p.Engine == nil && p.Rules == nil) {
+		return Decision{}
+	}
+
+	body := ReadBody(r, p.MaxBodySize)
+	decision := Decision{}
+	if p.Rules != nil {
+		decision = p.Rules.Evaluate(NewTransaction(r, body))
+	}
+	if !decision.Blocked && p.Engine != nil {
+		scored := p.Engine.Evaluate(CollectTargets(r, body))
+		scored.Matches = append(decision.Matches, scored.Matches...)
+		decision = scored
+		decision.Blocked = decision.Score >= p.Threshold
+	}
+	decision.Blocked = decision.Blocked && p.Mode == MODE_BLOCK
+	return decision
+}
+
+// ReadBody reads the body of form and JSON requests up to maxBodySize bytes.
+// The body is restored afterwards so it can still be forwarded to the target.
+func ReadBody(r *http.Request, maxBodySize int64) Body {
+	if r.Body == nil || r.Body == http.NoBody || maxBodySize <= 0 {
+		return Body{}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return Body{}
+	}
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return Body{}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return Body{}
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+
+	if int64(len(data)) > maxBodySize {
+		return Body{MediaType: mediaType, Data: data[:maxBodySize], Truncated: true}
+	}
+	return Body{MediaType: mediaType, Data: data}
+}
+
+// CollectTargets extracts the inspected values of the request
+func CollectTargets(r *http.Request, body Body) []Target {
+	targets := []Target{{Name: "path", Value: r.URL.Path}}
+	if r.URL.RawPath != "" {
+		targets = append(targets, Target{Name: "path", Value: r.URL.RawPath})
+	}
+
+	// The raw query covers pairs which are dropped by the parser
+	if r.URL.RawQuery != "" {
+		targets = append(targets, Target{Name: "query", Value: r.URL.RawQuery})
+	}
+	for name, values := range r.URL.Query() {
+		targets = append(targets, Target{Name: "query_name", Value: name})
+		for _, value := range values {
+			targets = append(targets, Target{Name: "query:" + name, Value: value})
+		}
+	}
+
+	for _, header := range InspectedHeaders {
+		for _, value := range r.Header.Values(header) {
+			targets = append(targets, Target{Name: "header:" + header, Value: value})
+		}
+	}
+
+	return append(targets, collectBodyTargets(body)...)
+}
+
+func collectBodyTargets(body Body) []Target {
+	if len(body.Data) == 0 {
+		return nil
+	}
+
+	// Bodies above the limit are only inspected as raw text
+	if body.Truncated {
+		return []Target{{Name: "body", Value: string(body.Data)}}
+	}
+
+	targets := []Target{}
+	switch body.MediaType {
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body.Data))
+		if err != nil {
+			return []Target{{Name: "body", Value: string(body.Data)}}
+		}
+		for name, list := range values {
+			targets = append(targets, Target{Name: "body_name", Value: name})
+			for _, value := range list {
+				targets = append(targets, Target{Name: "body:" + name, Value: value})
+			}
+		}
+	default:
+		var data interface{}
+		if err := json.Unmarshal(body.Data, &data); err != nil {
+			return []Target{{Name: "body", Value: string(body.Data)}}
+		}
+		targets = collectJSONTargets("body", data, targets)
+	}
+
+	return targets
+}
+
+func collectJSONTargets(name string, data interface{}, targets []Target) []Target {
+	switch value := data.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			targets = append(targets, Target{Name: "body_name", Value: key})
+			targets = collectJSONTargets(name+"."+key, item, targets)
+		}
+	case []interface{}:
+		for _, item := range value {
+			targets = collectJSONTargets(name, item, targets)
+		}
+	case string:
+		targets = append(targets, Target{Name: name, Value: value})
+	}
+	return targets
+}
+
+// normalize lowercases the value and removes (multiple) URL encoding
+func normalize(value string) string {
+	for i := 0; i < 3 && strings.Contains(value, "%"); i++ {
+		decoded, err := url.QueryUnescape(value)
+		if err != nil || decoded == value {
+			break
+		}
+		value = decoded
+	}
+	value = strings.ReplaceAll(value, "\x00", "")
+	return strings.ToLower(value)
+}
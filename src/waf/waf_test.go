@@ -0,0 +1,181 @@
+package waf
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newRequest(t *testing.T, method string, target string, body string, contentType string) *http.Request {
+	t.Helper()
+	var r *http.Request
+	if body == "" {
+		r = httptest.NewRequest(method, target, nil)
+	} else {
+		r = httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+	}
+	return r
+}
+
+func query(name string, value string) string {
+	return "/search?" + url.Values{name: {value}}.Encode()
+}
+
+func TestInspect(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		body        string
+		contentType string
+		header      string
+		blocked     bool
+		reason      string
+	}{
+		// SQL injection
+		{name: "union select", target: query("id", "1 UNION ALL SELECT password FROM users"), blocked: true, reason: "WAF_SQLI"},
+		{name: "tautology", target: query("user", "admin' OR '1'='1"), blocked: true, reason: "WAF_SQLI"},
+		{name: "stacked query", target: query("id", "1; DROP TABLE users"), blocked: true, reason: "WAF_SQLI"},
+		{name: "time based", target: query("id", "1 AND SLEEP(5)"), blocked: true, reason: "WAF_SQLI"},
+		{name: "double encoded", target: "/search?id=1%2520UNION%2520SELECT%2520password", blocked: true, reason: "WAF_SQLI"},
+		{name: "union in text", target: query("q", "the union of workers selected a leader")},
+		{name: "apostrophe in name", target: query("name", "O'Brien")},
+
+		// Cross-site scripting
+		{name: "script tag", target: query("q", "<script>alert(1)</script>"), blocked: true, reason: "WAF_XSS"},
+		{name: "event handler", target: query("q", `<img src=x onerror=alert(1)>`), blocked: true, reason: "WAF_XSS"},
+		{name: "event handler after quote", target: query("q", `<a href="x"onmouseover=alert(1)>`), blocked: true, reason: "WAF_XSS"},
+		{name: "event handler after slash", target: query("q", "<svg/onload=alert(1)>"), blocked: true, reason: "WAF_XSS"},
+		{name: "javascript url", target: query("next", "javascript:alert(document.cookie)"), blocked: true, reason: "WAF_XSS"},
+		{name: "query parameter onload", target: "/search?onload=1&onerror=retry"},
+		{name: "first query parameter onload", target: "/search?onload=1"},
+		{name: "event name in text", target: query("q", "the onload event")},
+		{name: "comparison in text", target: query("q", "a < b and c > d")},
+
+		// Path traversal
+		{name: "dot dot slash", target: "/files?name=../../etc/passwd", blocked: true, reason: "WAF_PATH_TRAVERSAL"},
+		{name: "encoded traversal", target: "/files?name=%2e%2e%2f%2e%2e%2fboot.ini", blocked: true, reason: "WAF_PATH_TRAVERSAL"},
+		{name: "windows traversal", target: query("name", `..\..\windows\win.ini`), blocked: true, reason: "WAF_PATH_TRAVERSAL"},
+		{name: "dots in file name", target: query("name", "report..final.pdf")},
+		{name: "version", target: "/download/v1.2.3/app.tar.gz"},
+
+		// Command injection
+		{name: "semicolon command", target: query("host", "example.com;cat secret.txt"), blocked: true, reason: "WAF_COMMAND_INJECTION"},
+		{name: "semicolon id", target: query("host", "example.com;id"), blocked: true, reason: "WAF_COMMAND_INJECTION"},
+		{name: "and command", target: query("host", "example.com && whoami"), blocked: true, reason: "WAF_COMMAND_INJECTION"},
+		{name: "pipe command", target: query("host", "example.com | ls -la"), blocked: true, reason: "WAF_COMMAND_INJECTION"},
+		{name: "ifs", target: query("host", "cat${IFS}secret.txt"), blocked: true, reason: "WAF_COMMAND_INJECTION"},
+		{name: "ampersand separated query", target: "/search?page=2&id=5&ls=1"},
+		{name: "query with cat parameter", target: "/search?a=1&sort=name&cat=books"},
+		{name: "cookie with id", target: "/", header: "a=1; id=5"},
+		{name: "command name in text", target: query("q", "curl is a tool; it is used by many")},
+
+		// Bodies
+		{name: "form body", target: "/login", body: "user=admin'--&password=x' OR 'a'='a", contentType: "application/x-www-form-urlencoded", blocked: true, reason: "WAF_SQLI"},
+		{name: "json body", target: "/comments", body: `{"comment":{"text":"<script>alert(1)</script>"}}`, contentType: "application/json", blocked: true, reason: "WAF_XSS"},
+		{name: "json key", target: "/comments", body: `{"<script>x":"1"}`, contentType: "application/json", blocked: true, reason: "WAF_XSS"},
+		{name: "benign json body", target: "/comments", body: `{"text":"select the union of both lists","count":5}`, contentType: "application/json"},
+		{name: "binary body is not inspected", target: "/upload", body: "<script>alert(1)</script>", contentType: "application/octet-stream"},
+	}
+
+	policy := NewPolicy(MODE_BLOCK, 0, 0)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRequest(t, http.MethodPost, test.target, test.body, test.contentType)
+			if test.header != "" {
+				r.Header.Set("Cookie", test.header)
+			}
+			decision := policy.Inspect(r)
+			if decision.Blocked != test.blocked {
+				t.Fatalf("Inspect(%s) = %+v, want blocked %v", test.target, decision, test.blocked)
+			}
+			if test.blocked && decision.Reason != test.reason {
+				t.Errorf("Inspect(%s) reason = %q, want %q", test.target, decision.Reason, test.reason)
+			}
+		})
+	}
+}
+
+func TestInspectThreshold(t *testing.T) {
+	// Rule 1003 (SQL comment after a quote) is a warning of score 3, rule
+	// 1006 (system tables) another 3
+	tests := []struct {
+		name      string
+		value     string
+		threshold int
+		score     int
+		blocked   bool
+	}{
+		{name: "single warning below threshold", value: "name'--", threshold: DEFAULT_THRESHOLD, score: SCORE_WARNING},
+		{name: "two warnings reach threshold", value: "name'-- information_schema", threshold: DEFAULT_THRESHOLD, score: 2 * SCORE_WARNING, blocked: true},
+		{name: "raised threshold", value: "name'-- information_schema", threshold: 10, score: 2 * SCORE_WARNING},
+		{name: "lowered threshold", value: "name'--", threshold: SCORE_WARNING, score: SCORE_WARNING, blocked: true},
+		{name: "rule counts once", value: "a'-- b'-- c'--", threshold: DEFAULT_THRESHOLD, score: SCORE_WARNING},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := NewPolicy(MODE_BLOCK, test.threshold, 0).Inspect(newRequest(t, http.MethodGet, query("q", test.value), "", ""))
+			if decision.Score != test.score || decision.Blocked != test.blocked {
+				t.Errorf("Inspect(%q) = score %d blocked %v, want score %d blocked %v", test.value, decision.Score, decision.Blocked, test.score, test.blocked)
+			}
+		})
+	}
+}
+
+func TestInspectModes(t *testing.T) {
+	target := query("q", "<script>alert(1)</script>")
+	tests := []struct {
+		mode    Mode
+		matched bool
+		blocked bool
+	}{
+		{MODE_OFF, false, false},
+		{MODE_DETECT, true, false},
+		{MODE_BLOCK, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			decision := NewPolicy(test.mode, 0, 0).Inspect(newRequest(t, http.MethodGet, target, "", ""))
+			if (len(decision.Matches) > 0) != test.matched || decision.Blocked != test.blocked {
+				t.Errorf("Inspect() in mode %s = %+v, want matched %v blocked %v", test.mode, decision, test.matched, test.blocked)
+			}
+		})
+	}
+}
+
+func TestReadBodyRestoresBody(t *testing.T) {
+	body := `{"text":"` + strings.Repeat("a", 100) + `"}`
+	r := newRequest(t, http.MethodPost, "/comments", body, "application/json")
+
+	inspected := ReadBody(r, 10)
+	if !inspected.Truncated || len(inspected.Data) != 10 {
+		t.Fatalf("ReadBody() = %d bytes truncated %v, want 10 bytes truncated", len(inspected.Data), inspected.Truncated)
+	}
+	forwarded, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(forwarded) != body {
+		t.Errorf("forwarded body = %q, want %q", forwarded, body)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := map[string]Mode{
+		"block":   MODE_BLOCK,
+		"DETECT":  MODE_DETECT,
+		"off":     MODE_OFF,
+		"":        MODE_OFF,
+		"enforce": MODE_OFF,
+	}
+	for mode, want := range tests {
+		if got := ParseMode(mode); got != want {
+			t.Errorf("ParseMode(%q) = %s, want %s", mode, got, want)
+		}
+	}
+}